@@ -2,14 +2,21 @@ package apiwatcher
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
+
+	metrics "github.com/a-castellano/AlarmStatusWatcher/metrics"
 )
 
+// DefaultConcurrency is the number of device status requests sent in parallel when none is configured
+const DefaultConcurrency = 4
+
 type DeviceInfo struct {
 	Online bool
 	Firing bool
@@ -17,18 +24,56 @@ type DeviceInfo struct {
 	Name   string
 }
 
+// FetchState tells whether device info in a snapshot is current
+type FetchState string
+
+const (
+	// FetchOK means device status was retrieved in this snapshot
+	FetchOK FetchState = "ok"
+	// FetchError means device status request failed
+	FetchError FetchState = "error"
+	// FetchStale means device status request failed and last known status is used instead
+	FetchStale FetchState = "stale"
+	// FetchCached means device was not due to be polled and last known status is used instead
+	FetchCached FetchState = "cached"
+)
+
+// FetchStatus is the result of retrieving one device status
+type FetchStatus struct {
+	State   FetchState
+	Message string
+}
+
 type APIInfo struct {
 	DevicesInfo map[string]DeviceInfo
-	Time        int64
+	// DevicesStatus holds fetch result of every listed device
+	DevicesStatus map[string]FetchStatus
+	Time          int64
+}
+
+// Status returns device fetch status, devices without status are considered ok
+func (apiInfo APIInfo) Status(deviceID string) FetchStatus {
+	if status, ok := apiInfo.DevicesStatus[deviceID]; ok {
+		return status
+	}
+	return FetchStatus{State: FetchOK}
 }
 
 type Watcher interface {
-	ShowInfo(http.Client) (APIInfo, error)
+	ShowInfo(context.Context, AlarmManagerRequester) (APIInfo, error)
 }
 
 type APIWatcher struct {
 	Host string
 	Port int
+	// Concurrency limits how many device status requests are sent at once
+	Concurrency int
+	// RequestTimeout limits each request duration, 0 disables it
+	RequestTimeout time.Duration
+	// Due tells whether a device status has to be requested in this poll,
+	// every device is requested when it is not set
+	Due     func(deviceID string) bool
+	Metrics *metrics.Metrics
 }
 
 type Requester struct {
@@ -57,58 +102,109 @@ type DeviceInfoRequest struct {
 	Online  bool   `json:"online"`
 }
 
-func (watcher APIWatcher) ShowInfo(alarmManager AlarmManagerRequester) (APIInfo, error) {
-	var apiInfo APIInfo
+func (watcher APIWatcher) get(ctx context.Context, alarmManager AlarmManagerRequester, requestURL string, target interface{}) error {
 	var body []byte
 
-	requestURL := fmt.Sprintf("http://%s:%d/devices", watcher.Host, watcher.Port)
-	apiInfo.DevicesInfo = make(map[string]DeviceInfo)
+	if watcher.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, watcher.RequestTimeout)
+		defer cancel()
+	}
 
-	request, requestError := http.NewRequest("GET", requestURL, bytes.NewReader(body))
+	request, requestError := http.NewRequestWithContext(ctx, "GET", requestURL, bytes.NewReader(body))
 	if requestError != nil {
-		return apiInfo, requestError
+		return requestError
 	}
 	response, responseErr := alarmManager.CallAlarmManager(request)
 	if responseErr != nil {
-		return apiInfo, responseErr
+		return responseErr
 	}
 	defer response.Body.Close()
-	bs, _ := ioutil.ReadAll(response.Body)
+	bs, readErr := ioutil.ReadAll(response.Body)
+	if readErr != nil {
+		return readErr
+	}
+	return json.Unmarshal(bs, target)
+}
 
-	devicesInfo := DevicesInfoRequest{}
-	unmarshalErr := json.Unmarshal(bs, &devicesInfo)
-	if unmarshalErr != nil {
-		return apiInfo, unmarshalErr
+func (watcher APIWatcher) fetchDevice(ctx context.Context, alarmManager AlarmManagerRequester, deviceID string, deviceName string) (DeviceInfo, error) {
+	var deviceInfo DeviceInfo
+
+	deviceRequestURL := fmt.Sprintf("http://%s:%d/devices/status/%s", watcher.Host, watcher.Port, deviceID)
+	deviceInfoRequest := DeviceInfoRequest{}
+	if requestErr := watcher.get(ctx, alarmManager, deviceRequestURL, &deviceInfoRequest); requestErr != nil {
+		return deviceInfo, requestErr
+	}
+	if deviceInfoRequest.Success == false {
+		return deviceInfo, errors.New(deviceInfoRequest.Msg)
 	}
+	deviceInfo.Online = deviceInfoRequest.Online
+	deviceInfo.Mode = deviceInfoRequest.Mode
+	deviceInfo.Firing = deviceInfoRequest.Firing
+	deviceInfo.Name = deviceName
+	return deviceInfo, nil
+}
 
-	for device_id, device_name := range devicesInfo.Data {
-		deviceRequestURL := fmt.Sprintf("http://%s:%d/devices/status/%s", watcher.Host, watcher.Port, device_id)
-		var deviceInfo DeviceInfo
+// ShowInfo retrieves the device list and then each device status using a
+// bounded pool of workers. Only a failure retrieving the device list is
+// returned as error, device failures are collected in DevicesStatus.
+func (watcher APIWatcher) ShowInfo(ctx context.Context, alarmManager AlarmManagerRequester) (APIInfo, error) {
+	var apiInfo APIInfo
 
-		deviceRequest, deviceRequestError := http.NewRequest("GET", deviceRequestURL, bytes.NewReader(body))
-		if deviceRequestError != nil {
-			return apiInfo, deviceRequestError
-		}
-		deviceResponse, deviceResponseErr := alarmManager.CallAlarmManager(deviceRequest)
-		if deviceResponseErr != nil {
-			return apiInfo, responseErr
-		}
-		defer deviceResponse.Body.Close()
-		deviceBodySource, _ := ioutil.ReadAll(deviceResponse.Body)
-		deviceInfoRequest := DeviceInfoRequest{}
-		unmarshalDeviceErr := json.Unmarshal(deviceBodySource, &deviceInfoRequest)
-		if unmarshalDeviceErr != nil {
-			return apiInfo, unmarshalDeviceErr
-		}
-		if deviceInfoRequest.Success == false {
-			return apiInfo, errors.New(deviceInfoRequest.Msg)
+	requestURL := fmt.Sprintf("http://%s:%d/devices", watcher.Host, watcher.Port)
+	apiInfo.DevicesInfo = make(map[string]DeviceInfo)
+	apiInfo.DevicesStatus = make(map[string]FetchStatus)
+
+	devicesInfo := DevicesInfoRequest{}
+	if requestErr := watcher.get(ctx, alarmManager, requestURL, &devicesInfo); requestErr != nil {
+		watcher.Metrics.PollError("request")
+		return apiInfo, requestErr
+	}
+
+	dueDevices := make([]string, 0, len(devicesInfo.Data))
+	for deviceID := range devicesInfo.Data {
+		if watcher.Due != nil && !watcher.Due(deviceID) {
+			apiInfo.DevicesStatus[deviceID] = FetchStatus{State: FetchCached}
+			continue
 		}
-		deviceInfo.Online = deviceInfoRequest.Online
-		deviceInfo.Mode = deviceInfoRequest.Mode
-		deviceInfo.Firing = deviceInfoRequest.Firing
-		deviceInfo.Name = device_name
-		apiInfo.DevicesInfo[device_id] = deviceInfo
+		dueDevices = append(dueDevices, deviceID)
+	}
+
+	concurrency := watcher.Concurrency
+	if concurrency < 1 {
+		concurrency = DefaultConcurrency
+	}
+	if concurrency > len(dueDevices) {
+		concurrency = len(dueDevices)
 	}
+
+	deviceIDs := make(chan string)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deviceID := range deviceIDs {
+				deviceInfo, deviceErr := watcher.fetchDevice(ctx, alarmManager, deviceID, devicesInfo.Data[deviceID])
+				mutex.Lock()
+				if deviceErr != nil {
+					watcher.Metrics.PollError("device")
+					apiInfo.DevicesStatus[deviceID] = FetchStatus{State: FetchError, Message: deviceErr.Error()}
+				} else {
+					apiInfo.DevicesStatus[deviceID] = FetchStatus{State: FetchOK}
+					apiInfo.DevicesInfo[deviceID] = deviceInfo
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, deviceID := range dueDevices {
+		deviceIDs <- deviceID
+	}
+	close(deviceIDs)
+	wg.Wait()
+
 	now := time.Now()
 	apiInfo.Time = now.Unix()
 	return apiInfo, nil
@@ -2,9 +2,16 @@ package apiwatcher
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type RoundTripperMock struct {
@@ -89,7 +96,7 @@ func TestGetOneDevice(t *testing.T) {
 	mock := MockAlarManagerOneDevice{}
 
 	watcher := APIWatcher{Host: "server.local", Port: 8080}
-	apiInfo, err := watcher.ShowInfo(&mock)
+	apiInfo, err := watcher.ShowInfo(context.TODO(), &mock)
 
 	if err != nil {
 		t.Errorf("TestGetOneDevice should not fail, error was '%s'", err.Error())
@@ -106,7 +113,7 @@ func TestGetOneDeviceErrorOnList(t *testing.T) {
 	mock := MockAlarManagerErrorFirstRequest{}
 
 	watcher := APIWatcher{Host: "server.local", Port: 8080}
-	_, err := watcher.ShowInfo(&mock)
+	_, err := watcher.ShowInfo(context.TODO(), &mock)
 
 	if err == nil {
 		t.Errorf("TestGetOneDeviceErrorOnList should fail.")
@@ -119,10 +126,16 @@ func TestGetOneDeviceErrorOnDeviceInfo(t *testing.T) {
 	mock := MockAlarManagerErrorSecondRequest{}
 
 	watcher := APIWatcher{Host: "server.local", Port: 8080}
-	_, err := watcher.ShowInfo(&mock)
+	apiInfo, err := watcher.ShowInfo(context.TODO(), &mock)
 
-	if err == nil {
-		t.Errorf("TestGetOneDeviceErrorOnDeviceInfo should fail.")
+	if err != nil {
+		t.Errorf("TestGetOneDeviceErrorOnDeviceInfo should not fail, device errors are collected. Error was '%s'", err.Error())
+	}
+	if apiInfo.Status("deviceid").State != FetchError {
+		t.Errorf("TestGetOneDeviceErrorOnDeviceInfo should collect deviceid error.")
+	}
+	if len(apiInfo.DevicesInfo) != 0 {
+		t.Errorf("TestGetOneDeviceErrorOnDeviceInfo should not contain device info.")
 	}
 
 }
@@ -132,10 +145,75 @@ func TestGetOneDeviceErrorOnDeviceRequest(t *testing.T) {
 	mock := MockAlarManagerSecondRequestWithError{}
 
 	watcher := APIWatcher{Host: "server.local", Port: 8080}
-	_, err := watcher.ShowInfo(&mock)
+	apiInfo, err := watcher.ShowInfo(context.TODO(), &mock)
 
-	if err == nil {
-		t.Errorf("TestGetOneDeviceErrorOnDeviceInfo should fail.")
+	if err != nil {
+		t.Errorf("TestGetOneDeviceErrorOnDeviceRequest should not fail, device errors are collected. Error was '%s'", err.Error())
+	}
+	if apiInfo.Status("deviceid").State != FetchError || apiInfo.Status("deviceid").Message != "Failed" {
+		t.Errorf("TestGetOneDeviceErrorOnDeviceRequest should collect 'Failed' error for deviceid.")
+	}
+
+}
+
+type MockAlarmManagerSeveralDevices struct {
+	Delay    time.Duration
+	inFlight int32
+	maxSeen  int32
+	mutex    sync.Mutex
+}
+
+func (m *MockAlarmManagerSeveralDevices) CallAlarmManager(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/devices" {
+		return &http.Response{Body: ioutil.NopCloser(bytes.NewBufferString(`{"success":true,"data":{"first":"First","second":"Second","third":"Third","broken":"Broken","slow":"Slow"}}`))}, nil
+	}
+	current := atomic.AddInt32(&m.inFlight, 1)
+	defer atomic.AddInt32(&m.inFlight, -1)
+	m.mutex.Lock()
+	if current > m.maxSeen {
+		m.maxSeen = current
+	}
+	m.mutex.Unlock()
+
+	deviceID := strings.TrimPrefix(req.URL.Path, "/devices/status/")
+	switch deviceID {
+	case "broken":
+		return nil, errors.New("connection reset")
+	case "slow":
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	time.Sleep(m.Delay)
+	return &http.Response{Body: ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"success":true,"msg":"","mode":"armed_%s","firing":false,"online":true}`, deviceID)))}, nil
+}
+
+func TestGetSeveralDevicesConcurrently(t *testing.T) {
+
+	mock := MockAlarmManagerSeveralDevices{Delay: time.Millisecond * 20}
+
+	watcher := APIWatcher{Host: "server.local", Port: 8080, Concurrency: 2, RequestTimeout: time.Millisecond * 100}
+	apiInfo, err := watcher.ShowInfo(context.TODO(), &mock)
+
+	if err != nil {
+		t.Fatalf("TestGetSeveralDevicesConcurrently should not fail, error was '%s'", err.Error())
+	}
+	if len(apiInfo.DevicesInfo) != 3 {
+		t.Errorf("TestGetSeveralDevicesConcurrently should retrieve 3 devices, not %d.", len(apiInfo.DevicesInfo))
+	}
+	if apiInfo.DevicesInfo["second"].Mode != "armed_second" || apiInfo.DevicesInfo["second"].Name != "Second" {
+		t.Errorf("TestGetSeveralDevicesConcurrently, unexpected second device info %+v.", apiInfo.DevicesInfo["second"])
+	}
+	if len(apiInfo.DevicesStatus) != 5 || apiInfo.Status("broken").State != FetchError || apiInfo.Status("slow").State != FetchError {
+		t.Errorf("TestGetSeveralDevicesConcurrently should collect broken and slow device errors, got %v.", apiInfo.DevicesStatus)
+	}
+	if apiInfo.Status("first").State != FetchOK {
+		t.Errorf("TestGetSeveralDevicesConcurrently, first device status should be ok, not %s.", apiInfo.Status("first").State)
+	}
+	if !strings.Contains(apiInfo.Status("slow").Message, context.DeadlineExceeded.Error()) {
+		t.Errorf("TestGetSeveralDevicesConcurrently, slow device should fail by timeout, error was '%s'.", apiInfo.Status("slow").Message)
+	}
+	if mock.maxSeen > 2 {
+		t.Errorf("TestGetSeveralDevicesConcurrently, no more than 2 requests should be in flight, %d were.", mock.maxSeen)
 	}
 
 }
@@ -153,3 +231,25 @@ func TestRequester(t *testing.T) {
 	}
 
 }
+
+func TestGetOnlyDueDevices(t *testing.T) {
+
+	mock := MockAlarmManagerSeveralDevices{}
+
+	watcher := APIWatcher{Host: "server.local", Port: 8080, RequestTimeout: time.Millisecond * 100}
+	watcher.Due = func(deviceID string) bool {
+		return deviceID == "first"
+	}
+	apiInfo, err := watcher.ShowInfo(context.TODO(), &mock)
+
+	if err != nil {
+		t.Fatalf("TestGetOnlyDueDevices should not fail, error was '%s'", err.Error())
+	}
+	if len(apiInfo.DevicesInfo) != 1 || apiInfo.Status("first").State != FetchOK {
+		t.Errorf("TestGetOnlyDueDevices should only retrieve first device, got %v.", apiInfo.DevicesInfo)
+	}
+	if apiInfo.Status("second").State != FetchCached || apiInfo.Status("slow").State != FetchCached {
+		t.Errorf("TestGetOnlyDueDevices, devices not due should be cached, got %v.", apiInfo.DevicesStatus)
+	}
+
+}
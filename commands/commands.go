@@ -0,0 +1,200 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	notifier "github.com/a-castellano/AlarmStatusWatcher/notifier"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+	"github.com/streadway/amqp"
+)
+
+// CommandAcknowledge acknowledges a device firing
+const CommandAcknowledge = "acknowledge"
+
+// Acknowledger records firing acknowledgements
+type Acknowledger interface {
+	Acknowledge(ctx context.Context, acknowledgement events.Acknowledgement) error
+}
+
+// Command is the JSON document consumed from the command queue
+type Command struct {
+	Command  string `json:"command"`
+	DeviceID string `json:"device_id"`
+	By       string `json:"by"`
+	Comment  string `json:"comment"`
+}
+
+// Consumer reads commands from the RabbitMQ command queue. Invalid commands
+// and commands for unknown or not firing devices are rejected without being
+// requeued. Commands failing otherwise, such as storage errors, are requeued
+// once and rejected if they fail again once redelivered so a broken command
+// is not retried forever.
+type Consumer struct {
+	Config       config_reader.RabbitmqConfig
+	Acknowledger Acknowledger
+	Dial         func(url string, amqpConfig amqp.Config) (notifier.AMQPConnection, error)
+	// TLSConfig is used for amqps connections
+	TLSConfig      *tls.Config
+	ReconnectDelay time.Duration
+	MaxReconnect   time.Duration
+}
+
+// NewConsumer returns a Consumer reading configured command queue
+func NewConsumer(config config_reader.RabbitmqConfig, acknowledger Acknowledger) (*Consumer, error) {
+	consumer := &Consumer{Config: config, Acknowledger: acknowledger}
+	if config.TLS.Enabled {
+		tlsConfig, tlsErr := notifier.NewTLSConfig(config.TLS)
+		if tlsErr != nil {
+			return nil, tlsErr
+		}
+		consumer.TLSConfig = tlsConfig
+	}
+	return consumer, nil
+}
+
+// Run consumes commands until ctx is cancelled, reconnecting to the broker
+// when the connection is lost
+func (consumer *Consumer) Run(ctx context.Context) {
+	if consumer.Dial == nil {
+		consumer.Dial = notifier.DialAMQP
+	}
+	if consumer.ReconnectDelay <= 0 {
+		consumer.ReconnectDelay = time.Second
+	}
+	if consumer.MaxReconnect < consumer.ReconnectDelay {
+		consumer.MaxReconnect = time.Minute
+	}
+
+	delay := consumer.ReconnectDelay
+	for ctx.Err() == nil {
+		consumeErr := consumer.consume(ctx, func() {
+			delay = consumer.ReconnectDelay
+		})
+		if consumeErr == nil {
+			continue
+		}
+		log.Printf("RabbitMQ command consumer failed, retrying in %s: %s", delay, consumeErr.Error())
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		delay = delay * 2
+		if delay > consumer.MaxReconnect {
+			delay = consumer.MaxReconnect
+		}
+	}
+}
+
+// consume handles deliveries of a single connection calling established once
+// consuming starts, it only returns nil once ctx is cancelled
+func (consumer *Consumer) consume(ctx context.Context, established func()) error {
+	connection, errDial := consumer.Dial(notifier.AMQPURL(consumer.Config), notifier.AMQPConfig(consumer.Config, consumer.TLSConfig))
+	if errDial != nil {
+		return errDial
+	}
+	defer connection.Close()
+	channel, errChannel := connection.Channel()
+	if errChannel != nil {
+		return errChannel
+	}
+	defer channel.Close()
+
+	_, errQueue := channel.QueueDeclare(
+		consumer.Config.CommandQueue, // name
+		true,                         // durable
+		false,                        // delete when unused
+		false,                        // exclusive
+		false,                        // no-wait
+		nil,                          // arguments
+	)
+	if errQueue != nil {
+		return errQueue
+	}
+	if errQos := channel.Qos(1, 0, false); errQos != nil {
+		return errQos
+	}
+	deliveries, errConsume := channel.Consume(
+		consumer.Config.CommandQueue, // queue
+		"",                           // consumer
+		false,                        // auto-ack
+		false,                        // exclusive
+		false,                        // no-local
+		false,                        // no-wait
+		nil,                          // args
+	)
+	if errConsume != nil {
+		return errConsume
+	}
+	closed := connection.NotifyClose(make(chan *amqp.Error, 1))
+	established()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case amqpErr := <-closed:
+			return fmt.Errorf("RabbitMQ connection closed: %v", amqpErr)
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return errors.New("RabbitMQ command deliveries were closed.")
+			}
+			if handleErr := consumer.Handle(ctx, delivery.Body); handleErr != nil {
+				if permanent(handleErr) || delivery.Redelivered {
+					log.Printf("Rejected RabbitMQ command: %s", handleErr.Error())
+					delivery.Reject(false)
+				} else {
+					log.Printf("Requeued RabbitMQ command: %s", handleErr.Error())
+					delivery.Nack(false, true)
+				}
+				continue
+			}
+			delivery.Ack(false)
+		}
+	}
+}
+
+// invalidCommand is returned by Handle for commands which can never succeed
+type invalidCommand struct {
+	message string
+}
+
+func (err invalidCommand) Error() string {
+	return err.message
+}
+
+// permanent tells whether retrying a command failing with err is pointless
+func permanent(err error) bool {
+	if _, invalid := err.(invalidCommand); invalid {
+		return true
+	}
+	return err == storage.ErrUnknownDevice || err == storage.ErrNotFiring
+}
+
+// Handle runs a JSON encoded command
+func (consumer *Consumer) Handle(ctx context.Context, body []byte) error {
+	var command Command
+	if errJSON := json.Unmarshal(body, &command); errJSON != nil {
+		return invalidCommand{fmt.Sprintf("Invalid command: %s", errJSON.Error())}
+	}
+	switch command.Command {
+	case CommandAcknowledge:
+		if command.DeviceID == "" || strings.TrimSpace(command.By) == "" {
+			return invalidCommand{"Acknowledge command requires device_id and by."}
+		}
+		return consumer.Acknowledger.Acknowledge(ctx, events.Acknowledgement{DeviceID: command.DeviceID, By: command.By, At: time.Now(), Comment: command.Comment})
+	default:
+		return invalidCommand{fmt.Sprintf("Unknown command '%s'.", command.Command)}
+	}
+}
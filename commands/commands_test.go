@@ -0,0 +1,232 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	notifier "github.com/a-castellano/AlarmStatusWatcher/notifier"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+	"github.com/streadway/amqp"
+)
+
+type FakeAcknowledger struct {
+	mutex            sync.Mutex
+	acknowledgements []events.Acknowledgement
+}
+
+func (fake *FakeAcknowledger) Acknowledge(ctx context.Context, acknowledgement events.Acknowledgement) error {
+	if acknowledgement.DeviceID == "garage" {
+		return storage.ErrNotFiring
+	}
+	if acknowledgement.DeviceID == "office" {
+		return errors.New("Redis is down.")
+	}
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.acknowledgements = append(fake.acknowledgements, acknowledgement)
+	return nil
+}
+
+// FakeBroker delivers queued messages through fake connections and records
+// how each delivery was settled, requeued deliveries are delivered again
+type FakeBroker struct {
+	mutex      sync.Mutex
+	dials      int
+	queues     []string
+	bodies     map[uint64][]byte
+	deliveries chan amqp.Delivery
+	acked      []uint64
+	rejected   []uint64
+	requeued   []uint64
+	settled    chan struct{}
+}
+
+type FakeConnection struct {
+	broker *FakeBroker
+}
+
+type FakeChannel struct {
+	notifier.AMQPChannel
+	broker *FakeBroker
+}
+
+func NewFakeBroker(bodies ...string) *FakeBroker {
+	broker := &FakeBroker{bodies: make(map[uint64][]byte), deliveries: make(chan amqp.Delivery, len(bodies)), settled: make(chan struct{}, len(bodies)*2)}
+	for index, body := range bodies {
+		broker.bodies[uint64(index+1)] = []byte(body)
+		broker.deliveries <- amqp.Delivery{Acknowledger: broker, DeliveryTag: uint64(index + 1), Body: []byte(body)}
+	}
+	return broker
+}
+
+func (broker *FakeBroker) Dial(url string, amqpConfig amqp.Config) (notifier.AMQPConnection, error) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	broker.dials++
+	if broker.dials == 1 {
+		return nil, errors.New("connection refused")
+	}
+	return &FakeConnection{broker: broker}, nil
+}
+
+func (broker *FakeBroker) Ack(tag uint64, multiple bool) error {
+	broker.mutex.Lock()
+	broker.acked = append(broker.acked, tag)
+	broker.mutex.Unlock()
+	broker.settled <- struct{}{}
+	return nil
+}
+
+func (broker *FakeBroker) Nack(tag uint64, multiple bool, requeue bool) error {
+	return broker.Reject(tag, requeue)
+}
+
+func (broker *FakeBroker) Reject(tag uint64, requeue bool) error {
+	broker.mutex.Lock()
+	if requeue {
+		broker.requeued = append(broker.requeued, tag)
+		broker.deliveries <- amqp.Delivery{Acknowledger: broker, DeliveryTag: tag, Body: broker.bodies[tag], Redelivered: true}
+	} else {
+		broker.rejected = append(broker.rejected, tag)
+	}
+	broker.mutex.Unlock()
+	broker.settled <- struct{}{}
+	return nil
+}
+
+func (connection *FakeConnection) Channel() (notifier.AMQPChannel, error) {
+	return &FakeChannel{broker: connection.broker}, nil
+}
+
+func (connection *FakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return receiver
+}
+
+func (connection *FakeConnection) Close() error {
+	return nil
+}
+
+func (channel *FakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	channel.broker.mutex.Lock()
+	defer channel.broker.mutex.Unlock()
+	channel.broker.queues = append(channel.broker.queues, name)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (channel *FakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (channel *FakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return channel.broker.deliveries, nil
+}
+
+func (channel *FakeChannel) Close() error {
+	return nil
+}
+
+func TestHandle(t *testing.T) {
+
+	acknowledger := &FakeAcknowledger{}
+	consumer := Consumer{Acknowledger: acknowledger}
+
+	if err := consumer.Handle(context.Background(), []byte(`{"command": "acknowledge", "device_id": "house", "by": "alice", "comment": "On my way"}`)); err != nil {
+		t.Fatalf("Acknowledge command should not fail, error was '%s'.", err.Error())
+	}
+	if len(acknowledger.acknowledgements) != 1 || acknowledger.acknowledgements[0].By != "alice" || acknowledger.acknowledgements[0].Comment != "On my way" || acknowledger.acknowledgements[0].At.IsZero() {
+		t.Errorf("Acknowledgement should be recorded, acknowledgements were %+v.", acknowledger.acknowledgements)
+	}
+
+	invalidCommands := map[string]string{
+		`acknowledge`: "Invalid command: invalid character 'a' looking for beginning of value",
+		`{"command": "acknowledge", "device_id": "house"}`:                 "Acknowledge command requires device_id and by.",
+		`{"command": "arm", "device_id": "house"}`:                         "Unknown command 'arm'.",
+		`{"command": "acknowledge", "device_id": "garage", "by": "alice"}`: storage.ErrNotFiring.Error(),
+	}
+	for body, expected := range invalidCommands {
+		if err := consumer.Handle(context.Background(), []byte(body)); err == nil || err.Error() != expected {
+			t.Errorf("Command %s should fail with '%s', error was %v.", body, expected, err)
+		}
+	}
+}
+
+func TestConsumerRun(t *testing.T) {
+
+	broker := NewFakeBroker(`{"command": "acknowledge", "device_id": "house", "by": "alice"}`, `{"command": "arm"}`)
+	acknowledger := &FakeAcknowledger{}
+	consumer := Consumer{
+		Config:         config_reader.RabbitmqConfig{Host: "localhost", Port: 5672, CommandQueue: "alarm-commands"},
+		Acknowledger:   acknowledger,
+		Dial:           broker.Dial,
+		ReconnectDelay: time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		consumer.Run(ctx)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-broker.settled:
+		case <-time.After(time.Second):
+			t.Fatalf("Commands should be consumed after reconnecting.")
+		}
+	}
+	cancel()
+	<-done
+
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	if broker.dials != 2 || len(broker.queues) != 1 || broker.queues[0] != "alarm-commands" {
+		t.Errorf("Consumer should reconnect and declare command queue, dials were %d and queues %v.", broker.dials, broker.queues)
+	}
+	if len(broker.acked) != 1 || broker.acked[0] != 1 || len(broker.rejected) != 1 || broker.rejected[0] != 2 {
+		t.Errorf("Valid commands should be acked and invalid ones rejected, acked %v and rejected %v.", broker.acked, broker.rejected)
+	}
+	if len(acknowledger.acknowledgements) != 1 || acknowledger.acknowledgements[0].DeviceID != "house" {
+		t.Errorf("Acknowledgement should be recorded, acknowledgements were %+v.", acknowledger.acknowledgements)
+	}
+}
+
+func TestConsumerRunRequeuesFailingCommandsOnce(t *testing.T) {
+
+	broker := NewFakeBroker(`{"command": "acknowledge", "device_id": "office", "by": "alice"}`, `{"command": "acknowledge", "device_id": "garage", "by": "alice"}`)
+	consumer := Consumer{
+		Config:         config_reader.RabbitmqConfig{Host: "localhost", Port: 5672, CommandQueue: "alarm-commands"},
+		Acknowledger:   &FakeAcknowledger{},
+		Dial:           broker.Dial,
+		ReconnectDelay: time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		consumer.Run(ctx)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-broker.settled:
+		case <-time.After(time.Second):
+			t.Fatalf("Commands should be settled.")
+		}
+	}
+	cancel()
+	<-done
+
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	if len(broker.requeued) != 1 || broker.requeued[0] != 1 {
+		t.Errorf("Command failing on storage should be requeued once, requeued %v.", broker.requeued)
+	}
+	if len(broker.rejected) != 2 || broker.rejected[0] != 2 || broker.rejected[1] != 1 {
+		t.Errorf("Command for a not firing device and redelivered failing command should be rejected, rejected %v.", broker.rejected)
+	}
+}
@@ -2,16 +2,127 @@ package config
 
 import (
 	"errors"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	viperLib "github.com/spf13/viper"
 )
 
+// TLSConfig holds client TLS settings, files are PEM encoded
+type TLSConfig struct {
+	Enabled    bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	// Verify enables server certificate verification
+	Verify bool
+}
+
 type RabbitmqConfig struct {
+	Enabled bool
+	// URL replaces User, Password, Host, Port and VHost when set, vhost is
+	// taken from URL path even if VHost is configured
+	URL       string
 	User      string
 	Password  string
 	Host      string
 	Port      int
+	VHost     string
+	Heartbeat time.Duration
+	TLS       TLSConfig
 	QueueName string
+	// Exchange enables exchange mode, events are published to it using
+	// RoutingKey template instead of being sent straight to QueueName
+	Exchange     string
+	ExchangeType string
+	RoutingKey   string
+	// BindingKey binds QueueName to Exchange when both are set
+	BindingKey string
+	// BufferSize is how many messages are kept in memory while broker is down
+	BufferSize int
+	// CommandQueue is consumed for commands such as acknowledgements when set
+	CommandQueue string
+}
+
+// Webhook sends events to an HTTP endpoint
+type Webhook struct {
+	Enabled bool
+	URL     string
+	Method  string
+	Headers map[string]string
+	// BodyTemplate renders request bodies, event payload is sent when empty
+	BodyTemplate string
+	// Secret signs bodies with HMAC-SHA256 in SignatureHeader when set
+	Secret          string
+	SignatureHeader string
+	Timeout         time.Duration
+	// Retries is how many times deliveries failing with 5xx or timeouts are
+	// retried, waiting RetryDelay doubled after each attempt
+	Retries    int
+	RetryDelay time.Duration
+	// DeliveryTimeout bounds the time spent delivering an event, retries
+	// included, as deliveries block polling
+	DeliveryTimeout time.Duration
+	// DeadLetterFile stores deliveries failing every attempt, they are logged when empty
+	DeadLetterFile string
+}
+
+// MQTT publishes device state and events to an MQTT broker. Device state is
+// retained under TopicPrefix/<device>/mode, firing and online, the watcher
+// status is retained under TopicPrefix/status and set to offline as last will.
+type MQTT struct {
+	Enabled  bool
+	Host     string
+	Port     int
+	ClientID string
+	User     string
+	Password string
+	TLS      TLSConfig
+	QoS      byte
+	// TopicPrefix is prepended to every published topic
+	TopicPrefix string
+	KeepAlive   time.Duration
+	// Timeout limits connection attempts and waiting for publish confirmations
+	Timeout time.Duration
+	// Discovery publishes Home Assistant discovery configs under DiscoveryPrefix
+	Discovery       bool
+	DiscoveryPrefix string
+}
+
+// Telegram sends events to a chat through the Telegram Bot API
+type Telegram struct {
+	Enabled bool
+	APIURL  string
+	Token   string
+	ChatID  string
+	Timeout time.Duration
+}
+
+// Slack sends events to a Slack compatible incoming webhook
+type Slack struct {
+	Enabled    bool
+	WebhookURL string
+	// Channel and Username override webhook defaults when set
+	Channel  string
+	Username string
+	Timeout  time.Duration
+}
+
+// Matrix sends events to a room through the Matrix client-server API
+type Matrix struct {
+	Enabled    bool
+	Homeserver string
+	Token      string
+	RoomID     string
+	Timeout    time.Duration
 }
 
 type RedisServer struct {
@@ -21,34 +132,546 @@ type RedisServer struct {
 	Database int
 }
 
+// SMTP connection modes
+const (
+	MailModeTLS      = "tls"
+	MailModeStartTLS = "starttls"
+	MailModePlain    = "plain"
+)
+
+// SMTP authentication mechanisms
+const (
+	MailAuthPlain   = "plain"
+	MailAuthLogin   = "login"
+	MailAuthCRAMMD5 = "crammd5"
+	MailAuthNone    = "none"
+)
+
 type MailServer struct {
+	Enabled      bool
 	MailFrom     string
 	MailDomain   string
 	SMTPHost     string
 	SMTPPort     int
 	SMTPName     string
 	SMTPPassword string
-	Destination  string
+	// Mode is one of tls (implicit TLS), starttls or plain
+	Mode string
+	Auth string
+	TLS  TLSConfig
+	To   []string
+	Cc   []string
+	Bcc  []string
+	// SubjectTemplate is a text/template, empty uses the default one
+	SubjectTemplate string
+	// TextTemplateFile and HTMLTemplateFile override default bodies
+	TextTemplateFile string
+	HTMLTemplateFile string
+	Digest           MailDigest
+	// Timeout bounds a whole delivery, from dialing to QUIT
+	Timeout time.Duration
+}
+
+// MailDigest groups non urgent events in a single email per window
+type MailDigest struct {
+	Enabled bool
+	Window  time.Duration
+	// Bypass lists severities sent immediately instead of being grouped
+	Bypass []string
 }
 
 type NotifyConfig struct {
-	NotifyStatusChange    bool
-	NotifyOffline         bool
-	SendEmailNotification bool
-	SendQueueNotification bool
+	NotifyStatusChange bool
+	NotifyOffline      bool
+	// Rules replace NotifyStatusChange and NotifyOffline when defined
+	Rules []NotifyRule
+}
+
+// NotifyRule routes changes matching every defined condition to Channels
+// and Recipients
+type NotifyRule struct {
+	Name string
+	// Devices are device ID or name patterns as accepted by path.Match
+	Devices []string
+	Types   []string
+	// From and To limit the rule to changes happening in that time of day
+	// range, it wraps midnight when From is later than To
+	From time.Duration
+	To   time.Duration
+	// Channels limits the rule to these notifiers, empty means all of them
+	Channels   []string
+	Recipients []string
 }
 
+// notifierNames are the channels rules and escalation levels can be routed to
+var notifierNames = []string{"mail", "queue", "webhook", "mqtt", "telegram", "slack", "matrix"}
+
+// notifyRuleTypes are the event types rules can match, still firing reminders
+// are sent by escalation and are not routed through rules
+var notifyRuleTypes = []string{"renamed", "mode_changed", "firing_started", "firing_stopped", "online", "offline", "available", "unavailable", "recovered", "unreachable", "flapping", "settled"}
+
 type AlarmManager struct {
-	Host string
-	Port int
+	Host             string
+	Port             int
+	FailureThreshold int
+	Concurrency      int
+	// UnavailableThreshold is the number of consecutive failed requests
+	// of a device status before notifying it, 0 disables it
+	UnavailableThreshold int
+	PollInterval         time.Duration
+	RequestTimeout       time.Duration
+	// MaxJitter is the maximum random delay added to each poll interval
+	MaxJitter time.Duration
+	// DevicePollIntervals overrides PollInterval for some devices
+	DevicePollIntervals map[string]time.Duration
+}
+
+type HTTPServer struct {
+	Enabled bool
+	// Host defaults to loopback so the API is not exposed unless configured
+	Host       string
+	Port       int
+	MaxPollAge int
+	// Write serves endpoints changing state, acknowledgements and
+	// maintenance windows, to requests sending Token as bearer token
+	Write bool
+	Token string
+}
+
+type History struct {
+	Enabled bool
+	// Retention is how many hours changes are kept
+	Retention int
+}
+
+// Debounce delays online changes until they hold and detects flapping devices
+type Debounce struct {
+	// HoldPolls and HoldTime confirm a transition after it holds for that many
+	// polls or that long, whatever happens first, 0 disables them
+	HoldPolls int
+	HoldTime  time.Duration
+	// FlapThreshold transitions within FlapWindow mark a device as flapping, 0 disables it
+	FlapThreshold int
+	FlapWindow    time.Duration
+}
+
+// Escalation resends firing notifications every Interval while a device
+// keeps firing, adding channels and recipients of reached levels
+type Escalation struct {
+	Enabled  bool
+	Interval time.Duration
+	// Channels limits reminders to these notifiers, empty means all of them
+	Channels []string
+	Levels   []EscalationLevel
 }
 
+// EscalationLevel is reached once a device has been firing for After
+type EscalationLevel struct {
+	After      time.Duration
+	Channels   []string
+	Recipients []string
+}
+
+// QuietHours suppresses non critical notifications during weekly windows,
+// times are read in Location
+type QuietHours struct {
+	Location *time.Location
+	Windows  []QuietWindow
+}
+
+// QuietWindow starts at From on each of Days and ends at To, the same or the
+// next day. It lasts a whole day when From and To are equal.
+type QuietWindow struct {
+	// Devices are device ID or name patterns as accepted by path.Match, empty means every device
+	Devices []string
+	// Days are the weekdays the window starts on, empty means every day
+	Days []time.Weekday
+	From time.Duration
+	To   time.Duration
+}
+
+var weekdays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
 type Config struct {
 	RabbitmqConfig RabbitmqConfig
 	RedisServer    RedisServer
 	MailServer     MailServer
 	NotifyConfig   NotifyConfig
 	AlarmManager   AlarmManager
+	HTTPServer     HTTPServer
+	History        History
+	Debounce       Debounce
+	Escalation     Escalation
+	QuietHours     QuietHours
+	Webhook        Webhook
+	MQTT           MQTT
+	Telegram       Telegram
+	Slack          Slack
+	Matrix         Matrix
+}
+
+// readNotifyRules reads and validates notify rules
+func readNotifyRules(viper *viperLib.Viper) ([]NotifyRule, error) {
+	var rules []struct {
+		Name       string
+		Devices    []string
+		Types      []string
+		From       string
+		To         string
+		Channels   []string
+		Recipients []string
+	}
+	if unmarshalErr := viper.UnmarshalKey("notify.rules", &rules); unmarshalErr != nil {
+		return nil, errors.New("Fatal error config: notify rules are not valid.")
+	}
+	notifyRules := make([]NotifyRule, 0, len(rules))
+	for index, rule := range rules {
+		ruleName := strconv.Itoa(index + 1)
+		notifyRule := NotifyRule{Name: rule.Name, Devices: rule.Devices, Types: rule.Types, Channels: rule.Channels, Recipients: rule.Recipients}
+		for _, pattern := range rule.Devices {
+			if _, matchErr := path.Match(pattern, ""); matchErr != nil {
+				return nil, errors.New("Fatal error config: notify rule " + ruleName + " device pattern " + pattern + " is not valid.")
+			}
+		}
+		for _, ruleType := range rule.Types {
+			valid := false
+			for _, notifyRuleType := range notifyRuleTypes {
+				valid = valid || ruleType == notifyRuleType
+			}
+			if !valid {
+				return nil, errors.New("Fatal error config: notify rule " + ruleName + " type " + ruleType + " is not valid.")
+			}
+		}
+		if channel, valid := validChannels(rule.Channels); !valid {
+			return nil, errors.New("Fatal error config: notify rule " + ruleName + " channel " + channel + " is not valid.")
+		}
+		if rule.From != "" || rule.To != "" {
+			var fromErr, toErr error
+			notifyRule.From, fromErr = readTimeOfDay(rule.From)
+			notifyRule.To, toErr = readTimeOfDay(rule.To)
+			if fromErr != nil || toErr != nil {
+				return nil, errors.New("Fatal error config: notify rule " + ruleName + " from and to must be defined together as HH:MM times.")
+			}
+		}
+		for _, recipient := range rule.Recipients {
+			if _, addressErr := mail.ParseAddress(recipient); addressErr != nil {
+				return nil, errors.New("Fatal error config: notify rule " + ruleName + " recipient " + recipient + " is not a valid address.")
+			}
+		}
+		notifyRules = append(notifyRules, notifyRule)
+	}
+	return notifyRules, nil
+}
+
+// readWebhook reads and validates webhook section
+func readWebhook(viper *viperLib.Viper) (Webhook, error) {
+	webhook := Webhook{Enabled: notifierEnabled(viper, "webhook", "notify.webhook")}
+	if !webhook.Enabled {
+		return webhook, nil
+	}
+	webhook.URL = viper.GetString("webhook.url")
+	if !validHTTPURL(webhook.URL) {
+		return webhook, errors.New("Fatal error config: webhook url must be a valid http or https URL.")
+	}
+	webhook.Method = "POST"
+	if viper.IsSet("webhook.method") {
+		webhook.Method = strings.ToUpper(viper.GetString("webhook.method"))
+	}
+	if webhook.Method != "POST" && webhook.Method != "PUT" && webhook.Method != "PATCH" {
+		return webhook, errors.New("Fatal error config: webhook method must be POST, PUT or PATCH.")
+	}
+	webhook.Headers = viper.GetStringMapString("webhook.headers")
+	webhook.BodyTemplate = viper.GetString("webhook.bodytemplate")
+	webhook.Secret = viper.GetString("webhook.secret")
+	webhook.SignatureHeader = "X-AlarmStatusWatcher-Signature"
+	if viper.IsSet("webhook.signatureheader") {
+		webhook.SignatureHeader = viper.GetString("webhook.signatureheader")
+	}
+	var durationErr error
+	if webhook.Timeout, durationErr = readDuration(viper, "webhook.timeout", time.Second*10); durationErr != nil {
+		return webhook, durationErr
+	}
+	if webhook.Timeout <= 0 {
+		return webhook, errors.New("Fatal error config: webhook timeout must be greater than 0.")
+	}
+	webhook.Retries = 3
+	if viper.IsSet("webhook.retries") {
+		webhook.Retries = viper.GetInt("webhook.retries")
+	}
+	if webhook.Retries < 0 {
+		return webhook, errors.New("Fatal error config: webhook retries cannot be negative.")
+	}
+	if webhook.RetryDelay, durationErr = readDuration(viper, "webhook.retrydelay", time.Second); durationErr != nil {
+		return webhook, durationErr
+	}
+	if webhook.RetryDelay <= 0 {
+		return webhook, errors.New("Fatal error config: webhook retrydelay must be greater than 0.")
+	}
+	if webhook.DeliveryTimeout, durationErr = readDuration(viper, "webhook.deliverytimeout", time.Second*30); durationErr != nil {
+		return webhook, durationErr
+	}
+	if webhook.DeliveryTimeout <= 0 {
+		return webhook, errors.New("Fatal error config: webhook deliverytimeout must be greater than 0.")
+	}
+	webhook.DeadLetterFile = viper.GetString("webhook.deadletter")
+	return webhook, nil
+}
+
+// validHTTPURL returns true for absolute http and https URLs
+func validHTTPURL(value string) bool {
+	parsed, parseErr := url.Parse(value)
+	return parseErr == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// validChannels returns the first channel not naming a notifier
+func validChannels(channels []string) (string, bool) {
+	for _, channel := range channels {
+		valid := false
+		for _, notifierName := range notifierNames {
+			valid = valid || channel == notifierName
+		}
+		if !valid {
+			return channel, false
+		}
+	}
+	return "", true
+}
+
+// enabledNotifiers returns whether each notifier name is enabled in config
+func enabledNotifiers(config Config) map[string]bool {
+	return map[string]bool{
+		"mail":     config.MailServer.Enabled,
+		"queue":    config.RabbitmqConfig.Enabled,
+		"webhook":  config.Webhook.Enabled,
+		"mqtt":     config.MQTT.Enabled,
+		"telegram": config.Telegram.Enabled,
+		"slack":    config.Slack.Enabled,
+		"matrix":   config.Matrix.Enabled,
+	}
+}
+
+// readChatNotifiers reads Telegram, Slack and Matrix notifier settings
+func readChatNotifiers(viper *viperLib.Viper, config *Config) error {
+	var durationErr error
+	config.Telegram.Enabled = notifierEnabled(viper, "telegram", "notify.telegram")
+	if config.Telegram.Enabled {
+		config.Telegram.Token = viper.GetString("telegram.token")
+		config.Telegram.ChatID = viper.GetString("telegram.chatid")
+		if config.Telegram.Token == "" || config.Telegram.ChatID == "" {
+			return errors.New("Fatal error config: telegram token and chatid must be defined.")
+		}
+		config.Telegram.APIURL = "https://api.telegram.org"
+		if viper.IsSet("telegram.apiurl") {
+			config.Telegram.APIURL = strings.TrimRight(viper.GetString("telegram.apiurl"), "/")
+		}
+		if !validHTTPURL(config.Telegram.APIURL) {
+			return errors.New("Fatal error config: telegram apiurl must be a valid http or https URL.")
+		}
+		if config.Telegram.Timeout, durationErr = readDuration(viper, "telegram.timeout", time.Second*10); durationErr != nil {
+			return durationErr
+		}
+		if config.Telegram.Timeout <= 0 {
+			return errors.New("Fatal error config: telegram timeout must be greater than 0.")
+		}
+	}
+	config.Slack.Enabled = notifierEnabled(viper, "slack", "notify.slack")
+	if config.Slack.Enabled {
+		config.Slack.WebhookURL = viper.GetString("slack.webhookurl")
+		if !validHTTPURL(config.Slack.WebhookURL) {
+			return errors.New("Fatal error config: slack webhookurl must be a valid http or https URL.")
+		}
+		config.Slack.Channel = viper.GetString("slack.channel")
+		config.Slack.Username = viper.GetString("slack.username")
+		if config.Slack.Timeout, durationErr = readDuration(viper, "slack.timeout", time.Second*10); durationErr != nil {
+			return durationErr
+		}
+		if config.Slack.Timeout <= 0 {
+			return errors.New("Fatal error config: slack timeout must be greater than 0.")
+		}
+	}
+	config.Matrix.Enabled = notifierEnabled(viper, "matrix", "notify.matrix")
+	if config.Matrix.Enabled {
+		config.Matrix.Homeserver = strings.TrimRight(viper.GetString("matrix.homeserver"), "/")
+		if !validHTTPURL(config.Matrix.Homeserver) {
+			return errors.New("Fatal error config: matrix homeserver must be a valid http or https URL.")
+		}
+		config.Matrix.Token = viper.GetString("matrix.token")
+		config.Matrix.RoomID = viper.GetString("matrix.roomid")
+		if config.Matrix.Token == "" || config.Matrix.RoomID == "" {
+			return errors.New("Fatal error config: matrix token and roomid must be defined.")
+		}
+		if config.Matrix.Timeout, durationErr = readDuration(viper, "matrix.timeout", time.Second*10); durationErr != nil {
+			return durationErr
+		}
+		if config.Matrix.Timeout <= 0 {
+			return errors.New("Fatal error config: matrix timeout must be greater than 0.")
+		}
+	}
+	return nil
+}
+
+// readMQTT reads and validates MQTT notifier settings
+func readMQTT(viper *viperLib.Viper) (MQTT, error) {
+	mqtt := MQTT{Enabled: notifierEnabled(viper, "mqtt", "notify.mqtt")}
+	if !mqtt.Enabled {
+		return mqtt, nil
+	}
+	mqtt.Host = viper.GetString("mqtt.host")
+	if mqtt.Host == "" {
+		return mqtt, errors.New("Fatal error config: no mqtt host was defined.")
+	}
+	var tlsErr error
+	if mqtt.TLS, tlsErr = readTLSConfig(viper, "mqtt"); tlsErr != nil {
+		return mqtt, tlsErr
+	}
+	mqtt.Port = 1883
+	if mqtt.TLS.Enabled {
+		mqtt.Port = 8883
+	}
+	if viper.IsSet("mqtt.port") {
+		mqtt.Port = viper.GetInt("mqtt.port")
+	}
+	mqtt.ClientID = "alarmstatuswatcher"
+	if viper.IsSet("mqtt.clientid") {
+		mqtt.ClientID = viper.GetString("mqtt.clientid")
+	}
+	mqtt.User = viper.GetString("mqtt.user")
+	mqtt.Password = viper.GetString("mqtt.password")
+	qos := 1
+	if viper.IsSet("mqtt.qos") {
+		qos = viper.GetInt("mqtt.qos")
+	}
+	if qos < 0 || qos > 2 {
+		return mqtt, errors.New("Fatal error config: mqtt qos must be 0, 1 or 2.")
+	}
+	mqtt.QoS = byte(qos)
+	mqtt.TopicPrefix = "alarmstatuswatcher"
+	if viper.IsSet("mqtt.topicprefix") {
+		mqtt.TopicPrefix = strings.Trim(viper.GetString("mqtt.topicprefix"), "/")
+	}
+	if mqtt.TopicPrefix == "" || strings.ContainsAny(mqtt.TopicPrefix, "+#") {
+		return mqtt, errors.New("Fatal error config: mqtt topicprefix cannot be empty or contain wildcards.")
+	}
+	var durationErr error
+	if mqtt.KeepAlive, durationErr = readDuration(viper, "mqtt.keepalive", time.Second*30); durationErr != nil {
+		return mqtt, durationErr
+	}
+	if mqtt.Timeout, durationErr = readDuration(viper, "mqtt.timeout", time.Second*10); durationErr != nil {
+		return mqtt, durationErr
+	}
+	if mqtt.KeepAlive <= 0 || mqtt.Timeout <= 0 {
+		return mqtt, errors.New("Fatal error config: mqtt keepalive and timeout must be greater than 0.")
+	}
+	mqtt.Discovery = viper.GetBool("mqtt.discovery")
+	mqtt.DiscoveryPrefix = "homeassistant"
+	if viper.IsSet("mqtt.discoveryprefix") {
+		mqtt.DiscoveryPrefix = strings.Trim(viper.GetString("mqtt.discoveryprefix"), "/")
+	}
+	if mqtt.DiscoveryPrefix == "" || strings.ContainsAny(mqtt.DiscoveryPrefix, "+#") {
+		return mqtt, errors.New("Fatal error config: mqtt discoveryprefix cannot be empty or contain wildcards.")
+	}
+	return mqtt, nil
+}
+
+// readTimeOfDay parses HH:MM times returning time since midnight
+func readTimeOfDay(value string) (time.Duration, error) {
+	parsed, parseErr := time.Parse("15:04", value)
+	if parseErr != nil {
+		return 0, parseErr
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// readQuietHours reads and validates quiet hours windows
+func readQuietHours(viper *viperLib.Viper) (QuietHours, error) {
+	quietHours := QuietHours{Location: time.Local}
+	if viper.IsSet("quiethours.timezone") {
+		location, locationErr := time.LoadLocation(viper.GetString("quiethours.timezone"))
+		if locationErr != nil {
+			return quietHours, errors.New("Fatal error config: quiethours timezone " + viper.GetString("quiethours.timezone") + " is not valid.")
+		}
+		quietHours.Location = location
+	}
+	var windows []struct {
+		Devices []string
+		Days    []string
+		From    string
+		To      string
+	}
+	if unmarshalErr := viper.UnmarshalKey("quiethours.windows", &windows); unmarshalErr != nil {
+		return quietHours, errors.New("Fatal error config: quiethours windows are not valid.")
+	}
+	for index, window := range windows {
+		windowName := strconv.Itoa(index + 1)
+		quietWindow := QuietWindow{Devices: window.Devices}
+		for _, pattern := range window.Devices {
+			if _, matchErr := path.Match(pattern, ""); matchErr != nil {
+				return quietHours, errors.New("Fatal error config: quiethours window " + windowName + " device pattern " + pattern + " is not valid.")
+			}
+		}
+		for _, day := range window.Days {
+			weekday, found := weekdays[strings.ToLower(day)]
+			if !found {
+				return quietHours, errors.New("Fatal error config: quiethours window " + windowName + " day " + day + " is not valid, use mon, tue, wed, thu, fri, sat or sun.")
+			}
+			quietWindow.Days = append(quietWindow.Days, weekday)
+		}
+		var fromErr, toErr error
+		quietWindow.From, fromErr = readTimeOfDay(window.From)
+		quietWindow.To, toErr = readTimeOfDay(window.To)
+		if fromErr != nil || toErr != nil {
+			return quietHours, errors.New("Fatal error config: quiethours window " + windowName + " from and to must be HH:MM times.")
+		}
+		quietHours.Windows = append(quietHours.Windows, quietWindow)
+	}
+	return quietHours, nil
+}
+
+func readDuration(viper *viperLib.Viper, key string, defaultValue time.Duration) (time.Duration, error) {
+	if !viper.IsSet(key) {
+		return defaultValue, nil
+	}
+	duration, parseErr := time.ParseDuration(viper.GetString(key))
+	if parseErr != nil {
+		return defaultValue, errors.New("Fatal error config: " + strings.Replace(key, ".", " ", -1) + " is not a valid duration.")
+	}
+	return duration, nil
+}
+
+// readTLSConfig reads TLS settings from section tls subsection
+func readTLSConfig(viper *viperLib.Viper, section string) (TLSConfig, error) {
+	key := section + ".tls"
+	tlsConfig := TLSConfig{
+		Enabled:    viper.GetBool(key + ".enabled"),
+		CAFile:     viper.GetString(key + ".ca"),
+		CertFile:   viper.GetString(key + ".cert"),
+		KeyFile:    viper.GetString(key + ".key"),
+		ServerName: viper.GetString(key + ".servername"),
+		Verify:     true,
+	}
+	if viper.IsSet(key + ".verify") {
+		tlsConfig.Verify = viper.GetBool(key + ".verify")
+	}
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		return tlsConfig, errors.New("Fatal error config: " + section + " tls cert and key must be defined together.")
+	}
+	tlsFiles := [][]string{{"ca", tlsConfig.CAFile}, {"cert", tlsConfig.CertFile}, {"key", tlsConfig.KeyFile}}
+	for _, tlsFile := range tlsFiles {
+		if tlsFile[1] == "" {
+			continue
+		}
+		if _, statErr := os.Stat(tlsFile[1]); statErr != nil {
+			return tlsConfig, errors.New("Fatal error config: " + section + " tls " + tlsFile[0] + " file cannot be read.")
+		}
+	}
+	return tlsConfig, nil
+}
+
+func notifierEnabled(viper *viperLib.Viper, section string, legacyField string) bool {
+	if viper.IsSet(section + ".enabled") {
+		return viper.GetBool(section + ".enabled")
+	}
+	return viper.GetBool(legacyField)
 }
 
 func ReadConfig() (Config, error) {
@@ -64,9 +687,14 @@ func ReadConfig() (Config, error) {
 
 	alarmManagerRequiredVariables := []string{"port", "host"}
 
-	notifyRequiredVariables := []string{"online", "statuschange", "queue", "mail"}
-	mailRequiredVariables := []string{"mailfrom", "maildomain", "host", "port", "user", "password", "destination"}
-	queueRequiredVariables := []string{"host", "port", "user", "password", "queue"}
+	notifyRequiredVariables := []string{"online", "statuschange"}
+	mailRequiredVariables := []string{"mailfrom", "maildomain", "host", "port"}
+	mailAuthRequiredVariables := []string{"user", "password"}
+	mailModes := map[string]bool{MailModeTLS: true, MailModeStartTLS: true, MailModePlain: true}
+	mailAuths := map[string]bool{MailAuthPlain: true, MailAuthLogin: true, MailAuthCRAMMD5: true, MailAuthNone: true}
+	queueRequiredVariables := []string{"host", "port", "user", "password"}
+	queueURLSchemes := map[string]bool{"amqp": true, "amqps": true}
+	httpRequiredVariables := []string{"port"}
 
 	viper := viperLib.New()
 
@@ -113,21 +741,83 @@ func ReadConfig() (Config, error) {
 	}
 	config.AlarmManager.Host = viper.GetString("alarmmanager.host")
 	config.AlarmManager.Port = viper.GetInt("alarmmanager.port")
-
-	// Notify
-	for _, requiredNotifyVariable := range notifyRequiredVariables {
-		if !viper.IsSet("notify." + requiredNotifyVariable) {
-			return config, errors.New("Fatal error config: no notify " + requiredNotifyVariable + " was defined.")
+	config.AlarmManager.FailureThreshold = 5
+	if viper.IsSet("alarmmanager.failurethreshold") {
+		config.AlarmManager.FailureThreshold = viper.GetInt("alarmmanager.failurethreshold")
+		if config.AlarmManager.FailureThreshold < 1 {
+			return config, errors.New("Fatal error config: alarmmanager failurethreshold must be greater than 0.")
+		}
+	}
+	config.AlarmManager.Concurrency = 4
+	if viper.IsSet("alarmmanager.concurrency") {
+		config.AlarmManager.Concurrency = viper.GetInt("alarmmanager.concurrency")
+		if config.AlarmManager.Concurrency < 1 {
+			return config, errors.New("Fatal error config: alarmmanager concurrency must be greater than 0.")
 		}
+	}
+	config.AlarmManager.UnavailableThreshold = viper.GetInt("alarmmanager.unavailablethreshold")
+	if config.AlarmManager.UnavailableThreshold < 0 {
+		return config, errors.New("Fatal error config: alarmmanager unavailablethreshold cannot be negative.")
+	}
+	var durationErr error
+	if config.AlarmManager.PollInterval, durationErr = readDuration(viper, "alarmmanager.pollinterval", time.Second); durationErr != nil {
+		return config, durationErr
+	}
+	if config.AlarmManager.PollInterval <= 0 {
+		return config, errors.New("Fatal error config: alarmmanager pollinterval must be greater than 0.")
+	}
+	if config.AlarmManager.RequestTimeout, durationErr = readDuration(viper, "alarmmanager.requesttimeout", time.Second*5); durationErr != nil {
+		return config, durationErr
+	}
+	if config.AlarmManager.RequestTimeout <= 0 {
+		return config, errors.New("Fatal error config: alarmmanager requesttimeout must be greater than 0.")
+	}
+	if config.AlarmManager.MaxJitter, durationErr = readDuration(viper, "alarmmanager.maxjitter", 0); durationErr != nil {
+		return config, durationErr
+	}
+	if config.AlarmManager.MaxJitter < 0 {
+		return config, errors.New("Fatal error config: alarmmanager maxjitter cannot be negative.")
+	}
+	config.AlarmManager.DevicePollIntervals = make(map[string]time.Duration)
+	deviceIDs := make([]string, 0)
+	for deviceID := range viper.GetStringMap("alarmmanager.devices") {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+	for _, deviceID := range deviceIDs {
+		devicePollInterval, deviceDurationErr := readDuration(viper, "alarmmanager.devices."+deviceID+".pollinterval", config.AlarmManager.PollInterval)
+		if deviceDurationErr != nil {
+			return config, deviceDurationErr
+		}
+		if devicePollInterval < config.AlarmManager.PollInterval {
+			return config, errors.New("Fatal error config: alarmmanager devices " + deviceID + " pollinterval cannot be lower than alarmmanager pollinterval.")
+		}
+		config.AlarmManager.DevicePollIntervals[deviceID] = devicePollInterval
+	}
+
+	// Notify, rules replace online and statuschange fields
+	if !viper.IsSet("notify.rules") {
+		for _, requiredNotifyVariable := range notifyRequiredVariables {
+			if !viper.IsSet("notify." + requiredNotifyVariable) {
+				return config, errors.New("Fatal error config: no notify " + requiredNotifyVariable + " was defined.")
+			}
 
+		}
 	}
 	config.NotifyConfig.NotifyStatusChange = viper.GetBool("notify.statuschange")
 	config.NotifyConfig.NotifyOffline = viper.GetBool("notify.online")
-	config.NotifyConfig.SendEmailNotification = viper.GetBool("notify.mail")
-	config.NotifyConfig.SendQueueNotification = viper.GetBool("notify.queue")
+	var rulesErr error
+	if config.NotifyConfig.Rules, rulesErr = readNotifyRules(viper); rulesErr != nil {
+		return config, rulesErr
+	}
+
+	// Each notifier is enabled from its own section, notify mail and queue
+	// fields are still honoured when sections do not define it
+	config.MailServer.Enabled = notifierEnabled(viper, "mail", "notify.mail")
+	config.RabbitmqConfig.Enabled = notifierEnabled(viper, "rabbitmq", "notify.queue")
 
 	// Check if mail is required Mail is required
-	if config.NotifyConfig.SendEmailNotification {
+	if config.MailServer.Enabled {
 		// Mail
 		if !viper.IsSet("mail") {
 			return config, errors.New("Fatal error config: mail config section is required.")
@@ -144,30 +834,334 @@ func ReadConfig() (Config, error) {
 		config.MailServer.MailDomain = viper.GetString("mail.maildomain")
 		config.MailServer.SMTPHost = viper.GetString("mail.host")
 		config.MailServer.SMTPPort = viper.GetInt("mail.port")
-		config.MailServer.SMTPName = viper.GetString("mail.user")
-		config.MailServer.SMTPPassword = viper.GetString("mail.password")
-		config.MailServer.Destination = viper.GetString("mail.destination")
 
+		config.MailServer.Mode = MailModeTLS
+		if viper.IsSet("mail.mode") {
+			config.MailServer.Mode = viper.GetString("mail.mode")
+		}
+		if !mailModes[config.MailServer.Mode] {
+			return config, errors.New("Fatal error config: mail mode must be tls, starttls or plain.")
+		}
+		config.MailServer.Auth = MailAuthPlain
+		if viper.IsSet("mail.auth") {
+			config.MailServer.Auth = viper.GetString("mail.auth")
+		}
+		if !mailAuths[config.MailServer.Auth] {
+			return config, errors.New("Fatal error config: mail auth must be plain, login, crammd5 or none.")
+		}
+		if config.MailServer.Auth != MailAuthNone {
+			for _, requiredMailVariable := range mailAuthRequiredVariables {
+				if !viper.IsSet("mail." + requiredMailVariable) {
+					return config, errors.New("Fatal error config: no mail " + requiredMailVariable + " was defined.")
+				}
+			}
+			config.MailServer.SMTPName = viper.GetString("mail.user")
+			config.MailServer.SMTPPassword = viper.GetString("mail.password")
+		}
+		var mailTLSErr error
+		if config.MailServer.TLS, mailTLSErr = readTLSConfig(viper, "mail"); mailTLSErr != nil {
+			return config, mailTLSErr
+		}
+		config.MailServer.TLS.Enabled = config.MailServer.Mode != MailModePlain
+		var mailTimeoutErr error
+		if config.MailServer.Timeout, mailTimeoutErr = readDuration(viper, "mail.timeout", time.Second*30); mailTimeoutErr != nil {
+			return config, mailTimeoutErr
+		}
+		if config.MailServer.Timeout <= 0 {
+			return config, errors.New("Fatal error config: mail timeout must be greater than 0.")
+		}
+
+		// destination field is kept as the first To recipient
+		if viper.IsSet("mail.destination") {
+			config.MailServer.To = append(config.MailServer.To, viper.GetString("mail.destination"))
+		}
+		config.MailServer.To = append(config.MailServer.To, viper.GetStringSlice("mail.to")...)
+		config.MailServer.Cc = viper.GetStringSlice("mail.cc")
+		config.MailServer.Bcc = viper.GetStringSlice("mail.bcc")
+		if len(config.MailServer.To)+len(config.MailServer.Cc)+len(config.MailServer.Bcc) == 0 {
+			return config, errors.New("Fatal error config: no mail destination was defined.")
+		}
+		config.MailServer.SubjectTemplate = viper.GetString("mail.templates.subject")
+		if _, templateErr := template.New("subject").Parse(config.MailServer.SubjectTemplate); templateErr != nil {
+			return config, errors.New("Fatal error config: mail templates subject is not a valid template.")
+		}
+		config.MailServer.TextTemplateFile = viper.GetString("mail.templates.text")
+		config.MailServer.HTMLTemplateFile = viper.GetString("mail.templates.html")
+		templateFiles := [][]string{{"text", config.MailServer.TextTemplateFile}, {"html", config.MailServer.HTMLTemplateFile}}
+		for _, templateFile := range templateFiles {
+			if templateFile[1] == "" {
+				continue
+			}
+			if _, statErr := os.Stat(templateFile[1]); statErr != nil {
+				return config, errors.New("Fatal error config: mail templates " + templateFile[0] + " file cannot be read.")
+			}
+		}
+		config.MailServer.Digest.Enabled = viper.GetBool("mail.digest.enabled")
+		if config.MailServer.Digest.Enabled {
+			var windowErr error
+			if config.MailServer.Digest.Window, windowErr = readDuration(viper, "mail.digest.window", time.Minute*5); windowErr != nil {
+				return config, windowErr
+			}
+			if config.MailServer.Digest.Window <= 0 {
+				return config, errors.New("Fatal error config: mail digest window must be greater than 0.")
+			}
+			config.MailServer.Digest.Bypass = []string{"critical"}
+			if viper.IsSet("mail.digest.bypass") {
+				config.MailServer.Digest.Bypass = viper.GetStringSlice("mail.digest.bypass")
+			}
+			for _, severity := range config.MailServer.Digest.Bypass {
+				if severity != "info" && severity != "warning" && severity != "critical" {
+					return config, errors.New("Fatal error config: mail digest bypass severity " + severity + " is not valid.")
+				}
+			}
+		}
+		for _, recipients := range [][]string{config.MailServer.To, config.MailServer.Cc, config.MailServer.Bcc} {
+			for _, recipient := range recipients {
+				if _, addressErr := mail.ParseAddress(recipient); addressErr != nil {
+					return config, errors.New("Fatal error config: mail recipient " + recipient + " is not a valid address.")
+				}
+			}
+		}
 	}
 
 	// Check if queue config is required
-	if config.NotifyConfig.SendQueueNotification {
+	if config.RabbitmqConfig.Enabled {
 		// Rabbitmq
 		if !viper.IsSet("rabbitmq") {
 			return config, errors.New("Fatal error config: rabbitmq config section is required.")
 		} else {
-			for _, requiredQueueVariable := range queueRequiredVariables {
-				if !viper.IsSet("rabbitmq." + requiredQueueVariable) {
-					return config, errors.New("Fatal error config: no rabbitmq " + requiredQueueVariable + " was defined.")
-				}
+			// A full connection URL replaces connection fields
+			if !viper.IsSet("rabbitmq.url") {
+				for _, requiredQueueVariable := range queueRequiredVariables {
+					if !viper.IsSet("rabbitmq." + requiredQueueVariable) {
+						return config, errors.New("Fatal error config: no rabbitmq " + requiredQueueVariable + " was defined.")
+					}
 
+				}
+			}
+		}
+		if viper.IsSet("rabbitmq.url") {
+			config.RabbitmqConfig.URL = viper.GetString("rabbitmq.url")
+			queueURL, urlErr := url.Parse(config.RabbitmqConfig.URL)
+			if urlErr != nil || !queueURLSchemes[queueURL.Scheme] || queueURL.Host == "" {
+				return config, errors.New("Fatal error config: rabbitmq url must be a valid amqp or amqps URL.")
 			}
 		}
 		config.RabbitmqConfig.QueueName = viper.GetString("rabbitmq.queue")
+		config.RabbitmqConfig.Exchange = viper.GetString("rabbitmq.exchange")
+		if config.RabbitmqConfig.Exchange == "" {
+			// Single queue mode
+			if config.RabbitmqConfig.QueueName == "" {
+				return config, errors.New("Fatal error config: no rabbitmq queue was defined.")
+			}
+		} else {
+			config.RabbitmqConfig.ExchangeType = "topic"
+			if viper.IsSet("rabbitmq.exchangetype") {
+				config.RabbitmqConfig.ExchangeType = viper.GetString("rabbitmq.exchangetype")
+			}
+			switch config.RabbitmqConfig.ExchangeType {
+			case "topic", "direct", "fanout":
+			default:
+				return config, errors.New("Fatal error config: rabbitmq exchangetype must be topic, direct or fanout.")
+			}
+			config.RabbitmqConfig.RoutingKey = "alarm.{{.DeviceID}}.{{.EventType}}"
+			if viper.IsSet("rabbitmq.routingkey") {
+				config.RabbitmqConfig.RoutingKey = viper.GetString("rabbitmq.routingkey")
+			}
+			if _, templateErr := template.New("routingkey").Parse(config.RabbitmqConfig.RoutingKey); templateErr != nil {
+				return config, errors.New("Fatal error config: rabbitmq routingkey is not a valid template.")
+			}
+			// Fanout exchanges ignore binding keys and direct ones only match exact keys
+			if config.RabbitmqConfig.ExchangeType == "topic" {
+				config.RabbitmqConfig.BindingKey = "#"
+			}
+			if viper.IsSet("rabbitmq.bindingkey") {
+				config.RabbitmqConfig.BindingKey = viper.GetString("rabbitmq.bindingkey")
+			}
+			if config.RabbitmqConfig.ExchangeType == "direct" && config.RabbitmqConfig.QueueName != "" && config.RabbitmqConfig.BindingKey == "" {
+				return config, errors.New("Fatal error config: rabbitmq bindingkey must be defined for direct exchanges.")
+			}
+		}
 		config.RabbitmqConfig.Host = viper.GetString("rabbitmq.host")
 		config.RabbitmqConfig.Port = viper.GetInt("rabbitmq.port")
 		config.RabbitmqConfig.User = viper.GetString("rabbitmq.user")
 		config.RabbitmqConfig.Password = viper.GetString("rabbitmq.password")
+		config.RabbitmqConfig.VHost = viper.GetString("rabbitmq.vhost")
+		var heartbeatErr error
+		if config.RabbitmqConfig.Heartbeat, heartbeatErr = readDuration(viper, "rabbitmq.heartbeat", time.Second*10); heartbeatErr != nil {
+			return config, heartbeatErr
+		}
+		if config.RabbitmqConfig.Heartbeat < 0 {
+			return config, errors.New("Fatal error config: rabbitmq heartbeat cannot be negative.")
+		}
+		var tlsErr error
+		if config.RabbitmqConfig.TLS, tlsErr = readTLSConfig(viper, "rabbitmq"); tlsErr != nil {
+			return config, tlsErr
+		}
+		if strings.HasPrefix(config.RabbitmqConfig.URL, "amqps://") {
+			config.RabbitmqConfig.TLS.Enabled = true
+		} else if config.RabbitmqConfig.URL != "" && config.RabbitmqConfig.TLS.Enabled {
+			// URL scheme decides the transport, an amqp URL would connect in plaintext
+			return config, errors.New("Fatal error config: rabbitmq url must use amqps when tls is enabled.")
+		}
+		config.RabbitmqConfig.BufferSize = 100
+		if viper.IsSet("rabbitmq.buffersize") {
+			config.RabbitmqConfig.BufferSize = viper.GetInt("rabbitmq.buffersize")
+			if config.RabbitmqConfig.BufferSize < 1 {
+				return config, errors.New("Fatal error config: rabbitmq buffersize must be greater than 0.")
+			}
+		}
+		config.RabbitmqConfig.CommandQueue = viper.GetString("rabbitmq.commandqueue")
+		if config.RabbitmqConfig.CommandQueue != "" && config.RabbitmqConfig.CommandQueue == config.RabbitmqConfig.QueueName {
+			return config, errors.New("Fatal error config: rabbitmq commandqueue must be different from queue.")
+		}
+	}
+
+	// Online debouncing is optional
+	config.Debounce.HoldPolls = viper.GetInt("debounce.holdpolls")
+	if config.Debounce.HoldPolls < 0 {
+		return config, errors.New("Fatal error config: debounce holdpolls cannot be negative.")
+	}
+	var debounceErr error
+	if config.Debounce.HoldTime, debounceErr = readDuration(viper, "debounce.holdtime", 0); debounceErr != nil {
+		return config, debounceErr
+	}
+	if config.Debounce.HoldTime < 0 {
+		return config, errors.New("Fatal error config: debounce holdtime cannot be negative.")
+	}
+	config.Debounce.FlapThreshold = viper.GetInt("debounce.flapthreshold")
+	if config.Debounce.FlapThreshold < 0 {
+		return config, errors.New("Fatal error config: debounce flapthreshold cannot be negative.")
+	}
+	if config.Debounce.FlapWindow, debounceErr = readDuration(viper, "debounce.flapwindow", time.Minute*10); debounceErr != nil {
+		return config, debounceErr
+	}
+	if config.Debounce.FlapWindow <= 0 {
+		return config, errors.New("Fatal error config: debounce flapwindow must be greater than 0.")
+	}
+
+	// Firing escalation is optional
+	config.Escalation.Enabled = viper.GetBool("escalation.enabled")
+	if config.Escalation.Enabled {
+		var escalationErr error
+		if config.Escalation.Interval, escalationErr = readDuration(viper, "escalation.interval", time.Minute*5); escalationErr != nil {
+			return config, escalationErr
+		}
+		if config.Escalation.Interval <= 0 {
+			return config, errors.New("Fatal error config: escalation interval must be greater than 0.")
+		}
+		config.Escalation.Channels = viper.GetStringSlice("escalation.channels")
+		if channel, valid := validChannels(config.Escalation.Channels); !valid {
+			return config, errors.New("Fatal error config: escalation channel " + channel + " is not valid.")
+		}
+		var levels []struct {
+			After      string
+			Channels   []string
+			Recipients []string
+		}
+		if unmarshalErr := viper.UnmarshalKey("escalation.levels", &levels); unmarshalErr != nil {
+			return config, errors.New("Fatal error config: escalation levels are not valid.")
+		}
+		var previous time.Duration
+		for index, level := range levels {
+			after, parseErr := time.ParseDuration(level.After)
+			if parseErr != nil || after <= previous {
+				return config, errors.New("Fatal error config: escalation level " + strconv.Itoa(index+1) + " after must be a duration greater than previous level one.")
+			}
+			for _, recipient := range level.Recipients {
+				if _, addressErr := mail.ParseAddress(recipient); addressErr != nil {
+					return config, errors.New("Fatal error config: escalation recipient " + recipient + " is not a valid address.")
+				}
+			}
+			if channel, valid := validChannels(level.Channels); !valid {
+				return config, errors.New("Fatal error config: escalation channel " + channel + " is not valid.")
+			}
+			previous = after
+			config.Escalation.Levels = append(config.Escalation.Levels, EscalationLevel{After: after, Channels: level.Channels, Recipients: level.Recipients})
+		}
+	}
+
+	// Webhook is optional
+	var webhookErr error
+	if config.Webhook, webhookErr = readWebhook(viper); webhookErr != nil {
+		return config, webhookErr
+	}
+
+	// MQTT is optional
+	var mqttErr error
+	if config.MQTT, mqttErr = readMQTT(viper); mqttErr != nil {
+		return config, mqttErr
+	}
+
+	// Chat notifiers are optional
+	if chatErr := readChatNotifiers(viper, &config); chatErr != nil {
+		return config, chatErr
+	}
+
+	// Rules and escalation can only be routed to enabled notifiers
+	enabled := enabledNotifiers(config)
+	for index, rule := range config.NotifyConfig.Rules {
+		for _, channel := range rule.Channels {
+			if !enabled[channel] {
+				return config, errors.New("Fatal error config: notify rule " + strconv.Itoa(index+1) + " channel " + channel + " is not enabled.")
+			}
+		}
+	}
+	escalationChannels := append([]string{}, config.Escalation.Channels...)
+	for _, level := range config.Escalation.Levels {
+		escalationChannels = append(escalationChannels, level.Channels...)
+	}
+	for _, channel := range escalationChannels {
+		if !enabled[channel] {
+			return config, errors.New("Fatal error config: escalation channel " + channel + " is not enabled.")
+		}
+	}
+
+	// Quiet hours are optional
+	var quietHoursErr error
+	if config.QuietHours, quietHoursErr = readQuietHours(viper); quietHoursErr != nil {
+		return config, quietHoursErr
+	}
+
+	// Changes history is optional
+	config.History.Enabled = viper.GetBool("history.enabled")
+	if config.History.Enabled {
+		config.History.Retention = 168
+		if viper.IsSet("history.retention") {
+			config.History.Retention = viper.GetInt("history.retention")
+		}
+		if config.History.Retention < 1 {
+			return config, errors.New("Fatal error config: history retention must be greater than 0.")
+		}
+	}
+
+	// HTTP status server is optional
+	config.HTTPServer.Enabled = viper.GetBool("http.enabled")
+	if config.HTTPServer.Enabled {
+		for _, requiredHTTPVariable := range httpRequiredVariables {
+			if !viper.IsSet("http." + requiredHTTPVariable) {
+				return config, errors.New("Fatal error config: no http " + requiredHTTPVariable + " was defined.")
+			}
+		}
+		config.HTTPServer.Host = "127.0.0.1"
+		if viper.IsSet("http.host") {
+			config.HTTPServer.Host = viper.GetString("http.host")
+		}
+		config.HTTPServer.Port = viper.GetInt("http.port")
+		config.HTTPServer.MaxPollAge = 60
+		if viper.IsSet("http.maxpollage") {
+			config.HTTPServer.MaxPollAge = viper.GetInt("http.maxpollage")
+		}
+		if config.HTTPServer.MaxPollAge < 1 {
+			return config, errors.New("Fatal error config: http maxpollage must be greater than 0.")
+		}
+		config.HTTPServer.Write = viper.GetBool("http.write")
+		if config.HTTPServer.Write {
+			config.HTTPServer.Token = viper.GetString("http.token")
+			if config.HTTPServer.Token == "" {
+				return config, errors.New("Fatal error config: http token must be defined when http write is enabled.")
+			}
+		}
 	}
 
 	return config, nil
@@ -0,0 +1,231 @@
+package events
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Field identifies which device attribute changed
+type Field string
+
+const (
+	FieldName   Field = "name"
+	FieldMode   Field = "mode"
+	FieldFiring Field = "firing"
+	FieldOnline Field = "online"
+	// FieldAvailable reports whether device status can be retrieved from AlarmManager
+	FieldAvailable Field = "available"
+	// FieldReachable reports AlarmManager availability instead of a device attribute
+	FieldReachable Field = "reachable"
+	// FieldFlapping reports a device whose online status changes too often
+	FieldFlapping Field = "flapping"
+)
+
+// Severity classifies how important a change is
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// Type names the kind of change, it is used to route and filter events
+type Type string
+
+const (
+	TypeRenamed       Type = "renamed"
+	TypeModeChanged   Type = "mode_changed"
+	TypeFiringStarted Type = "firing_started"
+	TypeFiringStopped Type = "firing_stopped"
+	// TypeStillFiring reminds a device keeps firing
+	TypeStillFiring Type = "still_firing"
+	TypeOnline      Type = "online"
+	TypeOffline     Type = "offline"
+	TypeAvailable   Type = "available"
+	TypeUnavailable Type = "unavailable"
+	TypeRecovered   Type = "recovered"
+	TypeUnreachable Type = "unreachable"
+	TypeFlapping    Type = "flapping"
+	TypeSettled     Type = "settled"
+)
+
+// ChangeEvent describes a single attribute change detected on a device
+type ChangeEvent struct {
+	DeviceID   string    `json:"device_id"`
+	DeviceName string    `json:"device_name"`
+	Field      Field     `json:"field"`
+	OldValue   string    `json:"old_value"`
+	NewValue   string    `json:"new_value"`
+	Timestamp  time.Time `json:"timestamp"`
+	Severity   Severity  `json:"severity"`
+}
+
+// New builds a ChangeEvent setting its severity from field and new value
+func New(deviceID string, deviceName string, field Field, oldValue string, newValue string, timestamp time.Time) ChangeEvent {
+	event := ChangeEvent{DeviceID: deviceID, DeviceName: deviceName, Field: field, OldValue: oldValue, NewValue: newValue, Timestamp: timestamp}
+	event.Severity = severityFor(field, newValue)
+	return event
+}
+
+func severityFor(field Field, newValue string) Severity {
+	switch field {
+	case FieldFiring:
+		if newValue == "true" {
+			return SeverityCritical
+		}
+		return SeverityWarning
+	case FieldOnline, FieldAvailable, FieldReachable:
+		if newValue == "false" {
+			return SeverityWarning
+		}
+	case FieldFlapping:
+		if newValue == "true" {
+			return SeverityWarning
+		}
+	}
+	return SeverityInfo
+}
+
+// Message renders the change as human readable text
+func (event ChangeEvent) Message() string {
+	switch event.Field {
+	case FieldName:
+		return fmt.Sprintf("Changed Name to %s", event.NewValue)
+	case FieldMode:
+		return fmt.Sprintf("Changed Mode from %s to %s", event.OldValue, event.NewValue)
+	case FieldFiring:
+		if event.NewValue == "true" && event.OldValue == "true" {
+			return "Still Firing"
+		}
+		if event.NewValue == "true" {
+			return "Started Firing"
+		}
+		return "Stopped Firing"
+	case FieldOnline:
+		if event.NewValue == "true" {
+			return "Became Online"
+		}
+		return "Became Offline"
+	case FieldAvailable:
+		if event.NewValue == "true" {
+			return "Status Available"
+		}
+		return "Status Unavailable"
+	case FieldReachable:
+		if event.NewValue == "true" {
+			return "Recovered"
+		}
+		return "Became Unreachable"
+	case FieldFlapping:
+		if event.NewValue == "true" {
+			return "Started Flapping"
+		}
+		return "Stopped Flapping"
+	}
+	return fmt.Sprintf("Changed %s from %s to %s", event.Field, event.OldValue, event.NewValue)
+}
+
+// Type returns the kind of change from field and new value
+func (event ChangeEvent) Type() Type {
+	switch event.Field {
+	case FieldName:
+		return TypeRenamed
+	case FieldMode:
+		return TypeModeChanged
+	case FieldFiring:
+		if event.NewValue == "true" && event.OldValue == "true" {
+			return TypeStillFiring
+		}
+		if event.NewValue == "true" {
+			return TypeFiringStarted
+		}
+		return TypeFiringStopped
+	case FieldOnline:
+		if event.NewValue == "true" {
+			return TypeOnline
+		}
+		return TypeOffline
+	case FieldAvailable:
+		if event.NewValue == "true" {
+			return TypeAvailable
+		}
+		return TypeUnavailable
+	case FieldReachable:
+		if event.NewValue == "true" {
+			return TypeRecovered
+		}
+		return TypeUnreachable
+	case FieldFlapping:
+		if event.NewValue == "true" {
+			return TypeFlapping
+		}
+		return TypeSettled
+	}
+	return Type(event.Field)
+}
+
+// IsStatusChange returns true for mode and firing changes
+func (event ChangeEvent) IsStatusChange() bool {
+	return event.Field == FieldMode || event.Field == FieldFiring
+}
+
+// IsOnlineChange returns true for online and flapping changes
+func (event ChangeEvent) IsOnlineChange() bool {
+	return event.Field == FieldOnline || event.Field == FieldFlapping
+}
+
+// IsAvailabilityChange returns true when device status became available or unavailable
+func (event ChangeEvent) IsAvailabilityChange() bool {
+	return event.Field == FieldAvailable
+}
+
+// RenderMessage joins messages of several events
+func RenderMessage(changes []ChangeEvent) string {
+	messages := make([]string, 0, len(changes))
+	for _, change := range changes {
+		messages = append(messages, change.Message())
+	}
+	return strings.Join(messages, " ")
+}
+
+// MaxSeverity returns the highest severity found in changes
+func MaxSeverity(changes []ChangeEvent) Severity {
+	maxSeverity := SeverityInfo
+	for _, change := range changes {
+		if change.Severity == SeverityCritical {
+			return SeverityCritical
+		}
+		if change.Severity == SeverityWarning {
+			maxSeverity = SeverityWarning
+		}
+	}
+	return maxSeverity
+}
+
+// GroupByDevice returns changes indexed by device ID keeping their order
+func GroupByDevice(changes []ChangeEvent) map[string][]ChangeEvent {
+	grouped := make(map[string][]ChangeEvent)
+	for _, change := range changes {
+		grouped[change.DeviceID] = append(grouped[change.DeviceID], change)
+	}
+	return grouped
+}
+
+// Acknowledgement records who acknowledged a device firing and when
+type Acknowledgement struct {
+	DeviceID string    `json:"device_id"`
+	By       string    `json:"by"`
+	At       time.Time `json:"at"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+// Maintenance suppresses non critical notifications of a device until Until
+type Maintenance struct {
+	DeviceID string    `json:"device_id"`
+	By       string    `json:"by"`
+	Reason   string    `json:"reason,omitempty"`
+	Started  time.Time `json:"started"`
+	Until    time.Time `json:"until"`
+}
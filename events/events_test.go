@@ -0,0 +1,69 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessages(t *testing.T) {
+
+	now := time.Now()
+	expected := map[string]ChangeEvent{
+		"Changed Name to Home Alarm":          New("ab123", "Home Alarm", FieldName, "", "Home Alarm", now),
+		"Changed Mode from armed to disarmed": New("ab123", "Home Alarm", FieldMode, "armed", "disarmed", now),
+		"Started Firing":                      New("ab123", "Home Alarm", FieldFiring, "false", "true", now),
+		"Stopped Firing":                      New("ab123", "Home Alarm", FieldFiring, "true", "false", now),
+		"Still Firing":                        New("ab123", "Home Alarm", FieldFiring, "true", "true", now),
+		"Became Online":                       New("ab123", "Home Alarm", FieldOnline, "false", "true", now),
+		"Became Offline":                      New("ab123", "Home Alarm", FieldOnline, "true", "false", now),
+	}
+	for message, event := range expected {
+		if event.Message() != message {
+			t.Errorf("Message should be '%s', not '%s'.", message, event.Message())
+		}
+	}
+}
+
+func TestSeverity(t *testing.T) {
+
+	now := time.Now()
+	started := New("ab123", "Home Alarm", FieldFiring, "false", "true", now)
+	offline := New("ab123", "Home Alarm", FieldOnline, "true", "false", now)
+	mode := New("ab123", "Home Alarm", FieldMode, "armed", "disarmed", now)
+
+	if started.Severity != SeverityCritical {
+		t.Errorf("Started firing severity should be critical, not %s.", started.Severity)
+	}
+	if offline.Severity != SeverityWarning {
+		t.Errorf("Became offline severity should be warning, not %s.", offline.Severity)
+	}
+	if mode.Severity != SeverityInfo {
+		t.Errorf("Mode change severity should be info, not %s.", mode.Severity)
+	}
+	if MaxSeverity([]ChangeEvent{mode, offline}) != SeverityWarning {
+		t.Errorf("Max severity should be warning.")
+	}
+	if RenderMessage([]ChangeEvent{mode, started}) != "Changed Mode from armed to disarmed Started Firing" {
+		t.Errorf("Unexpected rendered message '%s'.", RenderMessage([]ChangeEvent{mode, started}))
+	}
+}
+
+func TestTypes(t *testing.T) {
+
+	now := time.Now()
+	expected := map[Type]ChangeEvent{
+		TypeRenamed:       New("ab123", "Home Alarm", FieldName, "", "Home Alarm", now),
+		TypeModeChanged:   New("ab123", "Home Alarm", FieldMode, "armed", "disarmed", now),
+		TypeFiringStarted: New("ab123", "Home Alarm", FieldFiring, "false", "true", now),
+		TypeFiringStopped: New("ab123", "Home Alarm", FieldFiring, "true", "false", now),
+		TypeOffline:       New("ab123", "Home Alarm", FieldOnline, "true", "false", now),
+		TypeUnavailable:   New("ab123", "Home Alarm", FieldAvailable, "true", "false", now),
+		TypeRecovered:     New("alarmmanager", "AlarmManager", FieldReachable, "false", "true", now),
+		TypeFlapping:      New("ab123", "Home Alarm", FieldFlapping, "false", "true", now),
+	}
+	for eventType, event := range expected {
+		if event.Type() != eventType {
+			t.Errorf("Type should be '%s', not '%s'.", eventType, event.Type())
+		}
+	}
+}
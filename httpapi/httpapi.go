@@ -0,0 +1,438 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+)
+
+// StatusProvider returns the last processed snapshot and when AlarmManager was last polled successfully
+type StatusProvider interface {
+	Snapshot() (apiwatcher.APIInfo, time.Time)
+}
+
+// Pinger checks a backend connectivity
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HistoryProvider returns changes stored for a device
+type HistoryProvider interface {
+	History(ctx context.Context, deviceID string, from time.Time, to time.Time) ([]events.ChangeEvent, error)
+}
+
+// AcknowledgementStore records and returns firing acknowledgements
+type AcknowledgementStore interface {
+	Acknowledge(ctx context.Context, acknowledgement events.Acknowledgement) error
+	Acknowledgements(ctx context.Context) (map[string]events.Acknowledgement, error)
+}
+
+// MaintenanceStore records device maintenance windows
+type MaintenanceStore interface {
+	StartMaintenance(ctx context.Context, maintenance events.Maintenance) error
+	Maintenances(ctx context.Context) (map[string]events.Maintenance, error)
+	EndMaintenance(ctx context.Context, deviceID string) error
+}
+
+// Server exposes watcher status through HTTP
+type Server struct {
+	Status StatusProvider
+	Redis  Pinger
+	// MaxPollAge is the maximum time since last successful poll to be ready
+	MaxPollAge time.Duration
+	// Metrics serves /metrics when set
+	Metrics http.Handler
+	// History serves /history/{deviceID} when set
+	History HistoryProvider
+	// Acknowledgements serves /acknowledge/{deviceID} and adds acknowledgements
+	// to status when set
+	Acknowledgements AcknowledgementStore
+	// Maintenances serves /maintenance and /maintenance/{deviceID} when set
+	Maintenances MaintenanceStore
+	// WriteToken must be sent as bearer token to endpoints changing state,
+	// /acknowledge/{deviceID} and /maintenance/{deviceID}. They are not served
+	// when empty.
+	WriteToken string
+}
+
+// MaintenanceRequest is the JSON document expected by POST
+// /maintenance/{deviceID}, window lasts Duration or ends at Until
+type MaintenanceRequest struct {
+	By       string    `json:"by"`
+	Reason   string    `json:"reason"`
+	Duration string    `json:"duration"`
+	Until    time.Time `json:"until"`
+}
+
+// MaintenanceResponse is the JSON document returned by /maintenance
+type MaintenanceResponse struct {
+	Maintenances []events.Maintenance `json:"maintenances"`
+}
+
+// AcknowledgeRequest is the JSON document expected by /acknowledge/{deviceID}
+type AcknowledgeRequest struct {
+	By      string `json:"by"`
+	Comment string `json:"comment"`
+}
+
+// HistoryResponse is the JSON document returned by /history/{deviceID}
+type HistoryResponse struct {
+	DeviceID string               `json:"device_id"`
+	From     time.Time            `json:"from"`
+	To       time.Time            `json:"to"`
+	Changes  []events.ChangeEvent `json:"changes"`
+}
+
+// DeviceStatus is the JSON representation of a device
+type DeviceStatus struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Mode         string `json:"mode"`
+	Firing       bool   `json:"firing"`
+	Online       bool   `json:"online"`
+	FetchState   string `json:"fetch_state"`
+	FetchMessage string `json:"fetch_message,omitempty"`
+	// Acknowledgement is set while device firing is acknowledged
+	Acknowledgement *events.Acknowledgement `json:"acknowledgement,omitempty"`
+}
+
+// StatusResponse is the JSON document returned by /status
+type StatusResponse struct {
+	Time        int64          `json:"time"`
+	LastSuccess *time.Time     `json:"last_success,omitempty"`
+	Devices     []DeviceStatus `json:"devices"`
+}
+
+type checkResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Handler returns the HTTP handler serving every endpoint
+func (server Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", server.handleStatus)
+	mux.HandleFunc("/status/", server.handleDeviceStatus)
+	mux.HandleFunc("/healthz", server.handleHealth)
+	mux.HandleFunc("/readyz", server.handleReady)
+	if server.Metrics != nil {
+		mux.Handle("/metrics", server.Metrics)
+	}
+	if server.History != nil {
+		mux.HandleFunc("/history/", server.handleHistory)
+	}
+	if server.Acknowledgements != nil && server.WriteToken != "" {
+		mux.HandleFunc("/acknowledge/", server.requireToken(server.handleAcknowledge))
+	}
+	if server.Maintenances != nil {
+		mux.HandleFunc("/maintenance", server.handleMaintenances)
+		if server.WriteToken != "" {
+			mux.HandleFunc("/maintenance/", server.requireToken(server.handleMaintenance))
+		}
+	}
+	return mux
+}
+
+// requireToken rejects requests without WriteToken as bearer token
+func (server Server) requireToken(handler http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + server.WriteToken)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(value)
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return false
+	}
+	return true
+}
+
+func allowPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return false
+	}
+	return true
+}
+
+func deviceStatus(apiInfo apiwatcher.APIInfo, deviceID string, acknowledgements map[string]events.Acknowledgement) DeviceStatus {
+	info := apiInfo.DevicesInfo[deviceID]
+	fetchStatus := apiInfo.Status(deviceID)
+	status := DeviceStatus{ID: deviceID, Name: info.Name, Mode: info.Mode, Firing: info.Firing, Online: info.Online, FetchState: string(fetchStatus.State), FetchMessage: fetchStatus.Message}
+	if acknowledgement, found := acknowledgements[deviceID]; found {
+		status.Acknowledgement = &acknowledgement
+	}
+	return status
+}
+
+// acknowledgements returns stored acknowledgements, none if the server has no store
+func (server Server) acknowledgements(ctx context.Context) (map[string]events.Acknowledgement, error) {
+	if server.Acknowledgements == nil {
+		return nil, nil
+	}
+	return server.Acknowledgements.Acknowledgements(ctx)
+}
+
+func knownDevices(apiInfo apiwatcher.APIInfo) []string {
+	deviceIDs := make([]string, 0, len(apiInfo.DevicesStatus))
+	for deviceID := range apiInfo.DevicesInfo {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	for deviceID := range apiInfo.DevicesStatus {
+		if _, ok := apiInfo.DevicesInfo[deviceID]; !ok {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	sort.Strings(deviceIDs)
+	return deviceIDs
+}
+
+func (server Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	acknowledgements, acknowledgementsErr := server.acknowledgements(r.Context())
+	if acknowledgementsErr != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": acknowledgementsErr.Error()})
+		return
+	}
+	apiInfo, lastSuccess := server.Status.Snapshot()
+	response := StatusResponse{Time: apiInfo.Time, Devices: []DeviceStatus{}}
+	if !lastSuccess.IsZero() {
+		response.LastSuccess = &lastSuccess
+	}
+	for _, deviceID := range knownDevices(apiInfo) {
+		response.Devices = append(response.Devices, deviceStatus(apiInfo, deviceID, acknowledgements))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (server Server) handleDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	deviceID := strings.TrimPrefix(r.URL.Path, "/status/")
+	if deviceID == "" || strings.Contains(deviceID, "/") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	apiInfo, _ := server.Status.Snapshot()
+	_, hasInfo := apiInfo.DevicesInfo[deviceID]
+	_, hasStatus := apiInfo.DevicesStatus[deviceID]
+	if !hasInfo && !hasStatus {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "device " + deviceID + " not found"})
+		return
+	}
+	acknowledgements, acknowledgementsErr := server.acknowledgements(r.Context())
+	if acknowledgementsErr != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": acknowledgementsErr.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, deviceStatus(apiInfo, deviceID, acknowledgements))
+}
+
+func (server Server) handleAcknowledge(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+	deviceID := strings.TrimPrefix(r.URL.Path, "/acknowledge/")
+	if deviceID == "" || strings.Contains(deviceID, "/") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	var request AcknowledgeRequest
+	if decodeErr := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&request); decodeErr != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body, JSON document expected"})
+		return
+	}
+	if strings.TrimSpace(request.By) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "by is required"})
+		return
+	}
+	acknowledgement := events.Acknowledgement{DeviceID: deviceID, By: request.By, At: time.Now(), Comment: request.Comment}
+	switch acknowledgeErr := server.Acknowledgements.Acknowledge(r.Context(), acknowledgement); acknowledgeErr {
+	case nil:
+		writeJSON(w, http.StatusOK, acknowledgement)
+	case storage.ErrUnknownDevice:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "device " + deviceID + " not found"})
+	case storage.ErrNotFiring:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "device " + deviceID + " is not firing"})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": acknowledgeErr.Error()})
+	}
+}
+
+func parseTimeParameter(r *http.Request, name string, defaultValue time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (server Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	deviceID := strings.TrimPrefix(r.URL.Path, "/history/")
+	if deviceID == "" || strings.Contains(deviceID, "/") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	to, toErr := parseTimeParameter(r, "to", time.Now())
+	if toErr != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid to parameter, RFC3339 time expected"})
+		return
+	}
+	from, fromErr := parseTimeParameter(r, "from", to.Add(-24*time.Hour))
+	if fromErr != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid from parameter, RFC3339 time expected"})
+		return
+	}
+	if from.After(to) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "from must be before to"})
+		return
+	}
+	changes, historyErr := server.History.History(r.Context(), deviceID, from, to)
+	if historyErr != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": historyErr.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, HistoryResponse{DeviceID: deviceID, From: from, To: to, Changes: changes})
+}
+
+func (server Server) handleMaintenances(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	maintenances, maintenancesErr := server.Maintenances.Maintenances(r.Context())
+	if maintenancesErr != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": maintenancesErr.Error()})
+		return
+	}
+	response := MaintenanceResponse{Maintenances: []events.Maintenance{}}
+	now := time.Now()
+	for _, maintenance := range maintenances {
+		// Expired windows are kept until the watcher ends them
+		if now.Before(maintenance.Until) {
+			response.Maintenances = append(response.Maintenances, maintenance)
+		}
+	}
+	sort.Slice(response.Maintenances, func(i, j int) bool {
+		return response.Maintenances[i].DeviceID < response.Maintenances[j].DeviceID
+	})
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (server Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	deviceID := strings.TrimPrefix(r.URL.Path, "/maintenance/")
+	if deviceID == "" || strings.Contains(deviceID, "/") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		server.startMaintenance(w, r, deviceID)
+	case http.MethodDelete:
+		if endErr := server.Maintenances.EndMaintenance(r.Context(), deviceID); endErr != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": endErr.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodPost+", "+http.MethodDelete)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func (server Server) startMaintenance(w http.ResponseWriter, r *http.Request, deviceID string) {
+	var request MaintenanceRequest
+	if decodeErr := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&request); decodeErr != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body, JSON document expected"})
+		return
+	}
+	if strings.TrimSpace(request.By) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "by is required"})
+		return
+	}
+	now := time.Now()
+	until := request.Until
+	if request.Duration != "" {
+		duration, durationErr := time.ParseDuration(request.Duration)
+		if durationErr != nil || !request.Until.IsZero() {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "duration must be a valid duration and cannot be used with until"})
+			return
+		}
+		until = now.Add(duration)
+	}
+	if !until.After(now) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "maintenance window must end in the future, set duration or until"})
+		return
+	}
+	maintenance := events.Maintenance{DeviceID: deviceID, By: request.By, Reason: request.Reason, Started: now, Until: until}
+	switch startErr := server.Maintenances.StartMaintenance(r.Context(), maintenance); startErr {
+	case nil:
+		writeJSON(w, http.StatusOK, maintenance)
+	case storage.ErrUnknownDevice:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "device " + deviceID + " not found"})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": startErr.Error()})
+	}
+}
+
+func (server Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, checkResponse{Status: "ok"})
+}
+
+func (server Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	response := checkResponse{Status: "ok", Checks: map[string]string{"redis": "ok", "alarmmanager": "ok"}}
+
+	if pingErr := server.Redis.Ping(r.Context()); pingErr != nil {
+		response.Status = "unavailable"
+		response.Checks["redis"] = pingErr.Error()
+	}
+
+	_, lastSuccess := server.Status.Snapshot()
+	if lastSuccess.IsZero() {
+		response.Status = "unavailable"
+		response.Checks["alarmmanager"] = "never polled successfully"
+	} else if server.MaxPollAge > 0 && time.Since(lastSuccess) > server.MaxPollAge {
+		response.Status = "unavailable"
+		response.Checks["alarmmanager"] = "last successful poll at " + lastSuccess.Format(time.RFC3339)
+	}
+
+	if response.Status != "ok" {
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,376 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+)
+
+type FakeStatus struct {
+	Info        apiwatcher.APIInfo
+	LastSuccess time.Time
+}
+
+func (fake FakeStatus) Snapshot() (apiwatcher.APIInfo, time.Time) {
+	return fake.Info, fake.LastSuccess
+}
+
+type FakePinger struct {
+	Err error
+}
+
+func (fake FakePinger) Ping(ctx context.Context) error {
+	return fake.Err
+}
+
+func testInfo() apiwatcher.APIInfo {
+	return apiwatcher.APIInfo{
+		Time: 1655150000,
+		DevicesInfo: map[string]apiwatcher.DeviceInfo{
+			"home":   {Name: "Home Alarm", Mode: "armed", Firing: false, Online: true},
+			"garage": {Name: "Garage", Mode: "disarmed", Firing: false, Online: true},
+		},
+		DevicesStatus: map[string]apiwatcher.FetchStatus{
+			"home":   {State: apiwatcher.FetchOK},
+			"garage": {State: apiwatcher.FetchStale, Message: "timeout"},
+			"broken": {State: apiwatcher.FetchError, Message: "Failed"},
+		},
+	}
+}
+
+func get(t *testing.T, server Server, path string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestStatus(t *testing.T) {
+
+	server := Server{Status: FakeStatus{Info: testInfo(), LastSuccess: time.Now()}, Redis: FakePinger{}}
+	recorder := get(t, server, "/status")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET /status should return 200, not %d.", recorder.Code)
+	}
+	var response StatusResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("GET /status should return JSON, error was '%s'.", err.Error())
+	}
+	if len(response.Devices) != 3 {
+		t.Fatalf("GET /status should return 3 devices, not %d.", len(response.Devices))
+	}
+	if response.Devices[0].ID != "broken" || response.Devices[0].FetchState != "error" {
+		t.Errorf("Devices should be sorted and include failed ones, first was %+v.", response.Devices[0])
+	}
+	if response.Devices[1].ID != "garage" || response.Devices[1].FetchState != "stale" || response.Devices[1].Mode != "disarmed" {
+		t.Errorf("Unexpected garage status %+v.", response.Devices[1])
+	}
+	if response.LastSuccess == nil {
+		t.Errorf("GET /status should include last successful poll time.")
+	}
+}
+
+func TestDeviceStatus(t *testing.T) {
+
+	server := Server{Status: FakeStatus{Info: testInfo(), LastSuccess: time.Now()}, Redis: FakePinger{}}
+	recorder := get(t, server, "/status/home")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET /status/home should return 200, not %d.", recorder.Code)
+	}
+	var device DeviceStatus
+	json.Unmarshal(recorder.Body.Bytes(), &device)
+	if device.Name != "Home Alarm" || device.Mode != "armed" || device.FetchState != "ok" {
+		t.Errorf("Unexpected device status %+v.", device)
+	}
+
+	recorder = get(t, server, "/status/unknown")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("GET /status/unknown should return 404, not %d.", recorder.Code)
+	}
+}
+
+func TestOnlyGetIsAllowed(t *testing.T) {
+
+	server := Server{Status: FakeStatus{}, Redis: FakePinger{}}
+	request := httptest.NewRequest(http.MethodPost, "/status", nil)
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status should return 405, not %d.", recorder.Code)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+
+	server := Server{Status: FakeStatus{}, Redis: FakePinger{Err: errors.New("down")}}
+	recorder := get(t, server, "/healthz")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("GET /healthz should always return 200, not %d.", recorder.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+
+	ready := Server{Status: FakeStatus{LastSuccess: time.Now()}, Redis: FakePinger{}, MaxPollAge: time.Minute}
+	if recorder := get(t, ready, "/readyz"); recorder.Code != http.StatusOK {
+		t.Errorf("GET /readyz should return 200 when everything is fine, not %d.", recorder.Code)
+	}
+
+	redisDown := Server{Status: FakeStatus{LastSuccess: time.Now()}, Redis: FakePinger{Err: errors.New("connection refused")}, MaxPollAge: time.Minute}
+	recorder := get(t, redisDown, "/readyz")
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz should return 503 when redis is down, not %d.", recorder.Code)
+	}
+	var response checkResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.Checks["redis"] != "connection refused" {
+		t.Errorf("Redis check should report ping error, not '%s'.", response.Checks["redis"])
+	}
+
+	neverPolled := Server{Status: FakeStatus{}, Redis: FakePinger{}, MaxPollAge: time.Minute}
+	if recorder := get(t, neverPolled, "/readyz"); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz should return 503 before first successful poll, not %d.", recorder.Code)
+	}
+
+	oldPoll := Server{Status: FakeStatus{LastSuccess: time.Now().Add(-time.Hour)}, Redis: FakePinger{}, MaxPollAge: time.Minute}
+	if recorder := get(t, oldPoll, "/readyz"); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz should return 503 when last successful poll is too old, not %d.", recorder.Code)
+	}
+}
+
+type FakeHistory struct {
+	From    time.Time
+	To      time.Time
+	Changes []events.ChangeEvent
+}
+
+func (fake *FakeHistory) History(ctx context.Context, deviceID string, from time.Time, to time.Time) ([]events.ChangeEvent, error) {
+	fake.From = from
+	fake.To = to
+	return fake.Changes, nil
+}
+
+func TestHistory(t *testing.T) {
+
+	history := FakeHistory{Changes: []events.ChangeEvent{events.New("home", "Home Alarm", events.FieldMode, "disarmed", "armed", time.Unix(1655150000, 0))}}
+	server := Server{Status: FakeStatus{}, Redis: FakePinger{}, History: &history}
+
+	recorder := get(t, server, "/history/home?from=2022-06-13T00:00:00Z&to=2022-06-14T00:00:00Z")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET /history/home should return 200, not %d.", recorder.Code)
+	}
+	var response HistoryResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.DeviceID != "home" || len(response.Changes) != 1 || response.Changes[0].NewValue != "armed" {
+		t.Errorf("Unexpected history response %+v.", response)
+	}
+	if history.From.Format(time.RFC3339) != "2022-06-13T00:00:00Z" || history.To.Format(time.RFC3339) != "2022-06-14T00:00:00Z" {
+		t.Errorf("History should be queried with requested range, not %s - %s.", history.From, history.To)
+	}
+
+	recorder = get(t, server, "/history/home")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("GET /history/home without range should return 200, not %d.", recorder.Code)
+	}
+	if history.To.Sub(history.From) != 24*time.Hour {
+		t.Errorf("Default history range should be last 24 hours.")
+	}
+
+	if recorder := get(t, server, "/history/home?from=yesterday"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("GET /history/home with invalid from should return 400, not %d.", recorder.Code)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+
+	server := Server{Status: FakeStatus{}, Redis: FakePinger{}}
+	if recorder := get(t, server, "/history/home"); recorder.Code != http.StatusNotFound {
+		t.Errorf("GET /history/home without history should return 404, not %d.", recorder.Code)
+	}
+}
+
+type FakeAcknowledgements struct {
+	Stored map[string]events.Acknowledgement
+}
+
+func (fake *FakeAcknowledgements) Acknowledge(ctx context.Context, acknowledgement events.Acknowledgement) error {
+	switch acknowledgement.DeviceID {
+	case "unknown":
+		return storage.ErrUnknownDevice
+	case "garage":
+		return storage.ErrNotFiring
+	}
+	fake.Stored[acknowledgement.DeviceID] = acknowledgement
+	return nil
+}
+
+func (fake *FakeAcknowledgements) Acknowledgements(ctx context.Context) (map[string]events.Acknowledgement, error) {
+	return fake.Stored, nil
+}
+
+const testToken = "s3cr3t"
+
+func send(t *testing.T, server Server, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func post(t *testing.T, server Server, path string, body string) *httptest.ResponseRecorder {
+	return send(t, server, http.MethodPost, path, testToken, body)
+}
+
+func TestAcknowledge(t *testing.T) {
+
+	acknowledgements := FakeAcknowledgements{Stored: map[string]events.Acknowledgement{}}
+	server := Server{Status: FakeStatus{Info: testInfo(), LastSuccess: time.Now()}, Redis: FakePinger{}, Acknowledgements: &acknowledgements, WriteToken: testToken}
+
+	recorder := post(t, server, "/acknowledge/home", `{"by": "alice", "comment": "On my way"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("POST /acknowledge/home should return 200, not %d.", recorder.Code)
+	}
+	if stored := acknowledgements.Stored["home"]; stored.By != "alice" || stored.Comment != "On my way" || stored.At.IsZero() {
+		t.Errorf("Acknowledgement should be stored, it was %+v.", stored)
+	}
+
+	var device DeviceStatus
+	json.Unmarshal(get(t, server, "/status/home").Body.Bytes(), &device)
+	if device.Acknowledgement == nil || device.Acknowledgement.By != "alice" {
+		t.Errorf("Device status should include acknowledgement, status was %+v.", device)
+	}
+	var response StatusResponse
+	json.Unmarshal(get(t, server, "/status").Body.Bytes(), &response)
+	for _, device := range response.Devices {
+		if (device.ID == "home") != (device.Acknowledgement != nil) {
+			t.Errorf("Only acknowledged devices should include acknowledgement, status was %+v.", device)
+		}
+	}
+
+	if recorder := post(t, server, "/acknowledge/home", `{"comment": "On my way"}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("POST /acknowledge/home without by should return 400, not %d.", recorder.Code)
+	}
+	if recorder := post(t, server, "/acknowledge/home", `alice`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("POST /acknowledge/home without JSON body should return 400, not %d.", recorder.Code)
+	}
+	if recorder := post(t, server, "/acknowledge/unknown", `{"by": "alice"}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("POST /acknowledge/unknown should return 404, not %d.", recorder.Code)
+	}
+	if recorder := post(t, server, "/acknowledge/garage", `{"by": "alice"}`); recorder.Code != http.StatusConflict {
+		t.Errorf("POST /acknowledge/garage should return 409 when device is not firing, not %d.", recorder.Code)
+	}
+	if recorder := send(t, server, http.MethodGet, "/acknowledge/home", testToken, ""); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /acknowledge/home should return 405, not %d.", recorder.Code)
+	}
+}
+
+type FakeMaintenances struct {
+	Stored map[string]events.Maintenance
+}
+
+func (fake *FakeMaintenances) StartMaintenance(ctx context.Context, maintenance events.Maintenance) error {
+	if maintenance.DeviceID == "unknown" {
+		return storage.ErrUnknownDevice
+	}
+	fake.Stored[maintenance.DeviceID] = maintenance
+	return nil
+}
+
+func (fake *FakeMaintenances) Maintenances(ctx context.Context) (map[string]events.Maintenance, error) {
+	return fake.Stored, nil
+}
+
+func (fake *FakeMaintenances) EndMaintenance(ctx context.Context, deviceID string) error {
+	delete(fake.Stored, deviceID)
+	return nil
+}
+
+func TestMaintenance(t *testing.T) {
+
+	maintenances := FakeMaintenances{Stored: map[string]events.Maintenance{
+		"expired": {DeviceID: "expired", By: "bob", Until: time.Now().Add(-time.Minute)},
+	}}
+	server := Server{Status: FakeStatus{Info: testInfo(), LastSuccess: time.Now()}, Redis: FakePinger{}, Maintenances: &maintenances, WriteToken: testToken}
+
+	recorder := post(t, server, "/maintenance/home", `{"by": "alice", "reason": "Panel replacement", "duration": "2h"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("POST /maintenance/home should return 200, not %d.", recorder.Code)
+	}
+	stored := maintenances.Stored["home"]
+	if stored.By != "alice" || stored.Reason != "Panel replacement" || stored.Until.Sub(stored.Started) != time.Hour*2 {
+		t.Errorf("Maintenance window should be stored, it was %+v.", stored)
+	}
+
+	var response MaintenanceResponse
+	json.Unmarshal(get(t, server, "/maintenance").Body.Bytes(), &response)
+	if len(response.Maintenances) != 1 || response.Maintenances[0].DeviceID != "home" {
+		t.Errorf("GET /maintenance should only list active windows, response was %+v.", response)
+	}
+
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if recorder := post(t, server, "/maintenance/garage", `{"by": "alice", "until": "`+until+`"}`); recorder.Code != http.StatusOK {
+		t.Errorf("POST /maintenance/garage with until should return 200, not %d.", recorder.Code)
+	}
+	if recorder := post(t, server, "/maintenance/garage", `{"by": "alice"}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("POST /maintenance/garage without duration nor until should return 400, not %d.", recorder.Code)
+	}
+	if recorder := post(t, server, "/maintenance/garage", `{"by": "alice", "duration": "soon"}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("POST /maintenance/garage with invalid duration should return 400, not %d.", recorder.Code)
+	}
+	if recorder := post(t, server, "/maintenance/garage", `{"duration": "1h"}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("POST /maintenance/garage without by should return 400, not %d.", recorder.Code)
+	}
+	if recorder := post(t, server, "/maintenance/unknown", `{"by": "alice", "duration": "1h"}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("POST /maintenance/unknown should return 404, not %d.", recorder.Code)
+	}
+
+	recorder = send(t, server, http.MethodDelete, "/maintenance/home", testToken, "")
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("DELETE /maintenance/home should return 204, not %d.", recorder.Code)
+	}
+	if _, found := maintenances.Stored["home"]; found {
+		t.Errorf("DELETE /maintenance/home should end maintenance window.")
+	}
+}
+
+func TestWriteEndpointsRequireToken(t *testing.T) {
+
+	acknowledgements := FakeAcknowledgements{Stored: map[string]events.Acknowledgement{}}
+	maintenances := FakeMaintenances{Stored: map[string]events.Maintenance{}}
+	readOnly := Server{Status: FakeStatus{Info: testInfo(), LastSuccess: time.Now()}, Redis: FakePinger{}, Acknowledgements: &acknowledgements, Maintenances: &maintenances}
+	if recorder := post(t, readOnly, "/acknowledge/home", `{"by": "alice"}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("POST /acknowledge/home should return 404 without write token, not %d.", recorder.Code)
+	}
+	if recorder := post(t, readOnly, "/maintenance/home", `{"by": "alice", "duration": "1h"}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("POST /maintenance/home should return 404 without write token, not %d.", recorder.Code)
+	}
+	if recorder := get(t, readOnly, "/maintenance"); recorder.Code != http.StatusOK {
+		t.Errorf("GET /maintenance should be served without write token, it returned %d.", recorder.Code)
+	}
+
+	server := readOnly
+	server.WriteToken = testToken
+	for _, token := range []string{"", "wrong"} {
+		if recorder := send(t, server, http.MethodPost, "/acknowledge/home", token, `{"by": "alice"}`); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("POST /acknowledge/home with token '%s' should return 401, not %d.", token, recorder.Code)
+		}
+		if recorder := send(t, server, http.MethodDelete, "/maintenance/home", token, ""); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("DELETE /maintenance/home with token '%s' should return 401, not %d.", token, recorder.Code)
+		}
+	}
+	if len(acknowledgements.Stored) != 0 || len(maintenances.Stored) != 0 {
+		t.Errorf("Unauthorized requests should not change state.")
+	}
+}
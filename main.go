@@ -2,198 +2,87 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"log"
 	"log/syslog"
-	"net"
 	"net/http"
-	"net/mail"
-	"net/smtp"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	commands "github.com/a-castellano/AlarmStatusWatcher/commands"
 	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	httpapi "github.com/a-castellano/AlarmStatusWatcher/httpapi"
+	metrics "github.com/a-castellano/AlarmStatusWatcher/metrics"
+	monitor "github.com/a-castellano/AlarmStatusWatcher/monitor"
+	notifier "github.com/a-castellano/AlarmStatusWatcher/notifier"
 	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
 	goredis "github.com/go-redis/redis/v8"
-	"github.com/streadway/amqp"
 )
 
-func sendMessageByQueue(rabbitmqConfig config_reader.RabbitmqConfig, messageToSend string) error {
-
-	dialString := fmt.Sprintf("amqp://%s:%s@%s:%d/", rabbitmqConfig.User, rabbitmqConfig.Password, rabbitmqConfig.Host, rabbitmqConfig.Port)
-
-	conn, errDial := amqp.Dial(dialString)
-	defer conn.Close()
-
-	if errDial != nil {
-		return errDial
-	}
-
-	channel, errChannel := conn.Channel()
-	defer channel.Close()
-	if errChannel != nil {
-		return errChannel
-	}
-
-	queue, errQueue := channel.QueueDeclare(
-		rabbitmqConfig.QueueName, // name
-		true,                     // durable
-		false,                    // delete when unused
-		false,                    // exclusive
-		false,                    // no-wait
-		nil,                      // arguments
-	)
-	if errQueue != nil {
-		return errQueue
-	}
-
-	// send Job
-
-	err := channel.Publish(
-		"",         // exchange
-		queue.Name, // routing key
-		false,      // mandatory
-		false,
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "text/plain",
-			Body:         []byte(messageToSend),
-		})
-
-	if err != nil {
-		return err
-	}
-	return nil
-
-}
-
-func sendEmail(config config_reader.Config, messageToSend string) {
-
-	fromMail := fmt.Sprintf("%s@%s", config.MailServer.MailFrom, config.MailServer.MailDomain)
-	from := mail.Address{"", fromMail}
-	to := mail.Address{"", config.MailServer.Destination}
-	subj := "Alarm Status Changed"
-
-	// Setup headers
-	headers := make(map[string]string)
-	headers["From"] = from.String()
-	headers["To"] = to.String()
-	headers["Subject"] = subj
-
-	// Setup message
-	var message string
-	for k, v := range headers {
-		message += fmt.Sprintf("%s: %s\r\n", k, v)
-	}
-	message += "\r\n" + messageToSend
-
-	// Connect to the SMTP Server
-	servername := fmt.Sprintf("%s:%d", config.MailServer.SMTPHost, config.MailServer.SMTPPort)
-
-	host, _, _ := net.SplitHostPort(servername)
-
-	auth := smtp.PlainAuth("", config.MailServer.SMTPName, config.MailServer.SMTPPassword, host)
-
-	// TLS config
-	tlsconfig := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         host,
-	}
-
-	// Here is the key, you need to call tls.Dial instead of smtp.Dial
-	// for smtp servers running on 465 that require an ssl connection
-	// from the very beginning (no starttls)
-	conn, err := tls.Dial("tcp", servername, tlsconfig)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	c, err := smtp.NewClient(conn, host)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	// Auth
-	if err = c.Auth(auth); err != nil {
-		log.Panic(err)
-	}
-
-	// To && From
-	if err = c.Mail(from.Address); err != nil {
-		log.Panic(err)
-	}
-
-	if err = c.Rcpt(to.Address); err != nil {
-		log.Panic(err)
+func buildNotifierRegistry(config config_reader.Config) (*notifier.Registry, error) {
+	registry := notifier.NewRegistry()
+	if config.MailServer.Enabled {
+		mailNotifier, mailErr := notifier.NewMailNotifier(config.MailServer)
+		if mailErr != nil {
+			return registry, mailErr
+		}
+		var mailChannel notifier.Notifier = mailNotifier
+		if config.MailServer.Digest.Enabled {
+			mailChannel = notifier.NewDigestNotifier(mailNotifier)
+		}
+		if registerErr := registry.Register(mailChannel); registerErr != nil {
+			return registry, registerErr
+		}
 	}
-
-	// Data
-	w, err := c.Data()
-	if err != nil {
-		log.Panic(err)
+	if config.RabbitmqConfig.Enabled {
+		queueNotifier, queueErr := notifier.NewQueueNotifier(config.RabbitmqConfig)
+		if queueErr != nil {
+			return registry, queueErr
+		}
+		if registerErr := registry.Register(queueNotifier); registerErr != nil {
+			return registry, registerErr
+		}
 	}
-
-	_, err = w.Write([]byte(message))
-	if err != nil {
-		log.Panic(err)
+	if config.Webhook.Enabled {
+		webhookNotifier, webhookErr := notifier.NewWebhookNotifier(config.Webhook)
+		if webhookErr != nil {
+			return registry, webhookErr
+		}
+		if registerErr := registry.Register(webhookNotifier); registerErr != nil {
+			return registry, registerErr
+		}
 	}
-
-	err = w.Close()
-	if err != nil {
-		log.Panic(err)
+	if config.MQTT.Enabled {
+		mqttNotifier, mqttErr := notifier.NewMQTTNotifier(config.MQTT)
+		if mqttErr != nil {
+			return registry, mqttErr
+		}
+		if registerErr := registry.Register(mqttNotifier); registerErr != nil {
+			return registry, registerErr
+		}
 	}
-
-	c.Quit()
-	log.Println("Mail sent successfully")
-}
-
-func checkStatus(ctx context.Context, config config_reader.Config, storageInstance storage.Storage, alarmManagerRequester apiwatcher.Requester) {
-
-	watcher := apiwatcher.APIWatcher{Host: config.AlarmManager.Host, Port: config.AlarmManager.Port}
-
-	for range time.Tick(time.Second * 1) {
-		log.Println("Checking api status.")
-		apiInfo, apiInfoErr := watcher.ShowInfo(alarmManagerRequester)
-		if apiInfoErr != nil {
-
-			log.Fatal(apiInfoErr)
-			return
+	if config.Telegram.Enabled {
+		if registerErr := registry.Register(notifier.NewTelegramNotifier(config.Telegram)); registerErr != nil {
+			return registry, registerErr
 		}
-		newStatusMap, changedStatusMap, modeChangedMap, onlineChangedMap, checkAndUpdateErr := storageInstance.CheckAndUpdate(ctx, apiInfo.DevicesInfo)
-		if checkAndUpdateErr != nil {
-			log.Fatal(checkAndUpdateErr)
-			return
+	}
+	if config.Slack.Enabled {
+		if registerErr := registry.Register(notifier.NewSlackNotifier(config.Slack)); registerErr != nil {
+			return registry, registerErr
 		}
-		apiInfo.DevicesInfo = newStatusMap
-		for deviceID, message := range changedStatusMap {
-			if len(message) > 0 {
-				notificationMessage := fmt.Sprintf("%s - %s", apiInfo.DevicesInfo[deviceID].Name, message)
-				if config.NotifyConfig.SendEmailNotification {
-					if (config.NotifyConfig.NotifyOffline == true && onlineChangedMap[deviceID] == true) || (config.NotifyConfig.NotifyStatusChange == true && modeChangedMap[deviceID] == true) {
-						sendEmail(config, notificationMessage)
-					}
-				}
-				if config.NotifyConfig.SendQueueNotification {
-					if (config.NotifyConfig.NotifyOffline == true && onlineChangedMap[deviceID] == true) || (config.NotifyConfig.NotifyStatusChange == true && modeChangedMap[deviceID] == true) {
-						sendError := sendMessageByQueue(config.RabbitmqConfig, notificationMessage)
-						if sendError != nil {
-							log.Fatal(sendError)
-						}
-					}
-				}
-			}
-
+	}
+	if config.Matrix.Enabled {
+		if registerErr := registry.Register(notifier.NewMatrixNotifier(config.Matrix)); registerErr != nil {
+			return registry, registerErr
 		}
 	}
+	return registry, nil
 }
 
 func main() {
-	client := http.Client{
-		Timeout: time.Second * 5, // Maximum of 5 secs
-	}
-
-	alarmManagerRequester := apiwatcher.Requester{Client: client}
 	logwriter, e := syslog.New(syslog.LOG_NOTICE, "AlarmStatusWatcher")
 	if e == nil {
 		log.SetOutput(logwriter)
@@ -206,6 +95,20 @@ func main() {
 		return
 	}
 
+	client := http.Client{
+		Timeout: config.AlarmManager.RequestTimeout,
+	}
+
+	alarmManagerRequester := apiwatcher.Requester{Client: client}
+
+	registry, registryErr := buildNotifierRegistry(config)
+	if registryErr != nil {
+		log.Fatal(registryErr)
+		return
+	}
+	watcherMetrics := metrics.New()
+	registry.Metrics = watcherMetrics
+
 	redisAddress := fmt.Sprintf("%s:%d", config.RedisServer.IP, config.RedisServer.Port)
 
 	redisClient := goredis.NewClient(&goredis.Options{
@@ -214,14 +117,77 @@ func main() {
 		DB:       config.RedisServer.Database,
 	})
 
-	ctx := context.Background()
+	// Root context is cancelled on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	redisErr := redisClient.Set(ctx, "checkKey", "key", 1000000).Err()
 	if redisErr != nil {
 		panic(redisErr)
 	}
-	storageInstance := storage.Storage{RedisClient: redisClient}
+	storageInstance := storage.Storage{RedisClient: redisClient, UnavailableThreshold: config.AlarmManager.UnavailableThreshold, Metrics: watcherMetrics}
+	if config.History.Enabled {
+		storageInstance.HistoryRetention = time.Duration(config.History.Retention) * time.Hour
+	}
+
+	statusMonitor := monitor.New(config, storageInstance, alarmManagerRequester, registry)
+	statusMonitor.Metrics = watcherMetrics
+	statusMonitor.Watcher.Metrics = watcherMetrics
+
+	var httpServer *http.Server
+	if config.HTTPServer.Enabled {
+		statusServer := httpapi.Server{Status: statusMonitor, Redis: storageInstance, MaxPollAge: time.Duration(config.HTTPServer.MaxPollAge) * time.Second, Metrics: watcherMetrics.Handler(), Acknowledgements: storageInstance, Maintenances: storageInstance}
+		if storageInstance.HistoryEnabled() {
+			statusServer.History = storageInstance
+		}
+		if config.HTTPServer.Write {
+			statusServer.WriteToken = config.HTTPServer.Token
+		}
+		httpServer = &http.Server{Addr: fmt.Sprintf("%s:%d", config.HTTPServer.Host, config.HTTPServer.Port), Handler: statusServer.Handler()}
+		go func() {
+			if serveErr := httpServer.ListenAndServe(); serveErr != nil && serveErr != http.ErrServerClosed {
+				log.Fatal(serveErr)
+			}
+		}()
+	}
 
-	checkStatus(ctx, config, storageInstance, alarmManagerRequester)
+	consumerDone := make(chan struct{})
+	if config.RabbitmqConfig.Enabled && config.RabbitmqConfig.CommandQueue != "" {
+		consumer, consumerErr := commands.NewConsumer(config.RabbitmqConfig, storageInstance)
+		if consumerErr != nil {
+			log.Fatal(consumerErr)
+			return
+		}
+		go func() {
+			consumer.Run(ctx)
+			close(consumerDone)
+		}()
+	} else {
+		close(consumerDone)
+	}
+
+	runErr := statusMonitor.Run(ctx)
+	stop()
+	<-consumerDone
+	log.Println("Shutting down.")
+
+	// Close connections in order, HTTP server first so no request uses closed backends
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if httpServer != nil {
+		if shutdownErr := httpServer.Shutdown(shutdownCtx); shutdownErr != nil {
+			log.Println(shutdownErr)
+		}
+	}
+	if closeErr := registry.Close(); closeErr != nil {
+		log.Println(closeErr)
+	}
+	if closeErr := redisClient.Close(); closeErr != nil {
+		log.Println(closeErr)
+	}
 
+	if runErr != nil {
+		log.Println(runErr)
+		os.Exit(1)
+	}
 }
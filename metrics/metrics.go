@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "alarmstatuswatcher"
+
+// Metrics holds every collector exposed by the watcher. All methods can be
+// called on a nil *Metrics, so metrics are optional for every component.
+type Metrics struct {
+	registry *prometheus.Registry
+	mutex    sync.Mutex
+
+	pollDuration        prometheus.Histogram
+	pollErrors          *prometheus.CounterVec
+	deviceOnline        *prometheus.GaugeVec
+	deviceFiring        *prometheus.GaugeVec
+	deviceMode          *prometheus.GaugeVec
+	notificationsSent   *prometheus.CounterVec
+	notificationsFailed *prometheus.CounterVec
+	redisDuration       *prometheus.HistogramVec
+	lastSuccessfulPoll  prometheus.Gauge
+}
+
+// Device is the state exported for each device
+type Device struct {
+	ID     string
+	Name   string
+	Mode   string
+	Online bool
+	Firing bool
+}
+
+// New creates the collectors and registers them in a dedicated registry
+func New() *Metrics {
+	metrics := &Metrics{registry: prometheus.NewRegistry()}
+
+	metrics.pollDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "poll_duration_seconds",
+		Help:      "Duration of AlarmManager polls.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metrics.pollErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "poll_errors_total",
+		Help:      "Poll errors by type.",
+	}, []string{"type"})
+	metrics.deviceOnline = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_online",
+		Help:      "Whether device is online.",
+	}, []string{"device", "name"})
+	metrics.deviceFiring = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_firing",
+		Help:      "Whether device is firing.",
+	}, []string{"device", "name"})
+	metrics.deviceMode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_mode",
+		Help:      "Current device mode, set to 1 for the active mode.",
+	}, []string{"device", "name", "mode"})
+	metrics.notificationsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_sent_total",
+		Help:      "Notifications sent by channel.",
+	}, []string{"channel"})
+	metrics.notificationsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_failed_total",
+		Help:      "Notifications that could not be sent by channel.",
+	}, []string{"channel"})
+	metrics.redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_operation_duration_seconds",
+		Help:      "Duration of Redis operations.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+	metrics.lastSuccessfulPoll = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_poll_timestamp_seconds",
+		Help:      "Unix time of the last successful AlarmManager poll.",
+	})
+
+	metrics.registry.MustRegister(
+		metrics.pollDuration,
+		metrics.pollErrors,
+		metrics.deviceOnline,
+		metrics.deviceFiring,
+		metrics.deviceMode,
+		metrics.notificationsSent,
+		metrics.notificationsFailed,
+		metrics.redisDuration,
+		metrics.lastSuccessfulPoll,
+	)
+	return metrics
+}
+
+// Handler returns the HTTP handler exposing metrics in Prometheus text format
+func (metrics *Metrics) Handler() http.Handler {
+	if metrics == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+// Registry returns the underlying Prometheus registry
+func (metrics *Metrics) Registry() *prometheus.Registry {
+	if metrics == nil {
+		return nil
+	}
+	return metrics.registry
+}
+
+// ObservePoll records a poll duration
+func (metrics *Metrics) ObservePoll(duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.pollDuration.Observe(duration.Seconds())
+}
+
+// PollError counts a poll error of the given type
+func (metrics *Metrics) PollError(errorType string) {
+	if metrics == nil {
+		return
+	}
+	metrics.pollErrors.WithLabelValues(errorType).Inc()
+}
+
+// PollSucceeded stores the time of a successful poll
+func (metrics *Metrics) PollSucceeded(at time.Time) {
+	if metrics == nil {
+		return
+	}
+	metrics.lastSuccessfulPoll.Set(float64(at.Unix()))
+}
+
+// SetDevices replaces exported devices state, devices not present anymore are removed
+func (metrics *Metrics) SetDevices(devices []Device) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.deviceOnline.Reset()
+	metrics.deviceFiring.Reset()
+	metrics.deviceMode.Reset()
+	for _, device := range devices {
+		metrics.deviceOnline.WithLabelValues(device.ID, device.Name).Set(boolToFloat(device.Online))
+		metrics.deviceFiring.WithLabelValues(device.ID, device.Name).Set(boolToFloat(device.Firing))
+		metrics.deviceMode.WithLabelValues(device.ID, device.Name, device.Mode).Set(1)
+	}
+}
+
+// NotificationSent counts a notification sent or failed through channel
+func (metrics *Metrics) NotificationSent(channel string, err error) {
+	if metrics == nil {
+		return
+	}
+	if err != nil {
+		metrics.notificationsFailed.WithLabelValues(channel).Inc()
+		return
+	}
+	metrics.notificationsSent.WithLabelValues(channel).Inc()
+}
+
+// ObserveRedis records how long a Redis operation took since start
+func (metrics *Metrics) ObserveRedis(operation string, start time.Time) {
+	if metrics == nil {
+		return
+	}
+	metrics.redisDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
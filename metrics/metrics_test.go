@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, metrics *Metrics) string {
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Scraping metrics should return 200, not %d.", recorder.Code)
+	}
+	return recorder.Body.String()
+}
+
+func TestNilMetricsAreIgnored(t *testing.T) {
+
+	var metrics *Metrics
+	metrics.ObservePoll(time.Second)
+	metrics.PollError("request")
+	metrics.PollSucceeded(time.Now())
+	metrics.SetDevices([]Device{{ID: "ab123"}})
+	metrics.NotificationSent("mail", nil)
+	metrics.ObserveRedis("hset", time.Now())
+	if metrics.Registry() != nil {
+		t.Errorf("Nil metrics should not have registry.")
+	}
+}
+
+func TestExposedMetrics(t *testing.T) {
+
+	metrics := New()
+	metrics.ObservePoll(time.Millisecond * 30)
+	metrics.PollError("device")
+	metrics.PollError("device")
+	metrics.PollSucceeded(time.Unix(1655150000, 0))
+	metrics.NotificationSent("mail", nil)
+	metrics.NotificationSent("queue", errors.New("closed"))
+	metrics.ObserveRedis("hgetall", time.Now())
+	metrics.SetDevices([]Device{{ID: "ab123", Name: "Home Alarm", Mode: "armed", Online: true, Firing: true}})
+
+	output := scrape(t, metrics)
+	expected := []string{
+		`alarmstatuswatcher_poll_duration_seconds_count 1`,
+		`alarmstatuswatcher_poll_errors_total{type="device"} 2`,
+		`alarmstatuswatcher_last_successful_poll_timestamp_seconds 1.65515e+09`,
+		`alarmstatuswatcher_notifications_sent_total{channel="mail"} 1`,
+		`alarmstatuswatcher_notifications_failed_total{channel="queue"} 1`,
+		`alarmstatuswatcher_redis_operation_duration_seconds_count{operation="hgetall"} 1`,
+		`alarmstatuswatcher_device_online{device="ab123",name="Home Alarm"} 1`,
+		`alarmstatuswatcher_device_firing{device="ab123",name="Home Alarm"} 1`,
+		`alarmstatuswatcher_device_mode{device="ab123",mode="armed",name="Home Alarm"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("Metrics output should contain '%s'.", line)
+		}
+	}
+}
+
+func TestSetDevicesRemovesOldDevices(t *testing.T) {
+
+	metrics := New()
+	metrics.SetDevices([]Device{{ID: "ab123", Name: "Home Alarm", Mode: "armed", Online: true}})
+	metrics.SetDevices([]Device{{ID: "cd456", Name: "Garage", Mode: "disarmed", Online: false}})
+
+	output := scrape(t, metrics)
+	if strings.Contains(output, `device="ab123"`) {
+		t.Errorf("Removed device should not be exported anymore.")
+	}
+	if !strings.Contains(output, `alarmstatuswatcher_device_mode{device="cd456",mode="disarmed",name="Garage"} 1`) {
+		t.Errorf("New device mode should be exported.")
+	}
+}
@@ -0,0 +1,30 @@
+package monitor
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponential wait times between failed polls
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	// Jitter is the fraction of the wait time that is randomized, 0 disables it
+	Jitter float64
+}
+
+// Next returns how long to wait after the given number of consecutive failures
+func (backoff Backoff) Next(failures int) time.Duration {
+	wait := backoff.Initial
+	for i := 1; i < failures && wait < backoff.Max; i++ {
+		wait = wait * 2
+	}
+	if wait > backoff.Max {
+		wait = backoff.Max
+	}
+	if backoff.Jitter > 0 {
+		jitter := time.Duration(rand.Float64() * backoff.Jitter * float64(wait))
+		wait = wait - jitter
+	}
+	return wait
+}
@@ -0,0 +1,28 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowsExponentially(t *testing.T) {
+
+	backoff := Backoff{Initial: time.Second, Max: time.Second * 10}
+	expected := []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 10, time.Second * 10}
+	for index, wait := range expected {
+		if backoff.Next(index+1) != wait {
+			t.Errorf("Wait after %d failures should be %s, not %s.", index+1, wait, backoff.Next(index+1))
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+
+	backoff := Backoff{Initial: time.Second, Max: time.Second * 10, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		wait := backoff.Next(3)
+		if wait > time.Second*4 || wait < time.Second*2 {
+			t.Fatalf("Wait with jitter should be between 2s and 4s, not %s.", wait)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package monitor
+
+import "time"
+
+// Timer is the subset of time.Timer used by Monitor
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Clock provides time to Monitor so tests can control it
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (timer realTimer) C() <-chan time.Time {
+	return timer.timer.C
+}
+
+func (timer realTimer) Stop() bool {
+	return timer.timer.Stop()
+}
+
+// RealClock is the Clock backed by time package
+type RealClock struct{}
+
+// Now returns current time
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer returns a timer firing after d
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{timer: time.NewTimer(d)}
+}
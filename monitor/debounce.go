@@ -0,0 +1,206 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+)
+
+// DebounceStore persists debounce state so it survives restarts
+type DebounceStore interface {
+	SaveDebounceState(ctx context.Context, state storage.DebounceState) error
+	DebounceStates(ctx context.Context) (map[string]storage.DebounceState, error)
+}
+
+// Debouncer confirms online transitions once they have held for HoldPolls
+// polls or HoldTime and detects flapping devices. While a device is
+// flapping its online changes are held until it settles. State is kept in
+// Store when set, so pending transitions and flapping devices survive
+// restarts.
+type Debouncer struct {
+	HoldPolls     int
+	HoldTime      time.Duration
+	FlapThreshold int
+	FlapWindow    time.Duration
+	Store         DebounceStore
+
+	mutex   sync.Mutex
+	loaded  bool
+	devices map[string]*debounceState
+}
+
+type debounceState struct {
+	// last is the last observed value, confirmed the value that held long
+	// enough and notified the value users were told about
+	last      string
+	confirmed string
+	notified  string
+
+	candidate      string
+	candidateSince time.Time
+	candidatePolls int
+
+	transitions []time.Time
+	flapping    bool
+}
+
+// NewDebouncer returns a Debouncer configured from config keeping its state in store
+func NewDebouncer(config config_reader.Debounce, store DebounceStore) *Debouncer {
+	return &Debouncer{HoldPolls: config.HoldPolls, HoldTime: config.HoldTime, FlapThreshold: config.FlapThreshold, FlapWindow: config.FlapWindow, Store: store, devices: make(map[string]*debounceState)}
+}
+
+func (debouncer *Debouncer) enabled() bool {
+	return debouncer != nil && (debouncer.HoldPolls > 0 || debouncer.HoldTime > 0 || debouncer.FlapThreshold > 0)
+}
+
+// Filter replaces raw online changes with confirmed and flapping ones,
+// other changes are returned untouched. Failing to load or save state is
+// returned along with filtered changes, state is kept in memory meanwhile.
+func (debouncer *Debouncer) Filter(ctx context.Context, apiInfo apiwatcher.APIInfo, changes []events.ChangeEvent, now time.Time) ([]events.ChangeEvent, error) {
+	if !debouncer.enabled() {
+		return changes, nil
+	}
+	onlineChanges := make(map[string]events.ChangeEvent)
+	filtered := make([]events.ChangeEvent, 0, len(changes))
+	for _, change := range changes {
+		if change.Field == events.FieldOnline {
+			onlineChanges[change.DeviceID] = change
+		} else {
+			filtered = append(filtered, change)
+		}
+	}
+
+	deviceIDs := make([]string, 0, len(apiInfo.DevicesInfo))
+	for deviceID := range apiInfo.DevicesInfo {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+	if debouncer.devices == nil {
+		debouncer.devices = make(map[string]*debounceState)
+	}
+	var failures []string
+	if loadErr := debouncer.load(ctx); loadErr != nil {
+		failures = append(failures, "Failed to load debounce state: "+loadErr.Error())
+	}
+	for _, deviceID := range deviceIDs {
+		// Only fresh values count as polls
+		if apiInfo.Status(deviceID).State != apiwatcher.FetchOK {
+			continue
+		}
+		deviceInfo := apiInfo.DevicesInfo[deviceID]
+		onlineChange, changed := onlineChanges[deviceID]
+		filtered = append(filtered, debouncer.observe(deviceID, deviceInfo.Name, strconv.FormatBool(deviceInfo.Online), onlineChange, changed, now)...)
+		if debouncer.Store == nil {
+			continue
+		}
+		if saveErr := debouncer.Store.SaveDebounceState(ctx, debouncer.devices[deviceID].stored(deviceID)); saveErr != nil {
+			failures = append(failures, "Failed to save device "+deviceID+" debounce state: "+saveErr.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return filtered, errors.New(strings.Join(failures, "; "))
+	}
+	return filtered, nil
+}
+
+// load reads stored state once, devices already observed keep their state
+func (debouncer *Debouncer) load(ctx context.Context) error {
+	if debouncer.loaded || debouncer.Store == nil {
+		return nil
+	}
+	states, statesErr := debouncer.Store.DebounceStates(ctx)
+	if statesErr != nil {
+		return statesErr
+	}
+	for deviceID, state := range states {
+		if _, known := debouncer.devices[deviceID]; !known {
+			debouncer.devices[deviceID] = &debounceState{last: state.Last, confirmed: state.Confirmed, notified: state.Notified, candidate: state.Candidate, candidateSince: state.CandidateSince, candidatePolls: state.CandidatePolls, transitions: state.Transitions, flapping: state.Flapping}
+		}
+	}
+	debouncer.loaded = true
+	return nil
+}
+
+// stored returns state as kept in DebounceStore
+func (state *debounceState) stored(deviceID string) storage.DebounceState {
+	return storage.DebounceState{DeviceID: deviceID, Last: state.last, Confirmed: state.confirmed, Notified: state.notified, Candidate: state.candidate, CandidateSince: state.candidateSince, CandidatePolls: state.candidatePolls, Transitions: append([]time.Time(nil), state.transitions...), Flapping: state.flapping}
+}
+
+func (debouncer *Debouncer) observe(deviceID string, deviceName string, value string, onlineChange events.ChangeEvent, changed bool, now time.Time) []events.ChangeEvent {
+	state, known := debouncer.devices[deviceID]
+	if !known {
+		baseline := value
+		if changed {
+			baseline = onlineChange.OldValue
+		}
+		state = &debounceState{last: baseline, confirmed: baseline, notified: baseline}
+		debouncer.devices[deviceID] = state
+	}
+
+	var confirmedChanges []events.ChangeEvent
+	if value != state.last {
+		state.last = value
+		state.transitions = append(state.transitions, now)
+	}
+	cutoff := now.Add(-debouncer.FlapWindow)
+	for len(state.transitions) > 0 && !state.transitions[0].After(cutoff) {
+		state.transitions = state.transitions[1:]
+	}
+	if debouncer.FlapThreshold > 0 && !state.flapping && len(state.transitions) >= debouncer.FlapThreshold {
+		state.flapping = true
+		confirmedChanges = append(confirmedChanges, events.New(deviceID, deviceName, events.FieldFlapping, "false", "true", now))
+	}
+
+	if value == state.confirmed {
+		state.candidate = ""
+		state.candidatePolls = 0
+	} else {
+		if state.candidate != value {
+			state.candidate = value
+			state.candidateSince = now
+			state.candidatePolls = 0
+		}
+		state.candidatePolls++
+		if debouncer.held(state, now) {
+			state.confirmed = value
+			state.candidate = ""
+			state.candidatePolls = 0
+		}
+	}
+
+	if state.flapping {
+		// Device settles once a whole window passes without transitions
+		if len(state.transitions) > 0 {
+			return confirmedChanges
+		}
+		state.flapping = false
+		confirmedChanges = append(confirmedChanges, events.New(deviceID, deviceName, events.FieldFlapping, "true", "false", now))
+	}
+	if state.confirmed != state.notified {
+		confirmedChanges = append(confirmedChanges, events.New(deviceID, deviceName, events.FieldOnline, state.notified, state.confirmed, now))
+		state.notified = state.confirmed
+	}
+	return confirmedChanges
+}
+
+func (debouncer *Debouncer) held(state *debounceState, now time.Time) bool {
+	if debouncer.HoldPolls == 0 && debouncer.HoldTime == 0 {
+		return true
+	}
+	if debouncer.HoldPolls > 0 && state.candidatePolls >= debouncer.HoldPolls {
+		return true
+	}
+	return debouncer.HoldTime > 0 && now.Sub(state.candidateSince) >= debouncer.HoldTime
+}
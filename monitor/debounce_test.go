@@ -0,0 +1,148 @@
+package monitor
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+)
+
+type FakeDebounceStore struct {
+	states map[string]storage.DebounceState
+}
+
+func (store *FakeDebounceStore) SaveDebounceState(ctx context.Context, state storage.DebounceState) error {
+	store.states[state.DeviceID] = state
+	return nil
+}
+
+func (store *FakeDebounceStore) DebounceStates(ctx context.Context) (map[string]storage.DebounceState, error) {
+	states := make(map[string]storage.DebounceState, len(store.states))
+	for deviceID, state := range store.states {
+		states[deviceID] = state
+	}
+	return states, nil
+}
+
+// debouncePoll feeds debouncer with a poll where garage online status is
+// online, previous is the value of last poll
+func debouncePoll(debouncer *Debouncer, previous bool, online bool, now time.Time) []events.ChangeEvent {
+	apiInfo := apiwatcher.APIInfo{
+		DevicesInfo:   map[string]apiwatcher.DeviceInfo{"garage": {Name: "Garage", Online: online}},
+		DevicesStatus: map[string]apiwatcher.FetchStatus{"garage": {State: apiwatcher.FetchOK}},
+	}
+	var changes []events.ChangeEvent
+	if previous != online {
+		changes = append(changes, events.New("garage", "Garage", events.FieldOnline, strconv.FormatBool(previous), strconv.FormatBool(online), now))
+	}
+	filtered, _ := debouncer.Filter(context.TODO(), apiInfo, changes, now)
+	return filtered
+}
+
+func TestDebouncerDisabledKeepsChanges(t *testing.T) {
+
+	debouncer := NewDebouncer(config_reader.Debounce{FlapWindow: time.Minute}, nil)
+	now := time.Unix(1655150000, 0)
+	if changes := debouncePoll(debouncer, true, false, now); len(changes) != 1 || changes[0].Type() != events.TypeOffline {
+		t.Errorf("Disabled debouncer should keep raw changes, not %+v.", changes)
+	}
+}
+
+func TestDebouncerHoldPolls(t *testing.T) {
+
+	debouncer := NewDebouncer(config_reader.Debounce{HoldPolls: 3, FlapWindow: time.Minute}, nil)
+	now := time.Unix(1655150000, 0)
+
+	debouncePoll(debouncer, true, true, now)
+	if changes := debouncePoll(debouncer, true, false, now.Add(time.Second)); len(changes) != 0 {
+		t.Errorf("Offline change should not be confirmed after one poll, changes were %+v.", changes)
+	}
+	if changes := debouncePoll(debouncer, false, true, now.Add(time.Second*2)); len(changes) != 0 {
+		t.Errorf("Short offline blips should not be notified, changes were %+v.", changes)
+	}
+
+	debouncePoll(debouncer, true, false, now.Add(time.Second*3))
+	debouncePoll(debouncer, false, false, now.Add(time.Second*4))
+	changes := debouncePoll(debouncer, false, false, now.Add(time.Second*5))
+	if len(changes) != 1 || changes[0].Type() != events.TypeOffline || changes[0].OldValue != "true" {
+		t.Errorf("Offline change should be confirmed after 3 polls, changes were %+v.", changes)
+	}
+	if changes := debouncePoll(debouncer, false, false, now.Add(time.Second*6)); len(changes) != 0 {
+		t.Errorf("Confirmed change should be notified once, changes were %+v.", changes)
+	}
+}
+
+func TestDebouncerHoldTime(t *testing.T) {
+
+	debouncer := NewDebouncer(config_reader.Debounce{HoldTime: time.Second * 10, FlapWindow: time.Minute}, nil)
+	now := time.Unix(1655150000, 0)
+
+	// First poll already reports a stored change
+	if changes := debouncePoll(debouncer, true, false, now); len(changes) != 0 {
+		t.Errorf("Offline change should not be confirmed before hold time, changes were %+v.", changes)
+	}
+	if changes := debouncePoll(debouncer, false, false, now.Add(time.Second*5)); len(changes) != 0 {
+		t.Errorf("Offline change should not be confirmed before hold time, changes were %+v.", changes)
+	}
+	if changes := debouncePoll(debouncer, false, false, now.Add(time.Second*10)); len(changes) != 1 || changes[0].Type() != events.TypeOffline {
+		t.Errorf("Offline change should be confirmed once hold time passes, changes were %+v.", changes)
+	}
+}
+
+func TestDebouncerFlapping(t *testing.T) {
+
+	debouncer := NewDebouncer(config_reader.Debounce{FlapThreshold: 3, FlapWindow: time.Minute}, nil)
+	now := time.Unix(1655150000, 0)
+
+	debouncePoll(debouncer, true, true, now)
+	if changes := debouncePoll(debouncer, true, false, now.Add(time.Second)); len(changes) != 1 || changes[0].Type() != events.TypeOffline {
+		t.Errorf("First transition should be notified, changes were %+v.", changes)
+	}
+	if changes := debouncePoll(debouncer, false, true, now.Add(time.Second*2)); len(changes) != 1 || changes[0].Type() != events.TypeOnline {
+		t.Errorf("Second transition should be notified, changes were %+v.", changes)
+	}
+	changes := debouncePoll(debouncer, true, false, now.Add(time.Second*3))
+	if len(changes) != 1 || changes[0].Type() != events.TypeFlapping {
+		t.Errorf("Third transition should only report flapping, changes were %+v.", changes)
+	}
+	if changes := debouncePoll(debouncer, false, true, now.Add(time.Second*4)); len(changes) != 0 {
+		t.Errorf("Changes should be held while device is flapping, changes were %+v.", changes)
+	}
+	if changes := debouncePoll(debouncer, true, false, now.Add(time.Second*5)); len(changes) != 0 {
+		t.Errorf("Changes should be held while device is flapping, changes were %+v.", changes)
+	}
+	if changes := debouncePoll(debouncer, false, false, now.Add(time.Second*30)); len(changes) != 0 {
+		t.Errorf("Device should keep flapping until a window passes without transitions, changes were %+v.", changes)
+	}
+
+	changes = debouncePoll(debouncer, false, false, now.Add(time.Second*66))
+	if len(changes) != 2 || changes[0].Type() != events.TypeSettled || changes[1].Type() != events.TypeOffline {
+		t.Errorf("Settled device should report settled and its final status, changes were %+v.", changes)
+	}
+}
+
+func TestDebouncerStateSurvivesRestart(t *testing.T) {
+
+	store := &FakeDebounceStore{states: map[string]storage.DebounceState{}}
+	config := config_reader.Debounce{HoldPolls: 3, FlapThreshold: 3, FlapWindow: time.Minute}
+	now := time.Unix(1655150000, 0)
+
+	debouncer := NewDebouncer(config, store)
+	debouncePoll(debouncer, true, true, now)
+	debouncePoll(debouncer, true, false, now.Add(time.Second))
+	debouncePoll(debouncer, false, false, now.Add(time.Second*2))
+
+	restarted := NewDebouncer(config, store)
+	changes := debouncePoll(restarted, false, false, now.Add(time.Second*3))
+	if len(changes) != 1 || changes[0].Type() != events.TypeOffline || changes[0].OldValue != "true" {
+		t.Errorf("Offline change held before restart should be confirmed after 3 polls, changes were %+v.", changes)
+	}
+	if state := store.states["garage"]; state.Notified != "false" || len(state.Transitions) != 1 {
+		t.Errorf("Debounce state should be stored after each poll, state was %+v.", state)
+	}
+}
@@ -0,0 +1,131 @@
+package monitor
+
+import (
+	"context"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	notifier "github.com/a-castellano/AlarmStatusWatcher/notifier"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+)
+
+// EscalationStore persists escalation state so it survives restarts
+type EscalationStore interface {
+	StartEscalation(ctx context.Context, deviceID string, started time.Time) error
+	SaveEscalation(ctx context.Context, escalation storage.Escalation) error
+	Escalations(ctx context.Context) ([]storage.Escalation, error)
+	StopEscalation(ctx context.Context, deviceID string) error
+}
+
+// Reminder is a firing notification to be sent through Channels, every
+// channel is used when Channels is empty
+type Reminder struct {
+	Event    notifier.Event
+	Channels []string
+}
+
+// Escalator resends firing notifications every Interval while devices keep
+// firing, reached levels add their channels and recipients
+type Escalator struct {
+	Store    EscalationStore
+	Interval time.Duration
+	Channels []string
+	Levels   []config_reader.EscalationLevel
+}
+
+// NewEscalator returns an Escalator configured from config or nil if escalation is disabled
+func NewEscalator(config config_reader.Escalation, store EscalationStore) *Escalator {
+	if !config.Enabled {
+		return nil
+	}
+	return &Escalator{Store: store, Interval: config.Interval, Channels: config.Channels, Levels: config.Levels}
+}
+
+// Process starts and stops escalations from firing changes and returns the
+// reminders due at now
+func (escalator *Escalator) Process(ctx context.Context, apiInfo apiwatcher.APIInfo, changes []events.ChangeEvent, now time.Time) ([]Reminder, error) {
+	if escalator == nil {
+		return nil, nil
+	}
+	for _, change := range changes {
+		if change.Field != events.FieldFiring {
+			continue
+		}
+		var escalationErr error
+		if change.NewValue == "true" {
+			escalationErr = escalator.Store.StartEscalation(ctx, change.DeviceID, now)
+		} else {
+			escalationErr = escalator.Store.StopEscalation(ctx, change.DeviceID)
+		}
+		if escalationErr != nil && escalationErr != storage.ErrAcknowledged {
+			return nil, escalationErr
+		}
+	}
+
+	escalations, escalationsErr := escalator.Store.Escalations(ctx)
+	if escalationsErr != nil {
+		return nil, escalationsErr
+	}
+	var reminders []Reminder
+	for _, escalation := range escalations {
+		deviceInfo, found := apiInfo.DevicesInfo[escalation.DeviceID]
+		if !found {
+			continue
+		}
+		// Firing may have stopped while the watcher was not running
+		if !deviceInfo.Firing {
+			if stopErr := escalator.Store.StopEscalation(ctx, escalation.DeviceID); stopErr != nil {
+				return reminders, stopErr
+			}
+			continue
+		}
+		if now.Sub(escalation.Notified) < escalator.Interval {
+			continue
+		}
+		escalation.Level = escalator.level(now.Sub(escalation.Started))
+		escalation.Notified = now
+		escalation.Count++
+		saveErr := escalator.Store.SaveEscalation(ctx, escalation)
+		if saveErr == storage.ErrAcknowledged {
+			// Acknowledged after escalations were read
+			continue
+		}
+		if saveErr != nil {
+			return reminders, saveErr
+		}
+		channels, recipients := escalator.targets(escalation.Level)
+		change := events.New(escalation.DeviceID, deviceInfo.Name, events.FieldFiring, "true", "true", now)
+		reminders = append(reminders, Reminder{
+			Event:    notifier.Event{DeviceID: escalation.DeviceID, DeviceName: deviceInfo.Name, Changes: []events.ChangeEvent{change}, Escalation: escalation.Level, Recipients: recipients},
+			Channels: channels,
+		})
+	}
+	return reminders, nil
+}
+
+// level returns how many levels are reached after firing for elapsed
+func (escalator *Escalator) level(elapsed time.Duration) int {
+	level := 0
+	for _, escalationLevel := range escalator.Levels {
+		if elapsed >= escalationLevel.After {
+			level++
+		}
+	}
+	return level
+}
+
+// targets returns channels and recipients of reminders at level
+func (escalator *Escalator) targets(level int) ([]string, []string) {
+	var recipients []string
+	channels := append([]string{}, escalator.Channels...)
+	for _, escalationLevel := range escalator.Levels[:level] {
+		recipients = append(recipients, escalationLevel.Recipients...)
+		// Without base channels every channel is already used
+		if len(escalator.Channels) > 0 {
+			channels = append(channels, escalationLevel.Channels...)
+		}
+	}
+	return channels, recipients
+}
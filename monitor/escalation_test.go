@@ -0,0 +1,167 @@
+package monitor
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+)
+
+type FakeEscalationStore struct {
+	escalations map[string]storage.Escalation
+	// acknowledged devices refuse escalation saves like Storage does
+	acknowledged map[string]bool
+}
+
+func (store *FakeEscalationStore) StartEscalation(ctx context.Context, deviceID string, started time.Time) error {
+	return store.SaveEscalation(ctx, storage.Escalation{DeviceID: deviceID, Started: started, Notified: started})
+}
+
+func (store *FakeEscalationStore) SaveEscalation(ctx context.Context, escalation storage.Escalation) error {
+	if store.acknowledged[escalation.DeviceID] {
+		return storage.ErrAcknowledged
+	}
+	store.escalations[escalation.DeviceID] = escalation
+	return nil
+}
+
+func (store *FakeEscalationStore) Escalations(ctx context.Context) ([]storage.Escalation, error) {
+	var escalations []storage.Escalation
+	for _, escalation := range store.escalations {
+		escalations = append(escalations, escalation)
+	}
+	sort.Slice(escalations, func(i, j int) bool { return escalations[i].DeviceID < escalations[j].DeviceID })
+	return escalations, nil
+}
+
+func (store *FakeEscalationStore) StopEscalation(ctx context.Context, deviceID string) error {
+	delete(store.escalations, deviceID)
+	return nil
+}
+
+func firingInfo(firing bool) apiwatcher.APIInfo {
+	return apiwatcher.APIInfo{
+		DevicesInfo:   map[string]apiwatcher.DeviceInfo{"house": {Name: "House", Firing: firing}},
+		DevicesStatus: map[string]apiwatcher.FetchStatus{"house": {State: apiwatcher.FetchOK}},
+	}
+}
+
+func newTestEscalator(store *FakeEscalationStore) *Escalator {
+	return NewEscalator(config_reader.Escalation{
+		Enabled:  true,
+		Interval: time.Minute * 5,
+		Channels: []string{"queue"},
+		Levels: []config_reader.EscalationLevel{
+			{After: time.Minute * 10, Channels: []string{"mail"}, Recipients: []string{"oncall@windmaker.net"}},
+			{After: time.Minute * 30, Recipients: []string{"boss@windmaker.net"}},
+		},
+	}, store)
+}
+
+func TestNewEscalatorDisabled(t *testing.T) {
+
+	escalator := NewEscalator(config_reader.Escalation{}, &FakeEscalationStore{})
+	if escalator != nil {
+		t.Errorf("Disabled escalation should not return an Escalator.")
+	}
+	if reminders, err := escalator.Process(context.Background(), firingInfo(true), nil, time.Now()); err != nil || len(reminders) != 0 {
+		t.Errorf("Nil Escalator should not send reminders.")
+	}
+}
+
+func TestEscalatorReminders(t *testing.T) {
+
+	store := &FakeEscalationStore{escalations: map[string]storage.Escalation{}}
+	escalator := newTestEscalator(store)
+	ctx := context.Background()
+	now := time.Unix(1655150000, 0)
+
+	started := []events.ChangeEvent{events.New("house", "House", events.FieldFiring, "false", "true", now)}
+	reminders, err := escalator.Process(ctx, firingInfo(true), started, now)
+	if err != nil {
+		t.Error("TestEscalatorReminders should not fail. Error was ", err.Error())
+	}
+	if len(reminders) != 0 || len(store.escalations) != 1 {
+		t.Errorf("Firing start should only start an escalation, reminders were %+v.", reminders)
+	}
+	if reminders, _ := escalator.Process(ctx, firingInfo(true), nil, now.Add(time.Minute*4)); len(reminders) != 0 {
+		t.Errorf("No reminder should be sent before interval, reminders were %+v.", reminders)
+	}
+
+	reminders, _ = escalator.Process(ctx, firingInfo(true), nil, now.Add(time.Minute*5))
+	if len(reminders) != 1 {
+		t.Fatalf("One reminder should be sent after interval, reminders were %+v.", reminders)
+	}
+	reminder := reminders[0]
+	if reminder.Event.Escalation != 0 || len(reminder.Event.Recipients) != 0 || len(reminder.Channels) != 1 || reminder.Channels[0] != "queue" {
+		t.Errorf("First reminder should use base channels only, reminder was %+v.", reminder)
+	}
+	if reminder.Event.Type() != events.TypeStillFiring || reminder.Event.DeviceName != "House" {
+		t.Errorf("Reminder should be a still firing event, event was %+v.", reminder.Event)
+	}
+
+	reminders, _ = escalator.Process(ctx, firingInfo(true), nil, now.Add(time.Minute*10))
+	if len(reminders) != 1 || reminders[0].Event.Escalation != 1 {
+		t.Fatalf("Reminder should reach first level after 10 minutes, reminders were %+v.", reminders)
+	}
+	if len(reminders[0].Channels) != 2 || reminders[0].Channels[1] != "mail" || len(reminders[0].Event.Recipients) != 1 || reminders[0].Event.Recipients[0] != "oncall@windmaker.net" {
+		t.Errorf("First level should add its channels and recipients, reminder was %+v.", reminders[0])
+	}
+
+	reminders, _ = escalator.Process(ctx, firingInfo(true), nil, now.Add(time.Minute*30))
+	if len(reminders) != 1 || reminders[0].Event.Escalation != 2 || len(reminders[0].Event.Recipients) != 2 {
+		t.Errorf("Reminder should reach second level after 30 minutes, reminders were %+v.", reminders)
+	}
+	if escalation := store.escalations["house"]; escalation.Count != 3 || escalation.Level != 2 {
+		t.Errorf("Escalation state should be stored, it was %+v.", escalation)
+	}
+
+	stopped := []events.ChangeEvent{events.New("house", "House", events.FieldFiring, "true", "false", now.Add(time.Minute*31))}
+	if reminders, _ := escalator.Process(ctx, firingInfo(false), stopped, now.Add(time.Minute*40)); len(reminders) != 0 || len(store.escalations) != 0 {
+		t.Errorf("Firing stop should end escalation, reminders were %+v.", reminders)
+	}
+}
+
+func TestEscalatorResumesStoredEscalations(t *testing.T) {
+
+	now := time.Unix(1655150000, 0)
+	store := &FakeEscalationStore{escalations: map[string]storage.Escalation{
+		"house": {DeviceID: "house", Started: now.Add(-time.Minute * 20), Notified: now.Add(-time.Minute * 5), Level: 1, Count: 3},
+	}}
+	escalator := newTestEscalator(store)
+
+	reminders, err := escalator.Process(context.Background(), firingInfo(true), nil, now)
+	if err != nil {
+		t.Error("TestEscalatorResumesStoredEscalations should not fail. Error was ", err.Error())
+	}
+	if len(reminders) != 1 || reminders[0].Event.Escalation != 1 || store.escalations["house"].Count != 4 {
+		t.Errorf("Stored escalation should continue after restart, reminders were %+v.", reminders)
+	}
+
+	// Firing stopped while watcher was not running
+	if reminders, _ := escalator.Process(context.Background(), firingInfo(false), nil, now.Add(time.Minute*5)); len(reminders) != 0 || len(store.escalations) != 0 {
+		t.Errorf("Escalations of devices not firing should be stopped, reminders were %+v.", reminders)
+	}
+}
+
+func TestEscalatorSkipsEscalationsAcknowledgedWhileProcessing(t *testing.T) {
+
+	now := time.Unix(1655150000, 0)
+	escalation := storage.Escalation{DeviceID: "house", Started: now.Add(-time.Minute * 20), Notified: now.Add(-time.Minute * 5), Level: 1, Count: 3}
+	// Escalation is still listed but device was acknowledged before it is saved
+	store := &FakeEscalationStore{escalations: map[string]storage.Escalation{"house": escalation}, acknowledged: map[string]bool{"house": true}}
+	escalator := newTestEscalator(store)
+
+	reminders, err := escalator.Process(context.Background(), firingInfo(true), nil, now)
+	if err != nil {
+		t.Error("TestEscalatorSkipsEscalationsAcknowledgedWhileProcessing should not fail. Error was ", err.Error())
+	}
+	if len(reminders) != 0 || store.escalations["house"] != escalation {
+		t.Errorf("Acknowledged escalations should not be notified nor saved, reminders were %+v.", reminders)
+	}
+}
@@ -0,0 +1,375 @@
+package monitor
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	metrics "github.com/a-castellano/AlarmStatusWatcher/metrics"
+	notifier "github.com/a-castellano/AlarmStatusWatcher/notifier"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+)
+
+// AlarmManagerID is the device ID used for AlarmManager availability notifications
+const AlarmManagerID = "alarmmanager"
+
+// Monitor polls AlarmManager, stores device status and dispatches notifications
+type Monitor struct {
+	NotifyConfig config_reader.NotifyConfig
+	Watcher      apiwatcher.APIWatcher
+	Requester    apiwatcher.AlarmManagerRequester
+	Storage      storage.Storage
+	Registry     *notifier.Registry
+	PollInterval time.Duration
+	// MaxJitter is the maximum random delay added to PollInterval
+	MaxJitter        time.Duration
+	Schedule         *Schedule
+	Debouncer        *Debouncer
+	Escalator        *Escalator
+	Suppressor       *Suppressor
+	Backoff          Backoff
+	FailureThreshold int
+	Metrics          *metrics.Metrics
+	Clock            Clock
+	// DrainTimeout is how long in-flight notifications can take once Run is cancelled
+	DrainTimeout time.Duration
+
+	failures    int
+	unreachable bool
+
+	mutex       sync.RWMutex
+	lastInfo    apiwatcher.APIInfo
+	lastSuccess time.Time
+}
+
+// New returns a Monitor configured from config
+func New(config config_reader.Config, storageInstance storage.Storage, requester apiwatcher.AlarmManagerRequester, registry *notifier.Registry) *Monitor {
+	return &Monitor{
+		NotifyConfig:     config.NotifyConfig,
+		Watcher:          apiwatcher.APIWatcher{Host: config.AlarmManager.Host, Port: config.AlarmManager.Port, Concurrency: config.AlarmManager.Concurrency, RequestTimeout: config.AlarmManager.RequestTimeout},
+		Requester:        requester,
+		Storage:          storageInstance,
+		Registry:         registry,
+		PollInterval:     config.AlarmManager.PollInterval,
+		MaxJitter:        config.AlarmManager.MaxJitter,
+		Schedule:         NewSchedule(config.AlarmManager.DevicePollIntervals),
+		Debouncer:        NewDebouncer(config.Debounce, storageInstance),
+		Escalator:        NewEscalator(config.Escalation, storageInstance),
+		Suppressor:       NewSuppressor(config.QuietHours),
+		Backoff:          Backoff{Initial: time.Second * 1, Max: time.Minute * 1, Jitter: 0.5},
+		FailureThreshold: config.AlarmManager.FailureThreshold,
+		Clock:            RealClock{},
+		DrainTimeout:     time.Second * 10,
+	}
+}
+
+// Failures returns the number of consecutive failed AlarmManager polls
+func (monitor *Monitor) Failures() int {
+	return monitor.failures
+}
+
+// Snapshot returns the last processed devices status and when AlarmManager was last polled successfully
+func (monitor *Monitor) Snapshot() (apiwatcher.APIInfo, time.Time) {
+	monitor.mutex.RLock()
+	defer monitor.mutex.RUnlock()
+	return monitor.lastInfo, monitor.lastSuccess
+}
+
+// Run polls AlarmManager until ctx is cancelled or a non recoverable error
+// happens. Once ctx is cancelled no new poll is started, notifications being
+// sent are given DrainTimeout to finish before being cancelled.
+func (monitor *Monitor) Run(ctx context.Context) error {
+	notifyCtx, cancelNotify := context.WithCancel(context.Background())
+	defer cancelNotify()
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-finished:
+			return
+		case <-ctx.Done():
+		}
+		drainTimer := monitor.Clock.NewTimer(monitor.DrainTimeout)
+		defer drainTimer.Stop()
+		select {
+		case <-finished:
+		case <-drainTimer.C():
+			log.Println("Notifications did not finish before shutdown deadline, cancelling them.")
+			cancelNotify()
+		}
+	}()
+
+	for {
+		wait, checkErr := monitor.check(ctx, notifyCtx)
+		if ctx.Err() != nil {
+			// Errors caused by cancellation are expected while shutting down
+			return nil
+		}
+		if checkErr != nil {
+			return checkErr
+		}
+		timer := monitor.Clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C():
+		}
+	}
+}
+
+// Check polls AlarmManager once and returns how long to wait before next poll.
+// AlarmManager failures are not returned, they are retried with backoff.
+func (monitor *Monitor) Check(ctx context.Context) (time.Duration, error) {
+	return monitor.check(ctx, ctx)
+}
+
+func (monitor *Monitor) check(ctx context.Context, notifyCtx context.Context) (time.Duration, error) {
+	log.Println("Checking api status.")
+	start := time.Now()
+	defer func() {
+		monitor.Metrics.ObservePoll(time.Since(start))
+	}()
+	pollTime := monitor.Clock.Now()
+	watcher := monitor.Watcher
+	watcher.Due = func(deviceID string) bool {
+		return monitor.Schedule.Due(deviceID, pollTime)
+	}
+	apiInfo, apiInfoErr := watcher.ShowInfo(ctx, monitor.Requester)
+	if apiInfoErr != nil {
+		if ctx.Err() != nil {
+			// Poll was interrupted by shutdown, it is not an AlarmManager failure
+			return monitor.nextPoll(), nil
+		}
+		monitor.failures++
+		log.Printf("AlarmManager request failed, %d consecutive failures: %s", monitor.failures, apiInfoErr.Error())
+		if monitor.failures == monitor.FailureThreshold {
+			monitor.unreachable = true
+			monitor.notifyReachability(notifyCtx, false)
+		}
+		return monitor.Backoff.Next(monitor.failures), nil
+	}
+	if monitor.unreachable {
+		monitor.unreachable = false
+		monitor.notifyReachability(notifyCtx, true)
+	}
+	monitor.failures = 0
+	for deviceID, fetchStatus := range apiInfo.DevicesStatus {
+		if fetchStatus.State == apiwatcher.FetchError {
+			log.Printf("Failed to retrieve device %s status: %s", deviceID, fetchStatus.Message)
+		}
+	}
+
+	monitor.Schedule.Polled(apiInfo, pollTime)
+
+	apiInfo, changes, checkAndUpdateErr := monitor.Storage.CheckAndUpdate(ctx, apiInfo)
+	if checkAndUpdateErr != nil {
+		monitor.Metrics.PollError("storage")
+		return monitor.nextPoll(), checkAndUpdateErr
+	}
+	now := monitor.Clock.Now()
+	monitor.mutex.Lock()
+	monitor.lastInfo = apiInfo
+	monitor.lastSuccess = now
+	monitor.mutex.Unlock()
+	monitor.Metrics.PollSucceeded(now)
+	if historyErr := monitor.Storage.AppendHistory(ctx, changes); historyErr != nil {
+		monitor.Metrics.PollError("history")
+		log.Printf("Failed to store changes history: %s", historyErr.Error())
+	}
+	monitor.Metrics.SetDevices(metricsDevices(apiInfo))
+	monitor.publishStates(notifyCtx, apiInfo, monitor.removeDevices(ctx, apiInfo))
+	// History keeps every change, notifications only confirmed ones
+	changes, debounceErr := monitor.Debouncer.Filter(ctx, apiInfo, changes, now)
+	if debounceErr != nil {
+		monitor.Metrics.PollError("debounce")
+		log.Println(debounceErr)
+	}
+	// Quiet and maintenance windows only hold notifications back
+	notified, summaries := monitor.Suppressor.Filter(apiInfo, changes, monitor.maintenances(ctx, now), now)
+	acknowledgements := monitor.acknowledgements(ctx, changes)
+	channels := monitor.Registry.Names()
+	for _, summary := range summaries {
+		for _, route := range Routes(monitor.NotifyConfig, channels, summary.DeviceID, summary.DeviceName, summary.Changes) {
+			event := notifier.Event{DeviceID: summary.DeviceID, DeviceName: summary.DeviceName, Changes: route.Changes, Recipients: route.Recipients, Summary: true}
+			if sendError := monitor.Registry.DispatchTo(notifyCtx, event, route.Channels); sendError != nil {
+				log.Println(sendError)
+			}
+		}
+	}
+	for deviceID, deviceChanges := range events.GroupByDevice(notified) {
+		deviceName := apiInfo.DevicesInfo[deviceID].Name
+		for _, route := range Routes(monitor.NotifyConfig, channels, deviceID, deviceName, deviceChanges) {
+			event := notifier.Event{DeviceID: deviceID, DeviceName: deviceName, Changes: route.Changes, Recipients: route.Recipients}
+			if acknowledgement, found := acknowledgements[deviceID]; found {
+				event.Acknowledgement = &acknowledgement
+			}
+			// Failed deliveries are counted by the registry, they must not
+			// stop polling nor skip remaining routes
+			if sendError := monitor.Registry.DispatchTo(notifyCtx, event, route.Channels); sendError != nil {
+				log.Println(sendError)
+			}
+		}
+	}
+	monitor.clearAcknowledgements(ctx, acknowledgements, changes)
+	monitor.escalate(ctx, notifyCtx, apiInfo, changes, now)
+	return monitor.nextPoll(), nil
+}
+
+// nextPoll returns poll interval plus a random jitter up to MaxJitter
+func (monitor *Monitor) nextPoll() time.Duration {
+	if monitor.MaxJitter <= 0 {
+		return monitor.PollInterval
+	}
+	return monitor.PollInterval + time.Duration(rand.Int63n(int64(monitor.MaxJitter)))
+}
+
+// removeDevices deletes stored devices AlarmManager no longer lists and
+// returns their IDs
+func (monitor *Monitor) removeDevices(ctx context.Context, apiInfo apiwatcher.APIInfo) []string {
+	listed := make(map[string]bool, len(apiInfo.DevicesStatus))
+	for deviceID := range apiInfo.DevicesInfo {
+		listed[deviceID] = true
+	}
+	for deviceID := range apiInfo.DevicesStatus {
+		listed[deviceID] = true
+	}
+	removed, removeErr := monitor.Storage.RemoveDevices(ctx, listed)
+	if removeErr != nil {
+		monitor.Metrics.PollError("devices")
+		log.Printf("Failed to remove devices no longer listed: %s", removeErr.Error())
+	}
+	for _, deviceID := range removed {
+		log.Printf("Device %s is no longer listed by AlarmManager, it was removed.", deviceID)
+	}
+	return removed
+}
+
+// publishStates mirrors every known device state through state publishers,
+// removed devices are sent last
+func (monitor *Monitor) publishStates(ctx context.Context, apiInfo apiwatcher.APIInfo, removed []string) {
+	states := make([]notifier.DeviceState, 0, len(apiInfo.DevicesInfo)+len(removed))
+	for deviceID, deviceInfo := range apiInfo.DevicesInfo {
+		states = append(states, notifier.DeviceState{DeviceID: deviceID, DeviceName: deviceInfo.Name, Mode: deviceInfo.Mode, Firing: deviceInfo.Firing, Online: deviceInfo.Online})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].DeviceID < states[j].DeviceID
+	})
+	for _, deviceID := range removed {
+		states = append(states, notifier.DeviceState{DeviceID: deviceID, Removed: true})
+	}
+	if publishErr := monitor.Registry.PublishStates(ctx, states); publishErr != nil {
+		monitor.Metrics.PollError("state")
+		log.Println(publishErr)
+	}
+}
+
+// maintenances returns active maintenance windows ending expired ones
+func (monitor *Monitor) maintenances(ctx context.Context, now time.Time) map[string]events.Maintenance {
+	maintenances, maintenancesErr := monitor.Storage.Maintenances(ctx)
+	if maintenancesErr != nil {
+		monitor.Metrics.PollError("maintenance")
+		log.Printf("Failed to read maintenance windows: %s", maintenancesErr.Error())
+		return nil
+	}
+	for deviceID, maintenance := range maintenances {
+		if now.Before(maintenance.Until) {
+			continue
+		}
+		delete(maintenances, deviceID)
+		log.Printf("Device %s maintenance window ended.", deviceID)
+		if endErr := monitor.Storage.EndMaintenance(ctx, deviceID); endErr != nil {
+			monitor.Metrics.PollError("maintenance")
+			log.Printf("Failed to end device %s maintenance window: %s", deviceID, endErr.Error())
+		}
+	}
+	return maintenances
+}
+
+// acknowledgements returns stored acknowledgements when there are changes to notify
+func (monitor *Monitor) acknowledgements(ctx context.Context, changes []events.ChangeEvent) map[string]events.Acknowledgement {
+	if len(changes) == 0 {
+		return nil
+	}
+	acknowledgements, acknowledgementsErr := monitor.Storage.Acknowledgements(ctx)
+	if acknowledgementsErr != nil {
+		monitor.Metrics.PollError("acknowledgements")
+		log.Printf("Failed to read acknowledgements: %s", acknowledgementsErr.Error())
+	}
+	return acknowledgements
+}
+
+// clearAcknowledgements removes acknowledgements of devices which started or
+// stopped firing, they only apply to the firing they were made for
+func (monitor *Monitor) clearAcknowledgements(ctx context.Context, acknowledgements map[string]events.Acknowledgement, changes []events.ChangeEvent) {
+	for _, change := range changes {
+		if change.Field != events.FieldFiring {
+			continue
+		}
+		if _, found := acknowledgements[change.DeviceID]; !found {
+			continue
+		}
+		if clearErr := monitor.Storage.ClearAcknowledgement(ctx, change.DeviceID); clearErr != nil {
+			monitor.Metrics.PollError("acknowledgements")
+			log.Printf("Failed to clear device %s acknowledgement: %s", change.DeviceID, clearErr.Error())
+		}
+	}
+}
+
+// escalate resends firing notifications of devices that keep firing
+func (monitor *Monitor) escalate(ctx context.Context, notifyCtx context.Context, apiInfo apiwatcher.APIInfo, changes []events.ChangeEvent, now time.Time) {
+	reminders, escalationErr := monitor.Escalator.Process(ctx, apiInfo, changes, now)
+	if escalationErr != nil {
+		monitor.Metrics.PollError("escalation")
+		log.Printf("Failed to process firing escalations: %s", escalationErr.Error())
+	}
+	for _, reminder := range reminders {
+		if sendError := monitor.Registry.DispatchTo(notifyCtx, reminder.Event, reminder.Channels); sendError != nil {
+			log.Println(sendError)
+		}
+	}
+}
+
+func (monitor *Monitor) notifyReachability(ctx context.Context, reachable bool) {
+	oldValue, newValue := "true", "false"
+	if reachable {
+		oldValue, newValue = "false", "true"
+	}
+	change := events.New(AlarmManagerID, "AlarmManager", events.FieldReachable, oldValue, newValue, monitor.Clock.Now())
+	// Reachability is always notified unless rules say otherwise
+	routes := []Route{{Changes: []events.ChangeEvent{change}}}
+	if len(monitor.NotifyConfig.Rules) > 0 {
+		routes = Routes(monitor.NotifyConfig, monitor.Registry.Names(), AlarmManagerID, "AlarmManager", routes[0].Changes)
+	}
+	for _, route := range routes {
+		event := notifier.Event{DeviceID: AlarmManagerID, DeviceName: "AlarmManager", Changes: route.Changes, Recipients: route.Recipients}
+		if sendError := monitor.Registry.DispatchTo(ctx, event, route.Channels); sendError != nil {
+			log.Println(sendError)
+		}
+	}
+}
+
+func metricsDevices(apiInfo apiwatcher.APIInfo) []metrics.Device {
+	devices := make([]metrics.Device, 0, len(apiInfo.DevicesInfo))
+	for deviceID, deviceInfo := range apiInfo.DevicesInfo {
+		devices = append(devices, metrics.Device{ID: deviceID, Name: deviceInfo.Name, Mode: deviceInfo.Mode, Online: deviceInfo.Online, Firing: deviceInfo.Firing})
+	}
+	return devices
+}
+
+// ShouldNotify returns true if any change matches notify config
+func ShouldNotify(notifyConfig config_reader.NotifyConfig, deviceChanges []events.ChangeEvent) bool {
+	for _, change := range deviceChanges {
+		if (notifyConfig.NotifyOffline && (change.IsOnlineChange() || change.IsAvailabilityChange())) || (notifyConfig.NotifyStatusChange && change.IsStatusChange()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,419 @@
+package monitor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	metrics "github.com/a-castellano/AlarmStatusWatcher/metrics"
+	notifier "github.com/a-castellano/AlarmStatusWatcher/notifier"
+	storage "github.com/a-castellano/AlarmStatusWatcher/storage"
+	redismock "github.com/go-redis/redismock/v8"
+)
+
+type FakeNotifier struct {
+	mutex sync.Mutex
+	sent  []notifier.Event
+}
+
+func (fake *FakeNotifier) Name() string {
+	return "fake"
+}
+
+func (fake *FakeNotifier) Send(ctx context.Context, event notifier.Event) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.sent = append(fake.sent, event)
+	return nil
+}
+
+func (fake *FakeNotifier) Sent() []notifier.Event {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]notifier.Event{}, fake.sent...)
+}
+
+type FakeAlarmManager struct {
+	Server  *httptest.Server
+	failing int32
+}
+
+func NewFakeAlarmManager() *FakeAlarmManager {
+	alarmManager := &FakeAlarmManager{}
+	alarmManager.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&alarmManager.failing) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"success":true,"data":{}}`))
+	}))
+	return alarmManager
+}
+
+func (alarmManager *FakeAlarmManager) SetFailing(failing bool) {
+	if failing {
+		atomic.StoreInt32(&alarmManager.failing, 1)
+	} else {
+		atomic.StoreInt32(&alarmManager.failing, 0)
+	}
+}
+
+func newTestMonitor(t *testing.T, alarmManager *FakeAlarmManager, fake *FakeNotifier) *Monitor {
+	host, portString, _ := net.SplitHostPort(alarmManager.Server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	config := config_reader.Config{}
+	config.AlarmManager = config_reader.AlarmManager{Host: host, Port: port, FailureThreshold: 3}
+	config.NotifyConfig = config_reader.NotifyConfig{NotifyOffline: true, NotifyStatusChange: true}
+
+	db, _ := redismock.NewClientMock()
+	registry := notifier.NewRegistry()
+	registry.Register(fake)
+
+	monitor := New(config, storage.Storage{RedisClient: db}, apiwatcher.Requester{Client: http.Client{Timeout: time.Second}}, registry)
+	monitor.PollInterval = time.Millisecond
+	monitor.Backoff = Backoff{Initial: time.Millisecond, Max: time.Millisecond * 8}
+	return monitor
+}
+
+func TestUnreachableAndRecoveredNotifications(t *testing.T) {
+
+	alarmManager := NewFakeAlarmManager()
+	defer alarmManager.Server.Close()
+	fake := FakeNotifier{}
+	monitor := newTestMonitor(t, alarmManager, &fake)
+	ctx := context.TODO()
+
+	alarmManager.SetFailing(true)
+	for i := 1; i <= 4; i++ {
+		wait, err := monitor.Check(ctx)
+		if err != nil {
+			t.Fatalf("Check should survive AlarmManager failures, error was '%s'.", err.Error())
+		}
+		if wait != monitor.Backoff.Next(i) {
+			t.Errorf("Wait after %d failures should be %s, not %s.", i, monitor.Backoff.Next(i), wait)
+		}
+		if i < 3 && len(fake.Sent()) != 0 {
+			t.Errorf("No notification should be sent before reaching failure threshold.")
+		}
+	}
+	if _, lastSuccess := monitor.Snapshot(); !lastSuccess.IsZero() {
+		t.Errorf("Last successful poll should not be set while AlarmManager is failing.")
+	}
+	if monitor.Failures() != 4 {
+		t.Errorf("Monitor should count 4 consecutive failures, not %d.", monitor.Failures())
+	}
+	sent := fake.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("Only one unreachable notification should be sent, %d were sent.", len(sent))
+	}
+	if sent[0].DeviceID != AlarmManagerID || sent[0].Text() != "AlarmManager - Became Unreachable" {
+		t.Errorf("Unexpected unreachable notification '%s'.", sent[0].Text())
+	}
+
+	alarmManager.SetFailing(false)
+	wait, err := monitor.Check(ctx)
+	if err != nil {
+		t.Fatalf("Check should not fail once AlarmManager recovers, error was '%s'.", err.Error())
+	}
+	if wait != monitor.PollInterval {
+		t.Errorf("Wait after recovery should be poll interval, not %s.", wait)
+	}
+	if monitor.Failures() != 0 {
+		t.Errorf("Failures should be reset after recovery.")
+	}
+	if _, lastSuccess := monitor.Snapshot(); lastSuccess.IsZero() {
+		t.Errorf("Last successful poll should be set after recovery.")
+	}
+	sent = fake.Sent()
+	if len(sent) != 2 || sent[1].Text() != "AlarmManager - Recovered" {
+		t.Errorf("A recovered notification should be sent.")
+	}
+	if sent[1].Severity() != events.SeverityInfo {
+		t.Errorf("Recovered notification severity should be info, not %s.", sent[1].Severity())
+	}
+}
+
+func TestNoRecoveredNotificationBelowThreshold(t *testing.T) {
+
+	alarmManager := NewFakeAlarmManager()
+	defer alarmManager.Server.Close()
+	fake := FakeNotifier{}
+	monitor := newTestMonitor(t, alarmManager, &fake)
+	ctx := context.TODO()
+
+	alarmManager.SetFailing(true)
+	monitor.Check(ctx)
+	alarmManager.SetFailing(false)
+	monitor.Check(ctx)
+
+	if len(fake.Sent()) != 0 {
+		t.Errorf("No notification should be sent when failures do not reach threshold.")
+	}
+}
+
+func TestRunSurvivesFailuresUntilCancelled(t *testing.T) {
+
+	alarmManager := NewFakeAlarmManager()
+	defer alarmManager.Server.Close()
+	alarmManager.SetFailing(true)
+	fake := FakeNotifier{}
+	monitor := newTestMonitor(t, alarmManager, &fake)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if err := monitor.Run(ctx); err != nil {
+		t.Errorf("Run should return nil when cancelled, error was '%s'.", err.Error())
+	}
+	if len(fake.Sent()) != 1 {
+		t.Errorf("One unreachable notification should be sent while AlarmManager is failing, %d were sent.", len(fake.Sent()))
+	}
+}
+
+func TestRunKeepsPollingWhileWebhookIsDown(t *testing.T) {
+
+	var polls int32
+	alarmManager := &FakeAlarmManager{Server: httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&polls, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))}
+	defer alarmManager.Server.Close()
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer endpoint.Close()
+
+	monitor := newTestMonitor(t, alarmManager, &FakeNotifier{})
+	webhookNotifier, _ := notifier.NewWebhookNotifier(config_reader.Webhook{Enabled: true, URL: endpoint.URL, Method: "POST", Timeout: time.Second, Retries: 10, RetryDelay: time.Millisecond * 50, DeliveryTimeout: time.Millisecond * 200, DeadLetterFile: filepath.Join(t.TempDir(), "deadletter.log")})
+	monitor.Registry = notifier.NewRegistry()
+	monitor.Registry.Register(webhookNotifier)
+	monitor.FailureThreshold = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*600)
+	defer cancel()
+	if err := monitor.Run(ctx); err != nil {
+		t.Errorf("Run should not stop when webhook deliveries fail, error was '%s'.", err.Error())
+	}
+	if atomic.LoadInt32(&polls) < 3 {
+		t.Errorf("Polling should continue while webhook endpoint is down, only %d polls were done.", atomic.LoadInt32(&polls))
+	}
+}
+
+func TestPollMetrics(t *testing.T) {
+
+	alarmManager := NewFakeAlarmManager()
+	defer alarmManager.Server.Close()
+	fake := FakeNotifier{}
+	monitor := newTestMonitor(t, alarmManager, &fake)
+	monitor.Metrics = metrics.New()
+	monitor.Watcher.Metrics = monitor.Metrics
+	ctx := context.TODO()
+
+	alarmManager.SetFailing(true)
+	monitor.Check(ctx)
+	alarmManager.SetFailing(false)
+	monitor.Check(ctx)
+
+	recorder := httptest.NewRecorder()
+	monitor.Metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	output := recorder.Body.String()
+	if !strings.Contains(output, `alarmstatuswatcher_poll_errors_total{type="request"} 1`) {
+		t.Errorf("Failed poll should be counted as request error.")
+	}
+	if !strings.Contains(output, `alarmstatuswatcher_poll_duration_seconds_count 2`) {
+		t.Errorf("Both polls should be observed.")
+	}
+	if strings.Contains(output, "alarmstatuswatcher_last_successful_poll_timestamp_seconds 0") {
+		t.Errorf("Last successful poll timestamp should be set.")
+	}
+}
+
+type FakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+	done     bool
+}
+
+func (timer *FakeTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *FakeTimer) Stop() bool {
+	timer.clock.mutex.Lock()
+	defer timer.clock.mutex.Unlock()
+	wasActive := !timer.done
+	timer.done = true
+	return wasActive
+}
+
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*FakeTimer
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) NewTimer(d time.Duration) Timer {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	timer := &FakeTimer{clock: clock, deadline: clock.now.Add(d), c: make(chan time.Time, 1)}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// Advance moves clock forward firing expired timers
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+	for _, timer := range clock.timers {
+		if !timer.done && !timer.deadline.After(clock.now) {
+			timer.done = true
+			timer.c <- clock.now
+		}
+	}
+}
+
+// WaitForTimers waits until count timers have been created
+func (clock *FakeClock) WaitForTimers(t *testing.T, count int) {
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		clock.mutex.Lock()
+		created := len(clock.timers)
+		clock.mutex.Unlock()
+		if created >= count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d timers.", count)
+}
+
+type BlockingNotifier struct {
+	started  chan struct{}
+	finished chan error
+}
+
+func (blocking *BlockingNotifier) Name() string {
+	return "blocking"
+}
+
+func (blocking *BlockingNotifier) Send(ctx context.Context, event notifier.Event) error {
+	close(blocking.started)
+	<-ctx.Done()
+	blocking.finished <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestRunWithFakeClockStopsOnCancel(t *testing.T) {
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"success":true,"data":{}}`))
+	}))
+	defer server.Close()
+	fake := FakeNotifier{}
+	monitor := newTestMonitor(t, &FakeAlarmManager{Server: server}, &fake)
+	clock := &FakeClock{now: time.Unix(1655150000, 0)}
+	monitor.Clock = clock
+	monitor.PollInterval = time.Second * 30
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- monitor.Run(ctx)
+	}()
+
+	clock.WaitForTimers(t, 1)
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("One poll should be done before first tick, %d were done.", atomic.LoadInt32(&requests))
+	}
+	clock.Advance(time.Second * 29)
+	clock.Advance(time.Second)
+	clock.WaitForTimers(t, 2)
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("Two polls should be done after first tick, %d were done.", atomic.LoadInt32(&requests))
+	}
+	if _, lastSuccess := monitor.Snapshot(); !lastSuccess.Equal(time.Unix(1655150030, 0)) {
+		t.Errorf("Last successful poll should use clock time, not %s.", lastSuccess)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run should return nil when cancelled, error was '%s'.", err.Error())
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Run did not stop after cancellation.")
+	}
+}
+
+func TestRunDrainsNotificationsUntilDeadline(t *testing.T) {
+
+	alarmManager := NewFakeAlarmManager()
+	defer alarmManager.Server.Close()
+	alarmManager.SetFailing(true)
+
+	monitor := newTestMonitor(t, alarmManager, &FakeNotifier{})
+	blocking := BlockingNotifier{started: make(chan struct{}), finished: make(chan error, 1)}
+	monitor.Registry = notifier.NewRegistry()
+	monitor.Registry.Register(&blocking)
+	monitor.FailureThreshold = 1
+	clock := &FakeClock{now: time.Unix(1655150000, 0)}
+	monitor.Clock = clock
+	monitor.DrainTimeout = time.Second * 10
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- monitor.Run(ctx)
+	}()
+
+	<-blocking.started
+	cancel()
+	// Drain timer is the only timer created while notification is in flight
+	clock.WaitForTimers(t, 1)
+	clock.Advance(time.Second * 9)
+	select {
+	case <-blocking.finished:
+		t.Fatalf("In-flight notification should not be cancelled before drain deadline.")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case err := <-blocking.finished:
+		if err != context.Canceled {
+			t.Errorf("In-flight notification should be cancelled after drain deadline, error was '%v'.", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("In-flight notification was not cancelled after drain deadline.")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run should return nil when cancelled, error was '%s'.", err.Error())
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Run did not stop after drain deadline.")
+	}
+}
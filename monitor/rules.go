@@ -0,0 +1,121 @@
+package monitor
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+// Route is a group of device changes to be sent through Channels, every
+// channel is used when Channels is empty
+type Route struct {
+	Changes    []events.ChangeEvent
+	Channels   []string
+	Recipients []string
+}
+
+type routeTarget struct {
+	indexes    []int
+	recipients []string
+}
+
+// Routes returns where deviceChanges must be notified. Without rules every
+// change is sent through every channel if any of them is enabled by notify
+// booleans. With rules each change goes to the channels of every matching
+// rule, channels receiving the same changes share a single route.
+func Routes(notifyConfig config_reader.NotifyConfig, channels []string, deviceID string, deviceName string, deviceChanges []events.ChangeEvent) []Route {
+	if len(notifyConfig.Rules) == 0 {
+		if ShouldNotify(notifyConfig, deviceChanges) {
+			return []Route{{Changes: deviceChanges}}
+		}
+		return nil
+	}
+
+	targets := make(map[string]*routeTarget)
+	for index, change := range deviceChanges {
+		for _, rule := range notifyConfig.Rules {
+			if !RuleMatches(rule, deviceID, deviceName, change) {
+				continue
+			}
+			ruleChannels := rule.Channels
+			if len(ruleChannels) == 0 {
+				ruleChannels = channels
+			}
+			for _, channel := range ruleChannels {
+				target, found := targets[channel]
+				if !found {
+					target = &routeTarget{}
+					targets[channel] = target
+				}
+				if len(target.indexes) == 0 || target.indexes[len(target.indexes)-1] != index {
+					target.indexes = append(target.indexes, index)
+				}
+				target.recipients = appendMissing(target.recipients, rule.Recipients...)
+			}
+		}
+	}
+
+	var routes []Route
+	routeIndexes := make(map[string]int)
+	for _, channel := range channels {
+		target, found := targets[channel]
+		if !found {
+			continue
+		}
+		sort.Strings(target.recipients)
+		key := routeKey(target)
+		if routeIndex, found := routeIndexes[key]; found {
+			routes[routeIndex].Channels = append(routes[routeIndex].Channels, channel)
+			continue
+		}
+		route := Route{Channels: []string{channel}, Recipients: target.recipients}
+		for _, index := range target.indexes {
+			route.Changes = append(route.Changes, deviceChanges[index])
+		}
+		routeIndexes[key] = len(routes)
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// RuleMatches returns true if change satisfies every condition of rule
+func RuleMatches(rule config_reader.NotifyRule, deviceID string, deviceName string, change events.ChangeEvent) bool {
+	if !deviceMatches(rule.Devices, deviceID, deviceName) {
+		return false
+	}
+	if len(rule.Types) > 0 {
+		matched := false
+		for _, ruleType := range rule.Types {
+			matched = matched || events.Type(ruleType) == change.Type()
+		}
+		if !matched {
+			return false
+		}
+	}
+	return inDailyWindow(rule.From, rule.To, nil, time.Local, change.Timestamp)
+}
+
+func appendMissing(values []string, newValues ...string) []string {
+	for _, newValue := range newValues {
+		found := false
+		for _, value := range values {
+			found = found || value == newValue
+		}
+		if !found {
+			values = append(values, newValue)
+		}
+	}
+	return values
+}
+
+func routeKey(target *routeTarget) string {
+	indexes := make([]string, 0, len(target.indexes))
+	for _, index := range target.indexes {
+		indexes = append(indexes, strconv.Itoa(index))
+	}
+	return strings.Join(indexes, ",") + "|" + strings.Join(target.recipients, ",")
+}
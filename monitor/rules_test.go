@@ -0,0 +1,77 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+func TestRoutesWithoutRules(t *testing.T) {
+
+	now := time.Unix(1655150000, 0)
+	changes := []events.ChangeEvent{events.New("garage", "Garage", events.FieldOnline, "true", "false", now)}
+
+	routes := Routes(config_reader.NotifyConfig{NotifyOffline: true}, []string{"mail", "queue"}, "garage", "Garage", changes)
+	if len(routes) != 1 || len(routes[0].Channels) != 0 || len(routes[0].Changes) != 1 {
+		t.Errorf("Without rules changes should be sent through every channel, routes were %+v.", routes)
+	}
+	if routes := Routes(config_reader.NotifyConfig{NotifyStatusChange: true}, []string{"mail", "queue"}, "garage", "Garage", changes); len(routes) != 0 {
+		t.Errorf("Without rules disabled changes should not be sent, routes were %+v.", routes)
+	}
+}
+
+func TestRoutesWithRules(t *testing.T) {
+
+	notifyConfig := config_reader.NotifyConfig{Rules: []config_reader.NotifyRule{
+		{Devices: []string{"garage*"}, Types: []string{"online", "offline"}, Channels: []string{"queue"}},
+		{Types: []string{"firing_started", "firing_stopped"}, Channels: []string{"mail", "webhook"}, Recipients: []string{"security@example.com"}},
+		{Devices: []string{"Home *"}, Types: []string{"mode_changed"}},
+	}}
+	channels := []string{"mail", "queue", "webhook"}
+	now := time.Unix(1655150000, 0)
+
+	offline := events.New("garage2", "Garage", events.FieldOnline, "true", "false", now)
+	firing := events.New("garage2", "Garage", events.FieldFiring, "false", "true", now)
+	routes := Routes(notifyConfig, channels, "garage2", "Garage", []events.ChangeEvent{offline, firing})
+	if len(routes) != 2 {
+		t.Fatalf("Garage changes should be split in 2 routes, routes were %+v.", routes)
+	}
+	if len(routes[0].Channels) != 2 || routes[0].Channels[0] != "mail" || routes[0].Channels[1] != "webhook" || len(routes[0].Changes) != 1 || routes[0].Changes[0].Field != events.FieldFiring || routes[0].Recipients[0] != "security@example.com" {
+		t.Errorf("Firing should be sent to mail and webhook, route was %+v.", routes[0])
+	}
+	if len(routes[1].Channels) != 1 || routes[1].Channels[0] != "queue" || len(routes[1].Changes) != 1 || routes[1].Changes[0].Field != events.FieldOnline || len(routes[1].Recipients) != 0 {
+		t.Errorf("Garage offline should only be sent to queue, route was %+v.", routes[1])
+	}
+
+	houseOffline := events.New("house", "House", events.FieldOnline, "true", "false", now)
+	if routes := Routes(notifyConfig, channels, "house", "House", []events.ChangeEvent{houseOffline}); len(routes) != 0 {
+		t.Errorf("Changes without matching rules should not be sent, routes were %+v.", routes)
+	}
+
+	// Rules without channels use every channel and match device names too
+	mode := events.New("ab123", "Home Alarm", events.FieldMode, "disarmed", "armed", now)
+	routes = Routes(notifyConfig, channels, "ab123", "Home Alarm", []events.ChangeEvent{mode})
+	if len(routes) != 1 || len(routes[0].Channels) != 3 {
+		t.Errorf("Mode changes should be sent through every channel, routes were %+v.", routes)
+	}
+}
+
+func TestRuleTimeOfDay(t *testing.T) {
+
+	night := config_reader.NotifyRule{From: time.Hour * 22, To: time.Hour*7 + time.Minute*30}
+	day := config_reader.NotifyRule{From: time.Hour * 8, To: time.Hour * 20}
+	times := map[string]bool{"23:00": true, "03:15": true, "07:30": false, "12:00": false, "22:00": true}
+	for clock, atNight := range times {
+		parsed, _ := time.Parse("15:04", clock)
+		timestamp := time.Date(2022, 6, 13, parsed.Hour(), parsed.Minute(), 0, 0, time.Local)
+		change := events.New("garage", "Garage", events.FieldOnline, "true", "false", timestamp)
+		if RuleMatches(night, "garage", "Garage", change) != atNight {
+			t.Errorf("Night rule match at %s should be %t.", clock, atNight)
+		}
+		if RuleMatches(day, "garage", "Garage", change) != (clock == "12:00") {
+			t.Errorf("Day rule match at %s should be %t.", clock, clock == "12:00")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package monitor
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+)
+
+// Schedule decides which devices have to be polled, devices without a
+// specific interval are polled every time
+type Schedule struct {
+	// Intervals holds poll interval by lowercase device ID
+	Intervals map[string]time.Duration
+
+	mutex      sync.Mutex
+	lastPolled map[string]time.Time
+}
+
+// NewSchedule returns a Schedule using given device intervals
+func NewSchedule(intervals map[string]time.Duration) *Schedule {
+	schedule := &Schedule{Intervals: make(map[string]time.Duration), lastPolled: make(map[string]time.Time)}
+	for deviceID, interval := range intervals {
+		schedule.Intervals[strings.ToLower(deviceID)] = interval
+	}
+	return schedule
+}
+
+// Due returns true if deviceID has to be polled at now
+func (schedule *Schedule) Due(deviceID string, now time.Time) bool {
+	if schedule == nil {
+		return true
+	}
+	interval, ok := schedule.Intervals[strings.ToLower(deviceID)]
+	if !ok {
+		return true
+	}
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	lastPolled, polled := schedule.lastPolled[deviceID]
+	return !polled || !now.Before(lastPolled.Add(interval))
+}
+
+// Polled records devices whose status was retrieved at now
+func (schedule *Schedule) Polled(apiInfo apiwatcher.APIInfo, now time.Time) {
+	if schedule == nil {
+		return
+	}
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	for deviceID := range apiInfo.DevicesInfo {
+		if apiInfo.Status(deviceID).State == apiwatcher.FetchOK {
+			schedule.lastPolled[deviceID] = now
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+)
+
+func TestScheduleDue(t *testing.T) {
+
+	schedule := NewSchedule(map[string]time.Duration{"garage": time.Minute * 5})
+	now := time.Unix(1655150000, 0)
+
+	if !schedule.Due("house", now) || !schedule.Due("garage", now) {
+		t.Errorf("Every device should be due before being polled.")
+	}
+
+	apiInfo := apiwatcher.APIInfo{
+		DevicesInfo:   map[string]apiwatcher.DeviceInfo{"house": {}, "garage": {}},
+		DevicesStatus: map[string]apiwatcher.FetchStatus{"house": {State: apiwatcher.FetchOK}, "garage": {State: apiwatcher.FetchOK}},
+	}
+	schedule.Polled(apiInfo, now)
+
+	if !schedule.Due("house", now.Add(time.Second)) {
+		t.Errorf("Devices without interval should always be due.")
+	}
+	if schedule.Due("garage", now.Add(time.Minute*4)) {
+		t.Errorf("Garage should not be due before its interval.")
+	}
+	if !schedule.Due("garage", now.Add(time.Minute*5)) {
+		t.Errorf("Garage should be due after its interval.")
+	}
+}
+
+func TestScheduleFailedDevicesStayDue(t *testing.T) {
+
+	schedule := NewSchedule(map[string]time.Duration{"garage": time.Minute * 5})
+	now := time.Unix(1655150000, 0)
+
+	apiInfo := apiwatcher.APIInfo{
+		DevicesInfo:   map[string]apiwatcher.DeviceInfo{"garage": {}},
+		DevicesStatus: map[string]apiwatcher.FetchStatus{"garage": {State: apiwatcher.FetchStale}},
+	}
+	schedule.Polled(apiInfo, now)
+	if !schedule.Due("garage", now.Add(time.Second)) {
+		t.Errorf("Devices whose status was not retrieved should stay due.")
+	}
+}
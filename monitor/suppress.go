@@ -0,0 +1,90 @@
+package monitor
+
+import (
+	"sort"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+type heldChanges struct {
+	deviceName string
+	changes    []events.ChangeEvent
+}
+
+// Suppressor holds non critical changes of devices in quiet hours or under
+// maintenance and releases them as a summary once their window ends. Held
+// changes are kept in memory, they are still stored in history.
+type Suppressor struct {
+	QuietHours config_reader.QuietHours
+
+	held map[string]*heldChanges
+}
+
+// Summary groups changes held while a device window was active
+type Summary struct {
+	DeviceID   string
+	DeviceName string
+	Changes    []events.ChangeEvent
+}
+
+// NewSuppressor returns a Suppressor using quietHours windows
+func NewSuppressor(quietHours config_reader.QuietHours) *Suppressor {
+	return &Suppressor{QuietHours: quietHours, held: make(map[string]*heldChanges)}
+}
+
+// Filter returns the changes to notify now and summaries of devices whose
+// quiet or maintenance window has ended. Critical changes are never held.
+func (suppressor *Suppressor) Filter(apiInfo apiwatcher.APIInfo, changes []events.ChangeEvent, maintenances map[string]events.Maintenance, now time.Time) ([]events.ChangeEvent, []Summary) {
+	var notified []events.ChangeEvent
+	for _, change := range changes {
+		deviceName := apiInfo.DevicesInfo[change.DeviceID].Name
+		if change.Severity == events.SeverityCritical || !suppressor.Suppressed(change.DeviceID, deviceName, maintenances, now) {
+			notified = append(notified, change)
+			continue
+		}
+		held, found := suppressor.held[change.DeviceID]
+		if !found {
+			held = &heldChanges{}
+			suppressor.held[change.DeviceID] = held
+		}
+		held.deviceName = deviceName
+		held.changes = append(held.changes, change)
+	}
+
+	deviceIDs := make([]string, 0, len(suppressor.held))
+	for deviceID := range suppressor.held {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+	var summaries []Summary
+	for _, deviceID := range deviceIDs {
+		held := suppressor.held[deviceID]
+		if suppressor.Suppressed(deviceID, held.deviceName, maintenances, now) {
+			continue
+		}
+		summaries = append(summaries, Summary{DeviceID: deviceID, DeviceName: held.deviceName, Changes: held.changes})
+		delete(suppressor.held, deviceID)
+	}
+	return notified, summaries
+}
+
+// Suppressed returns true if device is under maintenance or in quiet hours at now
+func (suppressor *Suppressor) Suppressed(deviceID string, deviceName string, maintenances map[string]events.Maintenance, now time.Time) bool {
+	if maintenance, found := maintenances[deviceID]; found && now.Before(maintenance.Until) {
+		return true
+	}
+	for _, window := range suppressor.QuietHours.Windows {
+		if QuietWindowActive(window, suppressor.QuietHours.Location, deviceID, deviceName, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// QuietWindowActive returns true if window applies to device and is active at now
+func QuietWindowActive(window config_reader.QuietWindow, location *time.Location, deviceID string, deviceName string, now time.Time) bool {
+	return deviceMatches(window.Devices, deviceID, deviceName) && inDailyWindow(window.From, window.To, window.Days, location, now)
+}
@@ -0,0 +1,69 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+func TestQuietWindowActive(t *testing.T) {
+
+	madrid, _ := time.LoadLocation("Europe/Madrid")
+	// Friday and Saturday nights, 22:00 to 08:00 Madrid time
+	window := config_reader.QuietWindow{Devices: []string{"garage*"}, Days: []time.Weekday{time.Friday, time.Saturday}, From: time.Hour * 22, To: time.Hour * 8}
+
+	times := map[string]bool{
+		"2022-06-17T23:00:00+02:00": true,  // Friday night
+		"2022-06-18T07:59:00+02:00": true,  // Saturday morning, started on Friday
+		"2022-06-18T08:00:00+02:00": false, // Saturday window end
+		"2022-06-18T12:00:00+02:00": false,
+		"2022-06-19T03:00:00+02:00": true,  // Sunday morning, started on Saturday
+		"2022-06-19T23:00:00+02:00": false, // Sunday night
+		"2022-06-17T20:30:00Z":      true,  // Friday 22:30 in Madrid
+	}
+	for timestamp, active := range times {
+		now, _ := time.Parse(time.RFC3339, timestamp)
+		if QuietWindowActive(window, madrid, "garage2", "Garage", now) != active {
+			t.Errorf("Quiet window active at %s should be %t.", timestamp, active)
+		}
+	}
+	now, _ := time.Parse(time.RFC3339, "2022-06-17T23:00:00+02:00")
+	if QuietWindowActive(window, madrid, "house", "House", now) {
+		t.Errorf("Quiet window should only apply to matching devices.")
+	}
+}
+
+func TestSuppressorHoldsChangesUntilMaintenanceEnds(t *testing.T) {
+
+	suppressor := NewSuppressor(config_reader.QuietHours{})
+	now := time.Unix(1655150000, 0)
+	apiInfo := apiwatcher.APIInfo{DevicesInfo: map[string]apiwatcher.DeviceInfo{"garage": {Name: "Garage"}, "house": {Name: "House"}}}
+	maintenances := map[string]events.Maintenance{"garage": {DeviceID: "garage", Until: now.Add(time.Hour)}}
+
+	offline := events.New("garage", "Garage", events.FieldOnline, "true", "false", now)
+	firing := events.New("garage", "Garage", events.FieldFiring, "false", "true", now)
+	houseMode := events.New("house", "House", events.FieldMode, "disarmed", "armed", now)
+	notified, summaries := suppressor.Filter(apiInfo, []events.ChangeEvent{offline, firing, houseMode}, maintenances, now)
+	if len(notified) != 2 || notified[0].Field != events.FieldFiring || notified[1].DeviceID != "house" || len(summaries) != 0 {
+		t.Errorf("Only non critical changes of devices under maintenance should be held, notified were %+v.", notified)
+	}
+
+	online := events.New("garage", "Garage", events.FieldOnline, "false", "true", now.Add(time.Minute))
+	if notified, summaries := suppressor.Filter(apiInfo, []events.ChangeEvent{online}, maintenances, now.Add(time.Minute)); len(notified) != 0 || len(summaries) != 0 {
+		t.Errorf("Changes should be held while maintenance is active, notified were %+v.", notified)
+	}
+
+	notified, summaries = suppressor.Filter(apiInfo, nil, maintenances, now.Add(time.Hour))
+	if len(notified) != 0 || len(summaries) != 1 {
+		t.Fatalf("A summary should be returned once maintenance ends, summaries were %+v.", summaries)
+	}
+	if summaries[0].DeviceID != "garage" || summaries[0].DeviceName != "Garage" || len(summaries[0].Changes) != 2 {
+		t.Errorf("Summary should include held changes, it was %+v.", summaries[0])
+	}
+	if _, summaries := suppressor.Filter(apiInfo, nil, nil, now.Add(time.Hour*2)); len(summaries) != 0 {
+		t.Errorf("Summaries should be returned once, summaries were %+v.", summaries)
+	}
+}
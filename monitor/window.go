@@ -0,0 +1,51 @@
+package monitor
+
+import (
+	"path"
+	"time"
+)
+
+// deviceMatches returns true if deviceID or deviceName matches any of
+// patterns, every device matches an empty list
+func deviceMatches(patterns []string, deviceID string, deviceName string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		idMatch, _ := path.Match(pattern, deviceID)
+		nameMatch, _ := path.Match(pattern, deviceName)
+		if idMatch || nameMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// inDailyWindow returns true if timestamp time of day in location is in
+// [from, to) of a window starting on one of days, every day when empty. The
+// window ends the next day when from is later than to and equal values make
+// it last a whole day. Local time is used when location is nil.
+func inDailyWindow(from time.Duration, to time.Duration, days []time.Weekday, location *time.Location, timestamp time.Time) bool {
+	if location == nil {
+		location = time.Local
+	}
+	local := timestamp.In(location)
+	timeOfDay := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	startsOn := func(weekday time.Weekday) bool {
+		if len(days) == 0 {
+			return true
+		}
+		for _, day := range days {
+			if day == weekday {
+				return true
+			}
+		}
+		return false
+	}
+	if from < to {
+		return startsOn(local.Weekday()) && timeOfDay >= from && timeOfDay < to
+	}
+	// Window ends the next day, it may have started yesterday
+	yesterday := (local.Weekday() + 6) % 7
+	return (startsOn(local.Weekday()) && timeOfDay >= from) || (startsOn(yesterday) && timeOfDay < to)
+}
@@ -0,0 +1,45 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceMatches(t *testing.T) {
+
+	if !deviceMatches(nil, "ab123", "Home Alarm") {
+		t.Errorf("Every device should match an empty pattern list.")
+	}
+	if !deviceMatches([]string{"cd*", "Home *"}, "ab123", "Home Alarm") {
+		t.Errorf("Device should match by name.")
+	}
+	if deviceMatches([]string{"cd*"}, "ab123", "Home Alarm") {
+		t.Errorf("Device should not match other patterns.")
+	}
+}
+
+func TestInDailyWindow(t *testing.T) {
+
+	// Monday 2022-06-13 and Tuesday 2022-06-14 in UTC
+	windows := []struct {
+		from   time.Duration
+		to     time.Duration
+		days   []time.Weekday
+		time   string
+		active bool
+	}{
+		{time.Hour * 8, time.Hour * 20, nil, "2022-06-13T08:00:00Z", true},
+		{time.Hour * 8, time.Hour * 20, nil, "2022-06-13T20:00:00Z", false},
+		{time.Hour * 22, time.Hour * 6, nil, "2022-06-14T05:59:00Z", true},
+		{time.Hour * 22, time.Hour * 6, []time.Weekday{time.Monday}, "2022-06-14T05:59:00Z", true},
+		{time.Hour * 22, time.Hour * 6, []time.Weekday{time.Tuesday}, "2022-06-14T05:59:00Z", false},
+		{0, 0, nil, "2022-06-13T13:00:00Z", true},
+		{0, 0, []time.Weekday{time.Tuesday}, "2022-06-13T13:00:00Z", false},
+	}
+	for _, window := range windows {
+		timestamp, _ := time.Parse(time.RFC3339, window.time)
+		if inDailyWindow(window.from, window.to, window.days, time.UTC, timestamp) != window.active {
+			t.Errorf("Window %s-%s on %v active at %s should be %t.", window.from, window.to, window.days, window.time, window.active)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+var severityEmojis = map[events.Severity]string{
+	events.SeverityCritical: "🚨",
+	events.SeverityWarning:  "⚠️",
+	events.SeverityInfo:     "ℹ️",
+}
+
+var severityColors = map[events.Severity]string{
+	events.SeverityCritical: "#d32f2f",
+	events.SeverityWarning:  "#f9a825",
+	events.SeverityInfo:     "#2e7d32",
+}
+
+// ChatMessage is an event rendered for chat notifiers, every notifier
+// formats it with its own markup
+type ChatMessage struct {
+	Emoji string
+	// Color is the severity colour as #rrggbb
+	Color      string
+	Tag        string
+	DeviceID   string
+	DeviceName string
+	Lines      []string
+}
+
+// NewChatMessage renders event for chat notifiers
+func NewChatMessage(event Event) ChatMessage {
+	data := NewMailData(event)
+	message := ChatMessage{Emoji: severityEmojis[data.Severity], Color: severityColors[data.Severity], Tag: data.Tag, DeviceID: event.DeviceID, DeviceName: event.DeviceName}
+	for _, change := range event.Changes {
+		line := change.Message()
+		if change.Field == events.FieldMode {
+			line = fmt.Sprintf("Mode %s → %s", change.OldValue, change.NewValue)
+		}
+		message.Lines = append(message.Lines, line)
+	}
+	if event.Escalation > 0 {
+		message.Lines = append(message.Lines, fmt.Sprintf("Escalation level %d", event.Escalation))
+	}
+	if acknowledgement := event.Acknowledgement; acknowledgement != nil {
+		line := fmt.Sprintf("Acknowledged by %s at %s", acknowledgement.By, acknowledgement.At.Format("2006-01-02 15:04:05 MST"))
+		if acknowledgement.Comment != "" {
+			line += ": " + acknowledgement.Comment
+		}
+		message.Lines = append(message.Lines, line)
+	}
+	return message
+}
+
+// Title returns the message headline, e.g. "🚨 [FIRING] Home Alarm"
+func (message ChatMessage) Title() string {
+	return fmt.Sprintf("%s [%s] %s", message.Emoji, message.Tag, message.DeviceName)
+}
+
+// Text returns the message as plain text
+func (message ChatMessage) Text() string {
+	return message.Title() + "\n" + strings.Join(message.Lines, "\n")
+}
+
+// sendJSON sends body encoded as JSON and decodes response into result when
+// set, non 2xx responses are errors. Request URLs are left out of errors as
+// they can hold credentials.
+func sendJSON(ctx context.Context, client *http.Client, method string, requestURL string, headers map[string]string, body interface{}, result interface{}) error {
+	encoded, encodeErr := json.Marshal(body)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	request, requestErr := http.NewRequestWithContext(ctx, method, requestURL, bytes.NewReader(encoded))
+	if requestErr != nil {
+		return requestErr
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	response, responseErr := client.Do(request)
+	if responseErr != nil {
+		if urlErr, ok := responseErr.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return responseErr
+	}
+	defer response.Body.Close()
+	responseBody, readErr := io.ReadAll(io.LimitReader(response.Body, 1<<16))
+	if readErr != nil {
+		return readErr
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Request failed with status %d: %s", response.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+	if result != nil {
+		return json.Unmarshal(responseBody, result)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package notifier
+
+import (
+	"testing"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+func TestChatMessageFormatsChanges(t *testing.T) {
+
+	now := time.Date(2022, 6, 1, 10, 30, 0, 0, time.UTC)
+	event := Event{DeviceID: "ab123", DeviceName: "Home Alarm", Escalation: 2, Changes: []events.ChangeEvent{
+		events.New("ab123", "Home Alarm", events.FieldMode, "disarmed", "armed_away", now),
+		events.New("ab123", "Home Alarm", events.FieldFiring, "false", "true", now),
+	}}
+	event.Acknowledgement = &events.Acknowledgement{DeviceID: "ab123", By: "alice", At: now, Comment: "on my way"}
+
+	message := NewChatMessage(event)
+	if message.Title() != "🚨 [FIRING] Home Alarm" {
+		t.Errorf("Chat title should be '🚨 [FIRING] Home Alarm', not '%s'.", message.Title())
+	}
+	if message.Color != "#d32f2f" {
+		t.Errorf("Critical events should use red colour, not '%s'.", message.Color)
+	}
+	expected := []string{"Mode disarmed → armed_away", "Started Firing", "Escalation level 2", "Acknowledged by alice at 2022-06-01 10:30:00 UTC: on my way"}
+	if len(message.Lines) != len(expected) {
+		t.Fatalf("Chat message should have %d lines, not %d: %v.", len(expected), len(message.Lines), message.Lines)
+	}
+	for index, line := range expected {
+		if message.Lines[index] != line {
+			t.Errorf("Chat line %d should be '%s', not '%s'.", index, line, message.Lines[index])
+		}
+	}
+}
+
+func TestChatMessageSeverityEmoji(t *testing.T) {
+
+	offline := Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldOnline, "true", "false", time.Now())}}
+	if title := NewChatMessage(offline).Title(); title != "⚠️ [OFFLINE] Home Alarm" {
+		t.Errorf("Offline title should be '⚠️ [OFFLINE] Home Alarm', not '%s'.", title)
+	}
+	offline.Summary = true
+	if title := NewChatMessage(offline).Title(); title != "⚠️ [SUMMARY] Home Alarm" {
+		t.Errorf("Summary title should be '⚠️ [SUMMARY] Home Alarm', not '%s'.", title)
+	}
+	online := Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldOnline, "false", "true", time.Now())}}
+	if message := NewChatMessage(online); message.Emoji != "ℹ️" || message.Color != "#2e7d32" {
+		t.Errorf("Info events should use info emoji and green colour, got '%s' and '%s'.", message.Emoji, message.Color)
+	}
+}
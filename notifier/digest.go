@@ -0,0 +1,227 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	htmltemplate "html/template"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+// DefaultDigestSubjectTemplate renders subjects like "[DIGEST] 3 changes on 2 devices"
+const DefaultDigestSubjectTemplate = `[DIGEST] {{len .Changes}} changes on {{.Devices}} devices`
+
+// DefaultDigestTextTemplate is the plain text body of digest emails
+const DefaultDigestTextTemplate = `{{len .Changes}} changes on {{.Devices}} devices
+{{range .Changes}}
+{{.Timestamp.Format "2006-01-02 15:04:05 MST"}} - {{.DeviceName}} - {{.Message}}{{if .OldValue}} ({{.OldValue}} -> {{.NewValue}}){{end}}{{end}}
+`
+
+// DefaultDigestHTMLTemplate is the HTML body of digest emails
+const DefaultDigestHTMLTemplate = `<!DOCTYPE html>
+<html>
+<body>
+<h2>{{len .Changes}} changes on {{.Devices}} devices</h2>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Time</th><th>Device</th><th>Change</th><th>Old</th><th>New</th></tr>
+{{range .Changes}}<tr><td>{{.Timestamp.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.DeviceName}}</td><td>{{.Message}}</td><td>{{.OldValue}}</td><td>{{.NewValue}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`
+
+// DigestData holds the values available to digest templates
+type DigestData struct {
+	Severity events.Severity
+	Devices  int
+	Changes  []MailChange
+}
+
+// DigestNotifier groups mail events received within Window in a single
+// email per recipient set, events with a Bypass severity are sent right away
+type DigestNotifier struct {
+	Mail      MailNotifier
+	Window    time.Duration
+	Bypass    map[events.Severity]bool
+	Templates MailTemplates
+	// SendTimeout limits how long sending a digest can take
+	SendTimeout time.Duration
+
+	mutex   sync.Mutex
+	pending []Event
+	timer   *time.Timer
+}
+
+// NewDigestNotifier returns a DigestNotifier sending digests through mailNotifier
+func NewDigestNotifier(mailNotifier MailNotifier) *DigestNotifier {
+	digest := mailNotifier.Config.Digest
+	digestNotifier := &DigestNotifier{
+		Mail:        mailNotifier,
+		Window:      digest.Window,
+		Bypass:      make(map[events.Severity]bool),
+		SendTimeout: time.Second * 30,
+		Templates: MailTemplates{
+			Subject: template.Must(template.New("subject").Parse(DefaultDigestSubjectTemplate)),
+			Text:    template.Must(template.New("text").Parse(DefaultDigestTextTemplate)),
+			HTML:    htmltemplate.Must(htmltemplate.New("html").Parse(DefaultDigestHTMLTemplate)),
+		},
+	}
+	for _, severity := range digest.Bypass {
+		digestNotifier.Bypass[events.Severity(severity)] = true
+	}
+	return digestNotifier
+}
+
+// Name returns notifier name, digests replace the mail notifier
+func (digestNotifier *DigestNotifier) Name() string {
+	return digestNotifier.Mail.Name()
+}
+
+// Send mails bypass events immediately and queues the others until the
+// current window ends
+func (digestNotifier *DigestNotifier) Send(ctx context.Context, event Event) error {
+	if digestNotifier.Bypass[event.Severity()] {
+		return digestNotifier.Mail.Send(ctx, event)
+	}
+	digestNotifier.mutex.Lock()
+	defer digestNotifier.mutex.Unlock()
+	digestNotifier.pending = append(digestNotifier.pending, event)
+	digestNotifier.schedule()
+	return nil
+}
+
+// schedule starts the window timer unless it is already running, mutex must
+// be held
+func (digestNotifier *DigestNotifier) schedule() {
+	if digestNotifier.timer != nil {
+		return
+	}
+	digestNotifier.timer = time.AfterFunc(digestNotifier.Window, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), digestNotifier.SendTimeout)
+		defer cancel()
+		if flushErr := digestNotifier.Flush(ctx); flushErr != nil {
+			log.Printf("Failed to send mail digest, it will be retried in next window: %s", flushErr.Error())
+		}
+	})
+}
+
+// Pending returns how many events are waiting for the digest
+func (digestNotifier *DigestNotifier) Pending() int {
+	digestNotifier.mutex.Lock()
+	defer digestNotifier.mutex.Unlock()
+	return len(digestNotifier.pending)
+}
+
+// Flush sends queued events as digest emails, one per recipient set so rule
+// recipients only get events routed to them. Events of digests failing to be
+// sent are put back to be retried in next window.
+func (digestNotifier *DigestNotifier) Flush(ctx context.Context) error {
+	digestNotifier.mutex.Lock()
+	pending := digestNotifier.pending
+	digestNotifier.pending = nil
+	if digestNotifier.timer != nil {
+		digestNotifier.timer.Stop()
+		digestNotifier.timer = nil
+	}
+	digestNotifier.mutex.Unlock()
+
+	var failures []string
+	var failed []Event
+	for _, group := range groupByRecipients(pending) {
+		subject, text, html, renderErr := digestNotifier.Templates.Render(NewDigestData(group.events))
+		if renderErr != nil {
+			failures = append(failures, renderErr.Error())
+			failed = append(failed, group.events...)
+			continue
+		}
+		if deliverErr := digestNotifier.Mail.deliver(ctx, subject, text, html, group.recipients); deliverErr != nil {
+			failures = append(failures, deliverErr.Error())
+			failed = append(failed, group.events...)
+		}
+	}
+	if len(failures) > 0 {
+		digestNotifier.requeue(failed)
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// requeue puts failed events back before events received meanwhile and
+// starts a new window
+func (digestNotifier *DigestNotifier) requeue(failed []Event) {
+	digestNotifier.mutex.Lock()
+	defer digestNotifier.mutex.Unlock()
+	digestNotifier.pending = append(failed, digestNotifier.pending...)
+	digestNotifier.schedule()
+}
+
+// digestGroup holds pending events sharing the same recipients
+type digestGroup struct {
+	recipients []string
+	events     []Event
+}
+
+// groupByRecipients splits pending events by their sorted, deduplicated
+// recipients keeping the order in which recipient sets were first seen
+func groupByRecipients(pending []Event) []*digestGroup {
+	var groups []*digestGroup
+	byKey := make(map[string]*digestGroup)
+	for _, event := range pending {
+		recipients := make([]string, 0, len(event.Recipients))
+		seen := make(map[string]bool)
+		for _, recipient := range event.Recipients {
+			if !seen[recipient] {
+				seen[recipient] = true
+				recipients = append(recipients, recipient)
+			}
+		}
+		sort.Strings(recipients)
+		key := strings.Join(recipients, "\n")
+		group, found := byKey[key]
+		if !found {
+			group = &digestGroup{recipients: recipients}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.events = append(group.events, event)
+	}
+	return groups
+}
+
+// Close sends events still waiting for the digest, events failing to be sent
+// are kept but no new window is started
+func (digestNotifier *DigestNotifier) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), digestNotifier.SendTimeout)
+	defer cancel()
+	flushErr := digestNotifier.Flush(ctx)
+	digestNotifier.mutex.Lock()
+	defer digestNotifier.mutex.Unlock()
+	if digestNotifier.timer != nil {
+		digestNotifier.timer.Stop()
+		digestNotifier.timer = nil
+	}
+	return flushErr
+}
+
+// NewDigestData returns template values of pending events
+func NewDigestData(pending []Event) DigestData {
+	data := DigestData{Severity: events.SeverityInfo}
+	devices := make(map[string]bool)
+	changes := make([]events.ChangeEvent, 0)
+	for _, event := range pending {
+		devices[event.DeviceID] = true
+		changes = append(changes, event.Changes...)
+		for _, change := range event.Changes {
+			data.Changes = append(data.Changes, MailChange{ChangeEvent: change, Message: change.Message()})
+		}
+	}
+	data.Devices = len(devices)
+	data.Severity = events.MaxSeverity(changes)
+	return data
+}
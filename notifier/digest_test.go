@@ -0,0 +1,139 @@
+package notifier
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+func newTestDigestNotifier(t *testing.T, window time.Duration) (*DigestNotifier, *FakeSMTPServer) {
+	server := NewFakeSMTPServer(t, &FakeSMTPServer{Username: "alarms", Password: "secret"})
+	mailServer := config_reader.MailServer{MailFrom: "alarms", MailDomain: "example.com", SMTPHost: "127.0.0.1", SMTPPort: server.Port(), SMTPName: "alarms", SMTPPassword: "secret", Mode: config_reader.MailModePlain, Auth: config_reader.MailAuthPlain,
+		To:     []string{"owner@example.com"},
+		Digest: config_reader.MailDigest{Enabled: true, Window: window, Bypass: []string{"critical"}},
+	}
+	mailNotifier, err := NewMailNotifier(mailServer)
+	if err != nil {
+		t.Fatalf("NewMailNotifier should not fail, error was '%s'.", err.Error())
+	}
+	return NewDigestNotifier(mailNotifier), server
+}
+
+func TestDigestGroupsEvents(t *testing.T) {
+
+	digestNotifier, server := newTestDigestNotifier(t, time.Hour)
+	now := time.Now()
+	digestNotifier.Send(context.TODO(), Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldMode, "armed", "disarmed", now)}})
+	digestNotifier.Send(context.TODO(), Event{DeviceID: "cd456", DeviceName: "Garage", Changes: []events.ChangeEvent{events.New("cd456", "Garage", events.FieldOnline, "true", "false", now), events.New("cd456", "Garage", events.FieldName, "", "Garage", now)}})
+
+	if len(server.Mails()) != 0 {
+		t.Errorf("No mail should be sent before digest window ends.")
+	}
+	if digestNotifier.Pending() != 2 {
+		t.Errorf("Digest should hold 2 events, not %d.", digestNotifier.Pending())
+	}
+	if err := digestNotifier.Close(); err != nil {
+		t.Fatalf("Close should send the digest, error was '%s'.", err.Error())
+	}
+
+	mails := server.Mails()
+	if len(mails) != 1 {
+		t.Fatalf("One digest mail should be sent, not %d.", len(mails))
+	}
+	if !strings.Contains(mails[0].Data, "Subject: [DIGEST] 3 changes on 2 devices") {
+		t.Errorf("Unexpected digest mail '%s'.", mails[0].Data)
+	}
+	if !strings.Contains(mails[0].Data, "<td>Garage</td><td>Became Offline</td>") {
+		t.Errorf("Digest should contain a changes table, mail was '%s'.", mails[0].Data)
+	}
+	if digestNotifier.Pending() != 0 {
+		t.Errorf("Digest should be empty once sent.")
+	}
+}
+
+func TestDigestIsSentPerRecipientSet(t *testing.T) {
+
+	digestNotifier, server := newTestDigestNotifier(t, time.Hour)
+	now := time.Now()
+	digestNotifier.Send(context.TODO(), Event{DeviceID: "ab123", DeviceName: "Home Alarm", Recipients: []string{"alice@example.com"}, Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldMode, "armed", "disarmed", now)}})
+	digestNotifier.Send(context.TODO(), Event{DeviceID: "cd456", DeviceName: "Garage", Recipients: []string{"bob@example.com"}, Changes: []events.ChangeEvent{events.New("cd456", "Garage", events.FieldOnline, "true", "false", now)}})
+	digestNotifier.Send(context.TODO(), Event{DeviceID: "ab123", DeviceName: "Home Alarm", Recipients: []string{"alice@example.com", "alice@example.com"}, Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldMode, "disarmed", "armed", now)}})
+	if err := digestNotifier.Close(); err != nil {
+		t.Fatalf("Close should send the digests, error was '%s'.", err.Error())
+	}
+
+	mails := server.Mails()
+	if len(mails) != 2 {
+		t.Fatalf("One digest per recipient set should be sent, %d were sent.", len(mails))
+	}
+	if strings.Join(mails[0].Recipients, ",") != "owner@example.com,alice@example.com" || !strings.Contains(mails[0].Data, "Subject: [DIGEST] 2 changes on 1 devices") || strings.Contains(mails[0].Data, "Garage") {
+		t.Errorf("First digest should only hold Home Alarm changes for alice, mail was %+v.", mails[0])
+	}
+	if strings.Join(mails[1].Recipients, ",") != "owner@example.com,bob@example.com" || !strings.Contains(mails[1].Data, "Subject: [DIGEST] 1 changes on 1 devices") || strings.Contains(mails[1].Data, "Home Alarm") {
+		t.Errorf("Second digest should only hold Garage changes for bob, mail was %+v.", mails[1])
+	}
+}
+
+func TestDigestCriticalEventsBypassWindow(t *testing.T) {
+
+	digestNotifier, server := newTestDigestNotifier(t, time.Hour)
+	defer digestNotifier.Close()
+	event := Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldFiring, "false", "true", time.Now())}}
+	if err := digestNotifier.Send(context.TODO(), event); err != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", err.Error())
+	}
+	mails := server.Mails()
+	if len(mails) != 1 || !strings.Contains(mails[0].Data, "Subject: [FIRING] Home Alarm") {
+		t.Errorf("Critical events should be mailed immediately, mails were %+v.", mails)
+	}
+	if digestNotifier.Pending() != 0 {
+		t.Errorf("Critical events should not be queued.")
+	}
+}
+
+func TestDigestIsSentWhenWindowEnds(t *testing.T) {
+
+	digestNotifier, server := newTestDigestNotifier(t, time.Millisecond*20)
+	digestNotifier.Send(context.TODO(), Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldMode, "armed", "disarmed", time.Now())}})
+
+	deadline := time.Now().Add(time.Second * 2)
+	for len(server.Mails()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if len(server.Mails()) != 1 {
+		t.Errorf("Digest should be sent once window ends.")
+	}
+}
+
+func TestDigestKeepsEventsWhenSendingFails(t *testing.T) {
+
+	digestNotifier, server := newTestDigestNotifier(t, time.Hour)
+	sender := digestNotifier.Mail.Sender
+	digestNotifier.Mail.Sender.Config.SMTPPassword = "wrong"
+	now := time.Now()
+	digestNotifier.Send(context.TODO(), Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldMode, "armed", "disarmed", now)}})
+
+	if err := digestNotifier.Flush(context.TODO()); err == nil {
+		t.Fatalf("Flush should fail when mail server rejects the digest.")
+	}
+	if digestNotifier.Pending() != 1 {
+		t.Errorf("Digest should keep 1 event after failing to send it, not %d.", digestNotifier.Pending())
+	}
+
+	digestNotifier.Send(context.TODO(), Event{DeviceID: "cd456", DeviceName: "Garage", Changes: []events.ChangeEvent{events.New("cd456", "Garage", events.FieldOnline, "true", "false", now)}})
+	digestNotifier.Mail.Sender = sender
+	if err := digestNotifier.Close(); err != nil {
+		t.Fatalf("Close should send the digest, error was '%s'.", err.Error())
+	}
+	mails := server.Mails()
+	if len(mails) != 1 || !strings.Contains(mails[0].Data, "Subject: [DIGEST] 2 changes on 2 devices") {
+		t.Fatalf("Kept and new events should be sent in one digest, mails were %+v.", mails)
+	}
+	if strings.Index(mails[0].Data, "Home Alarm") > strings.Index(mails[0].Data, "Garage") {
+		t.Errorf("Kept events should be sent before new ones, mail was '%s'.", mails[0].Data)
+	}
+}
@@ -0,0 +1,173 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// homeAssistantStates are the alarm_control_panel states Home Assistant accepts
+var homeAssistantStates = map[string]bool{
+	"disarmed":            true,
+	"armed_home":          true,
+	"armed_away":          true,
+	"armed_night":         true,
+	"armed_vacation":      true,
+	"armed_custom_bypass": true,
+	"pending":             true,
+	"arming":              true,
+	"disarming":           true,
+	"triggered":           true,
+}
+
+var discoveryIDReplacer = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// HomeAssistantState returns the alarm_control_panel state of a device.
+// Firing devices are triggered and plain armed mode is reported as
+// armed_away. Empty is returned for modes unknown to Home Assistant as it
+// rejects states outside its fixed set.
+func HomeAssistantState(state DeviceState) string {
+	if state.Firing {
+		return "triggered"
+	}
+	mode := strings.ToLower(state.Mode)
+	if homeAssistantStates[mode] {
+		return mode
+	}
+	if mode == "armed" {
+		return "armed_away"
+	}
+	return ""
+}
+
+type homeAssistantAvailability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+}
+
+type homeAssistantDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// homeAssistantConfig is the discovery payload of a single entity
+type homeAssistantConfig struct {
+	Name             string                      `json:"name"`
+	UniqueID         string                      `json:"unique_id"`
+	StateTopic       string                      `json:"state_topic"`
+	CommandTopic     string                      `json:"command_topic,omitempty"`
+	PayloadOn        string                      `json:"payload_on,omitempty"`
+	PayloadOff       string                      `json:"payload_off,omitempty"`
+	DeviceClass      string                      `json:"device_class,omitempty"`
+	Availability     []homeAssistantAvailability `json:"availability"`
+	AvailabilityMode string                      `json:"availability_mode,omitempty"`
+	Device           homeAssistantDevice         `json:"device"`
+}
+
+func discoveryID(value string) string {
+	return discoveryIDReplacer.ReplaceAllString(value, "_")
+}
+
+// DiscoveryTopic returns the Home Assistant discovery config topic of
+// component objectID, client id is used as node id so several watchers can
+// share a broker
+func (mqttNotifier *MQTTNotifier) DiscoveryTopic(component string, objectID string) string {
+	return mqttNotifier.Config.DiscoveryPrefix + "/" + component + "/" + discoveryID(mqttNotifier.Config.ClientID) + "/" + objectID + "/config"
+}
+
+// discoveryConfigs returns the discovery configs of device entities by topic,
+// an alarm_control_panel and binary_sensor entities for online and firing
+func (mqttNotifier *MQTTNotifier) discoveryConfigs(state DeviceState) map[string]homeAssistantConfig {
+	objectID := discoveryID(state.DeviceID)
+	uniqueID := discoveryID(mqttNotifier.Config.ClientID) + "_" + objectID
+	watcherAvailability := homeAssistantAvailability{Topic: mqttNotifier.StatusTopic(), PayloadAvailable: MQTTStatusOnline, PayloadNotAvailable: MQTTStatusOffline}
+	deviceAvailability := []homeAssistantAvailability{watcherAvailability, {Topic: mqttNotifier.DeviceTopic(state.DeviceID, "online"), PayloadAvailable: "true", PayloadNotAvailable: "false"}}
+	device := homeAssistantDevice{Identifiers: []string{uniqueID}, Name: state.DeviceName, Manufacturer: "AlarmManager"}
+	return map[string]homeAssistantConfig{
+		mqttNotifier.DiscoveryTopic("alarm_control_panel", objectID): {
+			Name:       state.DeviceName,
+			UniqueID:   uniqueID,
+			StateTopic: mqttNotifier.DeviceTopic(state.DeviceID, "alarm"),
+			// Home Assistant requires a command topic, commands sent to it are ignored
+			CommandTopic:     mqttNotifier.DeviceTopic(state.DeviceID, "command"),
+			Availability:     deviceAvailability,
+			AvailabilityMode: "all",
+			Device:           device,
+		},
+		mqttNotifier.DiscoveryTopic("binary_sensor", objectID+"_online"): {
+			Name:         state.DeviceName + " Online",
+			UniqueID:     uniqueID + "_online",
+			StateTopic:   mqttNotifier.DeviceTopic(state.DeviceID, "online"),
+			PayloadOn:    "true",
+			PayloadOff:   "false",
+			DeviceClass:  "connectivity",
+			Availability: []homeAssistantAvailability{watcherAvailability},
+			Device:       device,
+		},
+		mqttNotifier.DiscoveryTopic("binary_sensor", objectID+"_firing"): {
+			Name:             state.DeviceName + " Firing",
+			UniqueID:         uniqueID + "_firing",
+			StateTopic:       mqttNotifier.DeviceTopic(state.DeviceID, "firing"),
+			PayloadOn:        "true",
+			PayloadOff:       "false",
+			DeviceClass:      "safety",
+			Availability:     deviceAvailability,
+			AvailabilityMode: "all",
+			Device:           device,
+		},
+	}
+}
+
+// publishDiscovery publishes discovery configs of new and renamed devices and
+// removes configs of removed devices, removals failing are retried on next
+// call. Devices missing from states keep their configs. Mutex must be held.
+func (mqttNotifier *MQTTNotifier) publishDiscovery(ctx context.Context, states []DeviceState) []string {
+	var failures []string
+	listed := make(map[string]bool)
+	for _, state := range states {
+		if state.Removed {
+			mqttNotifier.removing[state.DeviceID] = state
+			continue
+		}
+		listed[state.DeviceID] = true
+		delete(mqttNotifier.removing, state.DeviceID)
+		if name, found := mqttNotifier.discovered[state.DeviceID]; found && name == state.DeviceName {
+			continue
+		}
+		published := true
+		for topic, config := range mqttNotifier.discoveryConfigs(state) {
+			payload, _ := json.Marshal(config)
+			if publishErr := mqttNotifier.publish(ctx, topic, payload, true); publishErr != nil {
+				failures = append(failures, fmt.Sprintf("%s discovery: %s", state.DeviceID, publishErr.Error()))
+				published = false
+				break
+			}
+		}
+		if published {
+			mqttNotifier.discovered[state.DeviceID] = state.DeviceName
+		}
+	}
+	for deviceID := range mqttNotifier.discovered {
+		if !listed[deviceID] {
+			delete(mqttNotifier.discovered, deviceID)
+		}
+	}
+
+	for deviceID, state := range mqttNotifier.removing {
+		removed := true
+		for topic := range mqttNotifier.discoveryConfigs(state) {
+			if publishErr := mqttNotifier.publish(ctx, topic, []byte{}, true); publishErr != nil {
+				failures = append(failures, fmt.Sprintf("removing %s: %s", topic, publishErr.Error()))
+				removed = false
+			}
+		}
+		if removed {
+			delete(mqttNotifier.removing, deviceID)
+		}
+	}
+	return failures
+}
@@ -0,0 +1,96 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+// MailNotifier sends events by email
+type MailNotifier struct {
+	Config    config_reader.MailServer
+	Sender    SMTPSender
+	Templates MailTemplates
+}
+
+// NewMailNotifier returns a MailNotifier using configured SMTP server and templates
+func NewMailNotifier(config config_reader.MailServer) (MailNotifier, error) {
+	mailNotifier := MailNotifier{Config: config}
+	var err error
+	if mailNotifier.Sender, err = NewSMTPSender(config); err != nil {
+		return mailNotifier, err
+	}
+	mailNotifier.Templates, err = NewMailTemplates(config)
+	return mailNotifier, err
+}
+
+// Name returns notifier name
+func (mailNotifier MailNotifier) Name() string {
+	return "mail"
+}
+
+// Send sends event by email through configured SMTP server
+func (mailNotifier MailNotifier) Send(ctx context.Context, event Event) error {
+	subject, text, html, renderErr := mailNotifier.Templates.Render(NewMailData(event))
+	if renderErr != nil {
+		return renderErr
+	}
+	return mailNotifier.deliver(ctx, subject, text, html, event.Recipients)
+}
+
+// deliver composes and sends an email to configured recipients plus extra
+// ones, Bcc recipients are only added to the envelope
+func (mailNotifier MailNotifier) deliver(ctx context.Context, subject string, text string, html string, extra []string) error {
+	config := mailNotifier.Config
+
+	from := &mail.Address{Name: "", Address: fmt.Sprintf("%s@%s", config.MailFrom, config.MailDomain)}
+	to, toErr := parseAddresses(append(append([]string{}, config.To...), extra...))
+	if toErr != nil {
+		return toErr
+	}
+	cc, ccErr := parseAddresses(config.Cc)
+	if ccErr != nil {
+		return ccErr
+	}
+	bcc, bccErr := parseAddresses(config.Bcc)
+	if bccErr != nil {
+		return bccErr
+	}
+
+	message, composeErr := MailMessage{From: from, To: to, Cc: cc, Subject: subject, Text: text, HTML: html, Date: time.Now()}.Compose(config.MailDomain)
+	if composeErr != nil {
+		return composeErr
+	}
+
+	recipients := make([]string, 0, len(to)+len(cc)+len(bcc))
+	for _, addresses := range [][]*mail.Address{to, cc, bcc} {
+		for _, address := range addresses {
+			recipients = append(recipients, address.Address)
+		}
+	}
+	return mailNotifier.Sender.Send(ctx, from.Address, recipients, message)
+}
+
+func parseAddresses(values []string) ([]*mail.Address, error) {
+	addresses := make([]*mail.Address, 0, len(values))
+	for _, value := range values {
+		address, parseErr := mail.ParseAddress(value)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+func joinAddresses(addresses []*mail.Address) string {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		formatted = append(formatted, address.String())
+	}
+	return strings.Join(formatted, ", ")
+}
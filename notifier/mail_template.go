@@ -0,0 +1,230 @@
+package notifier
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+// DefaultSubjectTemplate renders subjects like "[FIRING] Home Alarm"
+const DefaultSubjectTemplate = `[{{.Tag}}] {{.DeviceName}}`
+
+// DefaultTextTemplate is the plain text body of event emails
+const DefaultTextTemplate = `{{.DeviceName}} ({{.DeviceID}})
+{{range .Changes}}
+{{.Timestamp.Format "2006-01-02 15:04:05 MST"}} - {{.Message}}{{if .OldValue}} ({{.OldValue}} -> {{.NewValue}}){{end}}{{end}}
+{{with .Acknowledgement}}
+Acknowledged by {{.By}} at {{.At.Format "2006-01-02 15:04:05 MST"}}{{if .Comment}}: {{.Comment}}{{end}}
+{{end}}`
+
+// DefaultHTMLTemplate is the HTML body of event emails
+const DefaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<body>
+<h2>{{.DeviceName}}</h2>
+<p>Device {{.DeviceID}}, severity {{.Severity}}</p>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Time</th><th>Change</th><th>Old</th><th>New</th></tr>
+{{range .Changes}}<tr><td>{{.Timestamp.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Message}}</td><td>{{.OldValue}}</td><td>{{.NewValue}}</td></tr>
+{{end}}</table>
+{{with .Acknowledgement}}<p>Acknowledged by {{.By}} at {{.At.Format "2006-01-02 15:04:05 MST"}}{{if .Comment}}: {{.Comment}}{{end}}</p>
+{{end}}</body>
+</html>
+`
+
+// MailChange is a change as seen by mail templates
+type MailChange struct {
+	events.ChangeEvent
+	Message string
+}
+
+// MailData holds the values available to mail templates
+type MailData struct {
+	DeviceID   string
+	DeviceName string
+	// Tag summarizes what happened, e.g. FIRING or OFFLINE
+	Tag      string
+	Severity events.Severity
+	Message  string
+	Changes  []MailChange
+	// Acknowledgement is set while device firing is acknowledged
+	Acknowledgement *events.Acknowledgement
+}
+
+// MailTemplates renders subject and bodies of emails
+type MailTemplates struct {
+	Subject *template.Template
+	Text    *template.Template
+	HTML    *htmltemplate.Template
+}
+
+var mailTags = map[events.Type]string{
+	events.TypeRenamed:       "RENAMED",
+	events.TypeModeChanged:   "MODE",
+	events.TypeFiringStarted: "FIRING",
+	events.TypeFiringStopped: "RESOLVED",
+	events.TypeStillFiring:   "STILL FIRING",
+	events.TypeOnline:        "ONLINE",
+	events.TypeOffline:       "OFFLINE",
+	events.TypeAvailable:     "AVAILABLE",
+	events.TypeUnavailable:   "UNAVAILABLE",
+	events.TypeRecovered:     "RECOVERED",
+	events.TypeUnreachable:   "UNREACHABLE",
+	events.TypeFlapping:      "FLAPPING",
+	events.TypeSettled:       "SETTLED",
+}
+
+// NewMailTemplates parses configured templates falling back to default ones
+func NewMailTemplates(config config_reader.MailServer) (MailTemplates, error) {
+	var mailTemplates MailTemplates
+	var err error
+
+	subject := config.SubjectTemplate
+	if subject == "" {
+		subject = DefaultSubjectTemplate
+	}
+	if mailTemplates.Subject, err = template.New("subject").Parse(subject); err != nil {
+		return mailTemplates, err
+	}
+
+	text, textErr := templateSource(config.TextTemplateFile, DefaultTextTemplate)
+	if textErr != nil {
+		return mailTemplates, textErr
+	}
+	if mailTemplates.Text, err = template.New("text").Parse(text); err != nil {
+		return mailTemplates, err
+	}
+
+	html, htmlErr := templateSource(config.HTMLTemplateFile, DefaultHTMLTemplate)
+	if htmlErr != nil {
+		return mailTemplates, htmlErr
+	}
+	if mailTemplates.HTML, err = htmltemplate.New("html").Parse(html); err != nil {
+		return mailTemplates, err
+	}
+	return mailTemplates, nil
+}
+
+func templateSource(file string, defaultSource string) (string, error) {
+	if file == "" {
+		return defaultSource, nil
+	}
+	source, readErr := os.ReadFile(file)
+	return string(source), readErr
+}
+
+// NewMailData returns template values of event
+func NewMailData(event Event) MailData {
+	data := MailData{DeviceID: event.DeviceID, DeviceName: event.DeviceName, Severity: event.Severity(), Message: event.Message(), Tag: mailTags[event.Type()], Acknowledgement: event.Acknowledgement}
+	if data.Tag == "" {
+		data.Tag = strings.ToUpper(string(event.Type()))
+	}
+	if event.Summary {
+		data.Tag = "SUMMARY"
+	}
+	for _, change := range event.Changes {
+		data.Changes = append(data.Changes, MailChange{ChangeEvent: change, Message: change.Message()})
+	}
+	return data
+}
+
+// Render returns subject, text and HTML bodies for data
+func (mailTemplates MailTemplates) Render(data interface{}) (string, string, string, error) {
+	var subject, text, html bytes.Buffer
+	if err := mailTemplates.Subject.Execute(&subject, data); err != nil {
+		return "", "", "", err
+	}
+	if err := mailTemplates.Text.Execute(&text, data); err != nil {
+		return "", "", "", err
+	}
+	if err := mailTemplates.HTML.Execute(&html, data); err != nil {
+		return "", "", "", err
+	}
+	// Subjects are a single header line
+	return strings.Join(strings.Fields(subject.String()), " "), text.String(), html.String(), nil
+}
+
+// MailMessage is an email ready to be composed
+type MailMessage struct {
+	From    *mail.Address
+	To      []*mail.Address
+	Cc      []*mail.Address
+	Subject string
+	Text    string
+	HTML    string
+	Date    time.Time
+}
+
+// Compose returns the RFC 5322 message with a multipart/alternative body,
+// domain is used to build Message-ID
+func (message MailMessage) Compose(domain string) ([]byte, error) {
+	var buffer bytes.Buffer
+	body := multipart.NewWriter(&buffer)
+
+	headers := [][]string{
+		{"From", message.From.String()},
+	}
+	if len(message.To) > 0 {
+		headers = append(headers, []string{"To", joinAddresses(message.To)})
+	}
+	if len(message.Cc) > 0 {
+		headers = append(headers, []string{"Cc", joinAddresses(message.Cc)})
+	}
+	headers = append(headers,
+		[]string{"Subject", mime.QEncoding.Encode("utf-8", message.Subject)},
+		[]string{"Date", message.Date.Format(time.RFC1123Z)},
+		[]string{"Message-ID", messageID(message.Date, domain)},
+		[]string{"MIME-Version", "1.0"},
+		[]string{"Content-Type", "multipart/alternative; boundary=\"" + body.Boundary() + "\""},
+	)
+	for _, header := range headers {
+		buffer.WriteString(header[0] + ": " + header[1] + "\r\n")
+	}
+	buffer.WriteString("\r\n")
+
+	parts := [][]string{{"text/plain; charset=utf-8", message.Text}, {"text/html; charset=utf-8", message.HTML}}
+	for _, part := range parts {
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Type", part[0])
+		partHeader.Set("Content-Transfer-Encoding", "quoted-printable")
+		partWriter, partErr := body.CreatePart(partHeader)
+		if partErr != nil {
+			return nil, partErr
+		}
+		if err := writeQuotedPrintable(partWriter, part[1]); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeQuotedPrintable(writer io.Writer, content string) error {
+	encoder := quotedprintable.NewWriter(writer)
+	if _, err := encoder.Write([]byte(content)); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func messageID(date time.Time, domain string) string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return "<" + date.UTC().Format("20060102150405") + "." + hex.EncodeToString(random) + "@" + domain + ">"
+}
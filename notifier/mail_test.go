@@ -0,0 +1,116 @@
+package notifier
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+func TestMailNotifierRecipients(t *testing.T) {
+
+	server := NewFakeSMTPServer(t, &FakeSMTPServer{Username: "alarms", Password: "secret"})
+	mailServer := config_reader.MailServer{MailFrom: "alarms", MailDomain: "example.com", SMTPHost: "127.0.0.1", SMTPPort: server.Port(), SMTPName: "alarms", SMTPPassword: "secret", Mode: config_reader.MailModePlain, Auth: config_reader.MailAuthPlain,
+		To:  []string{"Owner <owner@example.com>"},
+		Cc:  []string{"neighbour@example.com"},
+		Bcc: []string{"audit@example.com"},
+	}
+	mailNotifier, err := NewMailNotifier(mailServer)
+	if err != nil {
+		t.Fatalf("NewMailNotifier should not fail, error was '%s'.", err.Error())
+	}
+
+	event := Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldFiring, "false", "true", time.Now())}}
+	if err := mailNotifier.Send(context.TODO(), event); err != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", err.Error())
+	}
+
+	mails := server.Mails()
+	if len(mails) != 1 {
+		t.Fatalf("Server should receive one mail, not %d.", len(mails))
+	}
+	if strings.Join(mails[0].Recipients, ",") != "owner@example.com,neighbour@example.com,audit@example.com" {
+		t.Errorf("Mail should be sent to to, cc and bcc recipients, not %v.", mails[0].Recipients)
+	}
+	message, readErr := mail.ReadMessage(strings.NewReader(mails[0].Data))
+	if readErr != nil {
+		t.Fatalf("Mail should be a valid RFC 5322 message, error was '%s'.", readErr.Error())
+	}
+	if message.Header.Get("Cc") != "<neighbour@example.com>" || message.Header.Get("To") != `"Owner" <owner@example.com>` {
+		t.Errorf("Mail should contain To and Cc headers, headers were %v.", message.Header)
+	}
+	if message.Header.Get("Subject") != "[FIRING] Home Alarm" {
+		t.Errorf("Mail subject should be '[FIRING] Home Alarm', not '%s'.", message.Header.Get("Subject"))
+	}
+	if _, dateErr := message.Header.Date(); dateErr != nil {
+		t.Errorf("Mail should have a valid Date header, error was '%s'.", dateErr.Error())
+	}
+	if !strings.HasSuffix(message.Header.Get("Message-ID"), "@example.com>") || message.Header.Get("MIME-Version") != "1.0" {
+		t.Errorf("Mail should have Message-ID and MIME-Version headers, headers were %v.", message.Header)
+	}
+
+	mediaType, params, mediaErr := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if mediaErr != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Mail should be multipart/alternative, not '%s'.", message.Header.Get("Content-Type"))
+	}
+	parts := multipart.NewReader(message.Body, params["boundary"])
+	bodies := make(map[string]string)
+	for {
+		part, partErr := parts.NextPart()
+		if partErr != nil {
+			break
+		}
+		content, _ := io.ReadAll(part)
+		bodies[strings.Split(part.Header.Get("Content-Type"), ";")[0]] = string(content)
+	}
+	if !strings.Contains(bodies["text/plain"], "Started Firing (false -> true)") {
+		t.Errorf("Text body should describe the change, body was '%s'.", bodies["text/plain"])
+	}
+	if !strings.Contains(bodies["text/html"], "<td>Started Firing</td>") {
+		t.Errorf("HTML body should contain a changes table, body was '%s'.", bodies["text/html"])
+	}
+	if strings.Contains(mails[0].Data, "audit@example.com") {
+		t.Errorf("Bcc recipients should not appear in mail headers.")
+	}
+}
+
+func TestMailTemplates(t *testing.T) {
+
+	mailTemplates, err := NewMailTemplates(config_reader.MailServer{SubjectTemplate: "{{.Severity}}: {{.DeviceName}}\n{{.Message}}"})
+	if err != nil {
+		t.Fatalf("NewMailTemplates should not fail, error was '%s'.", err.Error())
+	}
+	event := Event{DeviceID: "cd456", DeviceName: "<Garage>", Changes: []events.ChangeEvent{events.New("cd456", "<Garage>", events.FieldOnline, "true", "false", time.Now())}}
+	subject, text, html, renderErr := mailTemplates.Render(NewMailData(event))
+	if renderErr != nil {
+		t.Fatalf("Render should not fail, error was '%s'.", renderErr.Error())
+	}
+	if subject != "warning: <Garage> Became Offline" {
+		t.Errorf("Subject should be rendered in a single line, not '%s'.", subject)
+	}
+	if !strings.HasPrefix(text, "<Garage> (cd456)") {
+		t.Errorf("Text body should not be escaped, body was '%s'.", text)
+	}
+	if !strings.Contains(html, "<h2>&lt;Garage&gt;</h2>") {
+		t.Errorf("HTML body should be escaped, body was '%s'.", html)
+	}
+	if NewMailData(event).Tag != "OFFLINE" {
+		t.Errorf("Offline events should be tagged OFFLINE, not '%s'.", NewMailData(event).Tag)
+	}
+	if strings.Contains(text, "Acknowledged") {
+		t.Errorf("Text body should not include acknowledgement when there is none, body was '%s'.", text)
+	}
+
+	event.Acknowledgement = &events.Acknowledgement{DeviceID: "cd456", By: "alice", At: time.Now(), Comment: "On my way"}
+	_, text, html, _ = mailTemplates.Render(NewMailData(event))
+	if !strings.Contains(text, "Acknowledged by alice at ") || !strings.Contains(text, ": On my way") || !strings.Contains(html, "Acknowledged by alice") {
+		t.Errorf("Bodies should include acknowledgement, text body was '%s'.", text)
+	}
+}
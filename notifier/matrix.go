@@ -0,0 +1,59 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+// MatrixMessage is an m.room.message event with HTML formatting
+type MatrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+// MatrixNotifier sends events to a room through the Matrix client-server API
+type MatrixNotifier struct {
+	Config config_reader.Matrix
+	Client *http.Client
+
+	transactions uint64
+}
+
+// NewMatrixNotifier returns a MatrixNotifier for config
+func NewMatrixNotifier(config config_reader.Matrix) *MatrixNotifier {
+	return &MatrixNotifier{Config: config, Client: &http.Client{Timeout: config.Timeout}}
+}
+
+// Name returns notifier name
+func (matrixNotifier *MatrixNotifier) Name() string {
+	return "matrix"
+}
+
+// NewMatrixMessage renders event as a text message, its HTML version shows
+// the title with the severity colour
+func NewMatrixMessage(event Event) MatrixMessage {
+	message := NewChatMessage(event)
+	lines := []string{fmt.Sprintf(`<font data-mx-color="%s"><b>%s</b></font>`, message.Color, html.EscapeString(message.Title())), "<code>" + html.EscapeString(message.DeviceID) + "</code>"}
+	for _, line := range message.Lines {
+		lines = append(lines, html.EscapeString(line))
+	}
+	return MatrixMessage{MsgType: "m.text", Body: message.Text(), Format: "org.matrix.custom.html", FormattedBody: strings.Join(lines, "<br>")}
+}
+
+// Send puts event in configured room, every request uses a new transaction id
+func (matrixNotifier *MatrixNotifier) Send(ctx context.Context, event Event) error {
+	transactionID := fmt.Sprintf("alarmstatuswatcher-%d-%d", time.Now().UnixNano(), atomic.AddUint64(&matrixNotifier.transactions, 1))
+	requestURL := matrixNotifier.Config.Homeserver + "/_matrix/client/v3/rooms/" + url.PathEscape(matrixNotifier.Config.RoomID) + "/send/m.room.message/" + transactionID
+	headers := map[string]string{"Authorization": "Bearer " + matrixNotifier.Config.Token}
+	return sendJSON(ctx, matrixNotifier.Client, http.MethodPut, requestURL, headers, NewMatrixMessage(event), nil)
+}
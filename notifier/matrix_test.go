@@ -0,0 +1,66 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+func TestMatrixSendsRoomMessage(t *testing.T) {
+
+	var paths []string
+	var authorization, method string
+	var message MatrixMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		method = r.Method
+		authorization = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&message)
+		w.Write([]byte(`{"event_id":"$event"}`))
+	}))
+	defer server.Close()
+
+	matrixNotifier := NewMatrixNotifier(config_reader.Matrix{Enabled: true, Homeserver: server.URL, Token: "syt_token", RoomID: "!alarms:example.com", Timeout: time.Second})
+	for i := 0; i < 2; i++ {
+		if err := matrixNotifier.Send(context.TODO(), webhookEvent()); err != nil {
+			t.Fatalf("Send should not fail, error was '%s'.", err.Error())
+		}
+	}
+	if method != http.MethodPut || authorization != "Bearer syt_token" {
+		t.Errorf("Matrix messages should be PUT with the access token, got %s with '%s'.", method, authorization)
+	}
+	prefix := "/_matrix/client/v3/rooms/%21alarms:example.com/send/m.room.message/"
+	if !strings.HasPrefix(paths[0], prefix) {
+		t.Errorf("Matrix request path should start with '%s', it was '%s'.", prefix, paths[0])
+	}
+	if paths[0] == paths[1] {
+		t.Errorf("Every message should use a new transaction id.")
+	}
+	if message.MsgType != "m.text" || message.Body != "🚨 [FIRING] Home Alarm\nStarted Firing" || message.Format != "org.matrix.custom.html" {
+		t.Errorf("Unexpected Matrix message %+v.", message)
+	}
+	if message.FormattedBody != `<font data-mx-color="#d32f2f"><b>🚨 [FIRING] Home Alarm</b></font><br><code>ab123</code><br>Started Firing` {
+		t.Errorf("Unexpected Matrix formatted body '%s'.", message.FormattedBody)
+	}
+}
+
+func TestMatrixForbidden(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"User not in room"}`))
+	}))
+	defer server.Close()
+
+	matrixNotifier := NewMatrixNotifier(config_reader.Matrix{Enabled: true, Homeserver: server.URL, Token: "syt_token", RoomID: "!alarms:example.com", Timeout: time.Second})
+	err := matrixNotifier.Send(context.TODO(), webhookEvent())
+	if err == nil || !strings.Contains(err.Error(), "M_FORBIDDEN") {
+		t.Errorf("Send should fail with Matrix error, error was '%v'.", err)
+	}
+}
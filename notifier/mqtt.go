@@ -0,0 +1,219 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Values retained on the watcher status topic, offline is also the last will
+const (
+	MQTTStatusOnline  = "online"
+	MQTTStatusOffline = "offline"
+)
+
+// MQTTNotifier publishes events and retained device state to an MQTT broker.
+// The client reconnects on its own, device state is published again after
+// every reconnection so retained topics survive broker restarts. When
+// discovery is enabled devices are announced to Home Assistant.
+type MQTTNotifier struct {
+	Config config_reader.MQTT
+	Client mqtt.Client
+
+	mutex      sync.Mutex
+	published  map[string]DeviceState
+	discovered map[string]string
+	// removing holds removed devices whose discovery configs are not removed yet
+	removing map[string]DeviceState
+}
+
+// NewMQTTNotifier returns a MQTTNotifier connected to configured broker, an
+// unreachable broker is not an error as connection is retried in background
+func NewMQTTNotifier(config config_reader.MQTT) (*MQTTNotifier, error) {
+	mqttNotifier := &MQTTNotifier{Config: config, published: make(map[string]DeviceState), discovered: make(map[string]string), removing: make(map[string]DeviceState)}
+	options, optionsErr := mqttNotifier.clientOptions()
+	if optionsErr != nil {
+		return nil, optionsErr
+	}
+	mqttNotifier.Client = mqtt.NewClient(options)
+	token := mqttNotifier.Client.Connect()
+	if !token.WaitTimeout(config.Timeout) {
+		log.Printf("MQTT broker %s is not reachable yet, connection will be retried.", options.Servers[0].Host)
+	} else if token.Error() != nil {
+		return nil, token.Error()
+	}
+	return mqttNotifier, nil
+}
+
+// Name returns notifier name
+func (mqttNotifier *MQTTNotifier) Name() string {
+	return "mqtt"
+}
+
+func (mqttNotifier *MQTTNotifier) clientOptions() (*mqtt.ClientOptions, error) {
+	mqttConfig := mqttNotifier.Config
+	scheme := "tcp"
+	options := mqtt.NewClientOptions()
+	if mqttConfig.TLS.Enabled {
+		tlsConfig, tlsErr := NewTLSConfig(mqttConfig.TLS)
+		if tlsErr != nil {
+			return nil, tlsErr
+		}
+		scheme = "ssl"
+		options.SetTLSConfig(tlsConfig)
+	}
+	options.AddBroker(fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(mqttConfig.Host, strconv.Itoa(mqttConfig.Port))))
+	options.SetClientID(mqttConfig.ClientID)
+	options.SetUsername(mqttConfig.User)
+	options.SetPassword(mqttConfig.Password)
+	options.SetKeepAlive(mqttConfig.KeepAlive)
+	options.SetConnectTimeout(mqttConfig.Timeout)
+	options.SetWriteTimeout(mqttConfig.Timeout)
+	options.SetAutoReconnect(true)
+	options.SetConnectRetry(true)
+	options.SetMaxReconnectInterval(time.Minute)
+	options.SetWill(mqttNotifier.StatusTopic(), MQTTStatusOffline, mqttConfig.QoS, true)
+	options.SetOnConnectHandler(mqttNotifier.connected)
+	options.SetConnectionLostHandler(func(client mqtt.Client, lostErr error) {
+		log.Printf("MQTT connection lost, reconnecting: %s", lostErr.Error())
+	})
+	return options, nil
+}
+
+// connected announces the watcher and forgets published state and discovery
+// configs so they are published again on next poll
+func (mqttNotifier *MQTTNotifier) connected(client mqtt.Client) {
+	mqttNotifier.mutex.Lock()
+	mqttNotifier.published = make(map[string]DeviceState)
+	mqttNotifier.discovered = make(map[string]string)
+	mqttNotifier.mutex.Unlock()
+	if publishErr := mqttNotifier.publish(context.Background(), mqttNotifier.StatusTopic(), MQTTStatusOnline, true); publishErr != nil {
+		log.Printf("Failed to publish MQTT watcher status: %s", publishErr.Error())
+	}
+}
+
+// StatusTopic returns the topic holding watcher status
+func (mqttNotifier *MQTTNotifier) StatusTopic() string {
+	return mqttNotifier.Config.TopicPrefix + "/status"
+}
+
+// DeviceTopic returns the topic of deviceID subtopic, characters with
+// special meaning in MQTT topics are replaced in device ids
+func (mqttNotifier *MQTTNotifier) DeviceTopic(deviceID string, subtopic string) string {
+	return mqttNotifier.Config.TopicPrefix + "/" + topicSegment(deviceID) + "/" + subtopic
+}
+
+func topicSegment(value string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(value)
+}
+
+// Send publishes event JSON payload to device events topic
+func (mqttNotifier *MQTTNotifier) Send(ctx context.Context, event Event) error {
+	payload, payloadErr := event.Payload()
+	if payloadErr != nil {
+		return payloadErr
+	}
+	return mqttNotifier.publish(ctx, mqttNotifier.DeviceTopic(event.DeviceID, "events"), payload, false)
+}
+
+// stateValue is a device state subtopic value
+type stateValue struct {
+	subtopic string
+	value    string
+	changed  bool
+}
+
+// PublishStates publishes retained mode, firing and online topics of states
+// that changed since they were last published. With discovery enabled the
+// Home Assistant alarm state of known modes is published too and discovery
+// configs are published for listed devices and removed for removed ones.
+func (mqttNotifier *MQTTNotifier) PublishStates(ctx context.Context, states []DeviceState) error {
+	mqttNotifier.mutex.Lock()
+	defer mqttNotifier.mutex.Unlock()
+	var failures []string
+	if mqttNotifier.Config.Discovery {
+		failures = mqttNotifier.publishDiscovery(ctx, states)
+	}
+	listed := make(map[string]bool)
+	for _, state := range states {
+		if state.Removed {
+			continue
+		}
+		listed[state.DeviceID] = true
+		previous, known := mqttNotifier.published[state.DeviceID]
+		if known && previous == state {
+			continue
+		}
+		values := []stateValue{
+			{"mode", state.Mode, previous.Mode != state.Mode},
+			{"firing", strconv.FormatBool(state.Firing), previous.Firing != state.Firing},
+			{"online", strconv.FormatBool(state.Online), previous.Online != state.Online},
+		}
+		if mqttNotifier.Config.Discovery {
+			alarmState := HomeAssistantState(state)
+			if alarmState != "" {
+				values = append(values, stateValue{"alarm", alarmState, HomeAssistantState(previous) != alarmState})
+			} else if !known || previous.Mode != state.Mode {
+				log.Printf("Mode %s of device %s has no Home Assistant alarm state, it is not published.", state.Mode, state.DeviceID)
+			}
+		}
+		published := true
+		for _, value := range values {
+			if known && !value.changed {
+				continue
+			}
+			if publishErr := mqttNotifier.publish(ctx, mqttNotifier.DeviceTopic(state.DeviceID, value.subtopic), value.value, true); publishErr != nil {
+				failures = append(failures, fmt.Sprintf("%s %s: %s", state.DeviceID, value.subtopic, publishErr.Error()))
+				published = false
+			}
+		}
+		if published {
+			mqttNotifier.published[state.DeviceID] = state
+		}
+	}
+	for deviceID := range mqttNotifier.published {
+		if !listed[deviceID] {
+			delete(mqttNotifier.published, deviceID)
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("Failed to publish MQTT device state " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// publish sends payload to topic waiting for broker confirmation up to
+// configured timeout
+func (mqttNotifier *MQTTNotifier) publish(ctx context.Context, topic string, payload interface{}, retained bool) error {
+	token := mqttNotifier.Client.Publish(topic, mqttNotifier.Config.QoS, retained, payload)
+	timer := time.NewTimer(mqttNotifier.Config.Timeout)
+	defer timer.Stop()
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return errors.New("Timed out publishing to MQTT topic " + topic + ".")
+	}
+}
+
+// Close marks the watcher offline, as last will is not sent on clean
+// disconnections, and disconnects from the broker
+func (mqttNotifier *MQTTNotifier) Close() error {
+	var publishErr error
+	if mqttNotifier.Client.IsConnectionOpen() {
+		publishErr = mqttNotifier.publish(context.Background(), mqttNotifier.StatusTopic(), MQTTStatusOffline, true)
+	}
+	mqttNotifier.Client.Disconnect(uint(mqttNotifier.Config.Timeout / time.Millisecond))
+	return publishErr
+}
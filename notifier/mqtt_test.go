@@ -0,0 +1,518 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// TestBroker is a minimal in-process MQTT broker recording connections and
+// publications, it keeps retained messages, forwards publications to
+// subscribers at QoS 0 and sends last wills when a client connection is lost
+type TestBroker struct {
+	listener net.Listener
+
+	mutex     sync.Mutex
+	clients   []*testBrokerClient
+	connects  []*packets.ConnectPacket
+	published []*packets.PublishPacket
+	retained  map[string]string
+}
+
+type testBrokerClient struct {
+	connection net.Conn
+	mutex      sync.Mutex
+	filters    []string
+}
+
+func (client *testBrokerClient) write(packet packets.ControlPacket) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return packet.Write(client.connection)
+}
+
+func (client *testBrokerClient) subscribed(topic string) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for _, filter := range client.filters {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for index, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if index >= len(topicLevels) || (level != "+" && level != topicLevels[index]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func NewTestBroker(t *testing.T) *TestBroker {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("Test broker should listen, error was '%s'.", listenErr.Error())
+	}
+	broker := &TestBroker{listener: listener, retained: make(map[string]string)}
+	go broker.accept()
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+func (broker *TestBroker) Port() int {
+	return broker.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (broker *TestBroker) Close() {
+	broker.listener.Close()
+	broker.DropConnections()
+}
+
+// DropConnections closes client connections without a disconnect packet
+func (broker *TestBroker) DropConnections() {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	for _, client := range broker.clients {
+		client.connection.Close()
+	}
+	broker.clients = nil
+}
+
+func (broker *TestBroker) Connects() []*packets.ConnectPacket {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	return append([]*packets.ConnectPacket(nil), broker.connects...)
+}
+
+func (broker *TestBroker) Published(topic string) []*packets.PublishPacket {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	var published []*packets.PublishPacket
+	for _, publish := range broker.published {
+		if publish.TopicName == topic {
+			published = append(published, publish)
+		}
+	}
+	return published
+}
+
+// Retain stores a retained message as if it was published by another client
+func (broker *TestBroker) Retain(topic string, payload string) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	broker.retained[topic] = payload
+}
+
+func (broker *TestBroker) Retained(topic string) (string, bool) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	value, found := broker.retained[topic]
+	return value, found
+}
+
+func (broker *TestBroker) accept() {
+	for {
+		connection, acceptErr := broker.listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		client := &testBrokerClient{connection: connection}
+		broker.mutex.Lock()
+		broker.clients = append(broker.clients, client)
+		broker.mutex.Unlock()
+		go broker.serve(client)
+	}
+}
+
+func (broker *TestBroker) serve(client *testBrokerClient) {
+	defer client.connection.Close()
+	var connect *packets.ConnectPacket
+	for {
+		packet, readErr := packets.ReadPacket(client.connection)
+		if readErr != nil {
+			if connect != nil && connect.WillFlag {
+				broker.store(&packets.PublishPacket{TopicName: connect.WillTopic, Payload: connect.WillMessage, FixedHeader: packets.FixedHeader{Qos: connect.WillQos, Retain: connect.WillRetain}})
+			}
+			return
+		}
+		var response packets.ControlPacket
+		switch received := packet.(type) {
+		case *packets.ConnectPacket:
+			connect = received
+			broker.mutex.Lock()
+			broker.connects = append(broker.connects, received)
+			broker.mutex.Unlock()
+			response = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			broker.store(received)
+			switch received.Qos {
+			case 1:
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = received.MessageID
+				response = puback
+			case 2:
+				pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pubrec.MessageID = received.MessageID
+				response = pubrec
+			}
+		case *packets.PubrelPacket:
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = received.MessageID
+			response = pubcomp
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = received.MessageID
+			suback.ReturnCodes = make([]byte, len(received.Topics))
+			client.mutex.Lock()
+			client.filters = append(client.filters, received.Topics...)
+			client.mutex.Unlock()
+			if writeErr := client.write(suback); writeErr != nil {
+				return
+			}
+			broker.sendRetained(client)
+		case *packets.PingreqPacket:
+			response = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if response != nil {
+			if writeErr := client.write(response); writeErr != nil {
+				return
+			}
+		}
+	}
+}
+
+func (broker *TestBroker) store(publish *packets.PublishPacket) {
+	broker.mutex.Lock()
+	broker.published = append(broker.published, publish)
+	if publish.Retain {
+		if len(publish.Payload) == 0 {
+			delete(broker.retained, publish.TopicName)
+		} else {
+			broker.retained[publish.TopicName] = string(publish.Payload)
+		}
+	}
+	clients := append([]*testBrokerClient(nil), broker.clients...)
+	broker.mutex.Unlock()
+	for _, client := range clients {
+		if client.subscribed(publish.TopicName) {
+			client.write(forwarded(publish.TopicName, publish.Payload, false))
+		}
+	}
+}
+
+func (broker *TestBroker) sendRetained(client *testBrokerClient) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	for topic, payload := range broker.retained {
+		if client.subscribed(topic) {
+			client.write(forwarded(topic, []byte(payload), true))
+		}
+	}
+}
+
+func forwarded(topic string, payload []byte, retained bool) *packets.PublishPacket {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Payload = payload
+	publish.Retain = retained
+	return publish
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s.", description)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func mqttConfig(broker *TestBroker) config_reader.MQTT {
+	return config_reader.MQTT{Enabled: true, Host: "127.0.0.1", Port: broker.Port(), ClientID: "watcher-test", User: "watcher", Password: "secret", QoS: 1, TopicPrefix: "alarmstatuswatcher", KeepAlive: time.Second * 30, Timeout: time.Second * 2}
+}
+
+func TestMQTTConnectsWithCredentialsAndLastWill(t *testing.T) {
+
+	broker := NewTestBroker(t)
+	mqttNotifier, err := NewMQTTNotifier(mqttConfig(broker))
+	if err != nil {
+		t.Fatalf("NewMQTTNotifier should not fail, error was '%s'.", err.Error())
+	}
+	defer mqttNotifier.Close()
+
+	connects := broker.Connects()
+	if len(connects) != 1 {
+		t.Fatalf("Notifier should connect once, not %d times.", len(connects))
+	}
+	connect := connects[0]
+	if connect.ClientIdentifier != "watcher-test" || connect.Username != "watcher" || string(connect.Password) != "secret" {
+		t.Errorf("Connection should use configured client id and credentials, got %s.", connect.String())
+	}
+	if !connect.WillFlag || connect.WillTopic != "alarmstatuswatcher/status" || string(connect.WillMessage) != MQTTStatusOffline || !connect.WillRetain {
+		t.Errorf("Connection should set a retained offline last will, got %s.", connect.String())
+	}
+	waitFor(t, "online status", func() bool {
+		status, _ := broker.Retained("alarmstatuswatcher/status")
+		return status == MQTTStatusOnline
+	})
+}
+
+func TestMQTTPublishStatesRetainsChangedFields(t *testing.T) {
+
+	broker := NewTestBroker(t)
+	mqttNotifier, _ := NewMQTTNotifier(mqttConfig(broker))
+	defer mqttNotifier.Close()
+
+	states := []DeviceState{{DeviceID: "ab123", DeviceName: "Home Alarm", Mode: "armed_away", Firing: false, Online: true}, {DeviceID: "home/garage", DeviceName: "Garage", Mode: "disarmed", Online: true}}
+	if err := mqttNotifier.PublishStates(context.TODO(), states); err != nil {
+		t.Fatalf("PublishStates should not fail, error was '%s'.", err.Error())
+	}
+	expected := map[string]string{
+		"alarmstatuswatcher/ab123/mode":         "armed_away",
+		"alarmstatuswatcher/ab123/firing":       "false",
+		"alarmstatuswatcher/ab123/online":       "true",
+		"alarmstatuswatcher/home_garage/mode":   "disarmed",
+		"alarmstatuswatcher/home_garage/firing": "false",
+	}
+	for topic, value := range expected {
+		if retained, _ := broker.Retained(topic); retained != value {
+			t.Errorf("Topic %s should retain '%s', not '%s'.", topic, value, retained)
+		}
+	}
+
+	states[0].Firing = true
+	if err := mqttNotifier.PublishStates(context.TODO(), states); err != nil {
+		t.Fatalf("PublishStates should not fail, error was '%s'.", err.Error())
+	}
+	if retained, _ := broker.Retained("alarmstatuswatcher/ab123/firing"); retained != "true" {
+		t.Errorf("Firing topic should retain 'true', not '%s'.", retained)
+	}
+	if published := broker.Published("alarmstatuswatcher/ab123/firing"); len(published) != 2 || published[1].Qos != 1 {
+		t.Errorf("Firing topic should be published twice with QoS 1, it was published %d times.", len(published))
+	}
+	if published := broker.Published("alarmstatuswatcher/ab123/mode"); len(published) != 1 {
+		t.Errorf("Unchanged mode topic should be published once, not %d times.", len(published))
+	}
+}
+
+func TestMQTTSendPublishesEvent(t *testing.T) {
+
+	broker := NewTestBroker(t)
+	mqttNotifier, _ := NewMQTTNotifier(mqttConfig(broker))
+	defer mqttNotifier.Close()
+
+	if err := mqttNotifier.Send(context.TODO(), webhookEvent()); err != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", err.Error())
+	}
+	published := broker.Published("alarmstatuswatcher/ab123/events")
+	if len(published) != 1 {
+		t.Fatalf("Event should be published once, it was published %d times.", len(published))
+	}
+	if published[0].Retain {
+		t.Errorf("Events should not be retained.")
+	}
+	var payload Payload
+	if unmarshalErr := json.Unmarshal(published[0].Payload, &payload); unmarshalErr != nil || payload.DeviceID != "ab123" || payload.Message != "Started Firing" {
+		t.Errorf("Event payload should be the event JSON payload, it was '%s'.", published[0].Payload)
+	}
+}
+
+func TestMQTTRepublishesAfterReconnecting(t *testing.T) {
+
+	broker := NewTestBroker(t)
+	mqttNotifier, _ := NewMQTTNotifier(mqttConfig(broker))
+	defer mqttNotifier.Close()
+
+	states := []DeviceState{{DeviceID: "ab123", DeviceName: "Home Alarm", Mode: "armed_away", Online: true}}
+	mqttNotifier.PublishStates(context.TODO(), states)
+	waitFor(t, "online status", func() bool {
+		status, _ := broker.Retained("alarmstatuswatcher/status")
+		return status == MQTTStatusOnline
+	})
+
+	broker.DropConnections()
+	waitFor(t, "reconnection", func() bool {
+		return len(broker.Connects()) == 2
+	})
+	waitFor(t, "online status after reconnecting", func() bool {
+		status, _ := broker.Retained("alarmstatuswatcher/status")
+		return status == MQTTStatusOnline && len(broker.Published("alarmstatuswatcher/status")) == 3
+	})
+	if published := broker.Published("alarmstatuswatcher/status"); string(published[1].Payload) != MQTTStatusOffline {
+		t.Errorf("Last will should be published when connection is lost, got '%s'.", published[1].Payload)
+	}
+	waitFor(t, "state republished", func() bool {
+		mqttNotifier.PublishStates(context.TODO(), states)
+		return len(broker.Published("alarmstatuswatcher/ab123/mode")) == 2
+	})
+}
+
+func TestMQTTCloseMarksWatcherOffline(t *testing.T) {
+
+	broker := NewTestBroker(t)
+	mqttNotifier, _ := NewMQTTNotifier(mqttConfig(broker))
+	waitFor(t, "online status", func() bool {
+		status, _ := broker.Retained("alarmstatuswatcher/status")
+		return status == MQTTStatusOnline
+	})
+	if err := mqttNotifier.Close(); err != nil {
+		t.Errorf("Close should not fail, error was '%s'.", err.Error())
+	}
+	if status, _ := broker.Retained("alarmstatuswatcher/status"); status != MQTTStatusOffline {
+		t.Errorf("Watcher status should be offline after closing, not '%s'.", status)
+	}
+}
+
+func discoveryConfig(t *testing.T, broker *TestBroker, topic string) map[string]interface{} {
+	t.Helper()
+	retained, found := broker.Retained(topic)
+	if !found {
+		t.Fatalf("Discovery config %s should be retained.", topic)
+	}
+	var config map[string]interface{}
+	if unmarshalErr := json.Unmarshal([]byte(retained), &config); unmarshalErr != nil {
+		t.Fatalf("Discovery config %s should be JSON, error was '%s'.", topic, unmarshalErr.Error())
+	}
+	return config
+}
+
+func TestMQTTPublishesHomeAssistantDiscovery(t *testing.T) {
+
+	broker := NewTestBroker(t)
+	config := mqttConfig(broker)
+	config.Discovery = true
+	config.DiscoveryPrefix = "homeassistant"
+	mqttNotifier, _ := NewMQTTNotifier(config)
+	defer mqttNotifier.Close()
+
+	states := []DeviceState{{DeviceID: "ab123", DeviceName: "Home Alarm", Mode: "armed", Online: true}}
+	if err := mqttNotifier.PublishStates(context.TODO(), states); err != nil {
+		t.Fatalf("PublishStates should not fail, error was '%s'.", err.Error())
+	}
+
+	panel := discoveryConfig(t, broker, "homeassistant/alarm_control_panel/watcher-test/ab123/config")
+	if panel["name"] != "Home Alarm" || panel["unique_id"] != "watcher-test_ab123" || panel["state_topic"] != "alarmstatuswatcher/ab123/alarm" || panel["command_topic"] != "alarmstatuswatcher/ab123/command" {
+		t.Errorf("Unexpected alarm_control_panel config %v.", panel)
+	}
+	if device := panel["device"].(map[string]interface{}); device["name"] != "Home Alarm" {
+		t.Errorf("Discovery device should use device name, config was %v.", panel)
+	}
+	online := discoveryConfig(t, broker, "homeassistant/binary_sensor/watcher-test/ab123_online/config")
+	if online["state_topic"] != "alarmstatuswatcher/ab123/online" || online["device_class"] != "connectivity" || online["payload_on"] != "true" {
+		t.Errorf("Unexpected online binary_sensor config %v.", online)
+	}
+	firing := discoveryConfig(t, broker, "homeassistant/binary_sensor/watcher-test/ab123_firing/config")
+	if firing["state_topic"] != "alarmstatuswatcher/ab123/firing" || firing["name"] != "Home Alarm Firing" {
+		t.Errorf("Unexpected firing binary_sensor config %v.", firing)
+	}
+	if alarm, _ := broker.Retained("alarmstatuswatcher/ab123/alarm"); alarm != "armed_away" {
+		t.Errorf("Home Assistant alarm state should be 'armed_away', not '%s'.", alarm)
+	}
+
+	states[0].Firing = true
+	mqttNotifier.PublishStates(context.TODO(), states)
+	if alarm, _ := broker.Retained("alarmstatuswatcher/ab123/alarm"); alarm != "triggered" {
+		t.Errorf("Home Assistant alarm state of firing device should be 'triggered', not '%s'.", alarm)
+	}
+	if published := broker.Published("homeassistant/alarm_control_panel/watcher-test/ab123/config"); len(published) != 1 {
+		t.Errorf("Discovery config should only be published again when device changes name, it was published %d times.", len(published))
+	}
+}
+
+func TestMQTTSkipsUnknownHomeAssistantStates(t *testing.T) {
+
+	broker := NewTestBroker(t)
+	config := mqttConfig(broker)
+	config.Discovery = true
+	config.DiscoveryPrefix = "homeassistant"
+	mqttNotifier, _ := NewMQTTNotifier(config)
+	defer mqttNotifier.Close()
+
+	states := []DeviceState{{DeviceID: "ab123", DeviceName: "Home Alarm", Mode: "disarmed", Online: true}}
+	mqttNotifier.PublishStates(context.TODO(), states)
+	states[0].Mode = "Not Set"
+	if err := mqttNotifier.PublishStates(context.TODO(), states); err != nil {
+		t.Fatalf("PublishStates should not fail, error was '%s'.", err.Error())
+	}
+	if mode, _ := broker.Retained("alarmstatuswatcher/ab123/mode"); mode != "Not Set" {
+		t.Errorf("Mode topic should retain 'Not Set', not '%s'.", mode)
+	}
+	if published := broker.Published("alarmstatuswatcher/ab123/alarm"); len(published) != 1 || string(published[0].Payload) != "disarmed" {
+		t.Errorf("Modes unknown to Home Assistant should not be published as alarm state, %d states were published.", len(published))
+	}
+}
+
+func TestMQTTRemovesDiscoveryOfRemovedDevices(t *testing.T) {
+
+	broker := NewTestBroker(t)
+	broker.Retain("homeassistant/binary_sensor/other-watcher/foreign/config", `{"name":"Foreign"}`)
+	config := mqttConfig(broker)
+	config.Discovery = true
+	config.DiscoveryPrefix = "homeassistant"
+	mqttNotifier, _ := NewMQTTNotifier(config)
+	defer mqttNotifier.Close()
+
+	states := []DeviceState{{DeviceID: "ab123", DeviceName: "Home Alarm", Mode: "disarmed", Online: true}, {DeviceID: "cd456", DeviceName: "Garage", Mode: "disarmed", Online: true}}
+	if err := mqttNotifier.PublishStates(context.TODO(), states); err != nil {
+		t.Fatalf("PublishStates should not fail, error was '%s'.", err.Error())
+	}
+
+	// Devices missing from a poll, such as unknown devices failing to be
+	// fetched, keep their discovery configs
+	if err := mqttNotifier.PublishStates(context.TODO(), states[:1]); err != nil {
+		t.Fatalf("PublishStates should not fail, error was '%s'.", err.Error())
+	}
+	if _, found := broker.Retained("homeassistant/alarm_control_panel/watcher-test/cd456/config"); !found {
+		t.Errorf("Discovery config of a device missing from states should be kept.")
+	}
+
+	if err := mqttNotifier.PublishStates(context.TODO(), []DeviceState{states[0], {DeviceID: "cd456", Removed: true}}); err != nil {
+		t.Fatalf("PublishStates should not fail, error was '%s'.", err.Error())
+	}
+	for _, topic := range []string{"homeassistant/alarm_control_panel/watcher-test/cd456/config", "homeassistant/binary_sensor/watcher-test/cd456_online/config", "homeassistant/binary_sensor/watcher-test/cd456_firing/config"} {
+		if _, found := broker.Retained(topic); found {
+			t.Errorf("Discovery config %s of a removed device should be removed.", topic)
+		}
+	}
+	if _, found := broker.Retained("homeassistant/alarm_control_panel/watcher-test/ab123/config"); !found {
+		t.Errorf("Discovery config of listed devices should be kept.")
+	}
+	if _, found := broker.Retained("homeassistant/binary_sensor/other-watcher/foreign/config"); !found {
+		t.Errorf("Discovery configs of other watchers should be kept.")
+	}
+}
+
+func TestHomeAssistantState(t *testing.T) {
+
+	states := map[DeviceState]string{
+		{Mode: "disarmed"}:                 "disarmed",
+		{Mode: "Armed_Home"}:               "armed_home",
+		{Mode: "armed"}:                    "armed_away",
+		{Mode: "armed_away", Firing: true}: "triggered",
+		{Mode: "test"}:                     "",
+	}
+	for state, expected := range states {
+		if HomeAssistantState(state) != expected {
+			t.Errorf("Home Assistant state of mode '%s' should be '%s', not '%s'.", state.Mode, expected, HomeAssistantState(state))
+		}
+	}
+}
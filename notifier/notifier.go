@@ -0,0 +1,223 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	metrics "github.com/a-castellano/AlarmStatusWatcher/metrics"
+)
+
+// PayloadVersion is the version of the JSON payload sent to consumers, it
+// must be increased on any incompatible payload change
+const PayloadVersion = 1
+
+// Event is the notification produced by the watcher when a device changes
+type Event struct {
+	DeviceID   string
+	DeviceName string
+	Changes    []events.ChangeEvent
+	// Escalation is the escalation level of firing reminders
+	Escalation int
+	// Recipients are added to the notifier configured ones, notifiers
+	// without recipients ignore them
+	Recipients []string
+	// Acknowledgement is set while device firing is acknowledged
+	Acknowledgement *events.Acknowledgement
+	// Summary is set when Changes were held back by a quiet or maintenance
+	// window and are sent once it ends
+	Summary bool
+}
+
+// Payload is the JSON document delivered to machine consumers
+type Payload struct {
+	Version    int                  `json:"version"`
+	DeviceID   string               `json:"device_id"`
+	DeviceName string               `json:"device_name"`
+	Severity   events.Severity      `json:"severity"`
+	Message    string               `json:"message"`
+	Time       time.Time            `json:"time"`
+	Changes    []events.ChangeEvent `json:"changes"`
+	Escalation int                  `json:"escalation,omitempty"`
+	// Acknowledgement is set while device firing is acknowledged
+	Acknowledgement *events.Acknowledgement `json:"acknowledgement,omitempty"`
+	Summary         bool                    `json:"summary,omitempty"`
+}
+
+// Message renders event changes as text
+func (event Event) Message() string {
+	return events.RenderMessage(event.Changes)
+}
+
+// Text returns the human readable notification text
+func (event Event) Text() string {
+	return fmt.Sprintf("%s - %s", event.DeviceName, event.Message())
+}
+
+// Severity returns the highest severity of event changes
+func (event Event) Severity() events.Severity {
+	return events.MaxSeverity(event.Changes)
+}
+
+// Type returns the type of the most severe change
+func (event Event) Type() events.Type {
+	severity := event.Severity()
+	for _, change := range event.Changes {
+		if change.Severity == severity {
+			return change.Type()
+		}
+	}
+	return ""
+}
+
+// Payload returns the versioned JSON payload of the event
+func (event Event) Payload() ([]byte, error) {
+	payload := Payload{Version: PayloadVersion, DeviceID: event.DeviceID, DeviceName: event.DeviceName, Severity: event.Severity(), Message: event.Message(), Changes: event.Changes, Escalation: event.Escalation, Acknowledgement: event.Acknowledgement, Summary: event.Summary}
+	if len(event.Changes) > 0 {
+		payload.Time = event.Changes[0].Timestamp
+	}
+	return json.Marshal(payload)
+}
+
+// Notifier sends events through a notification channel
+type Notifier interface {
+	Name() string
+	Send(ctx context.Context, event Event) error
+}
+
+// DeviceState is the current status of a device
+type DeviceState struct {
+	DeviceID   string
+	DeviceName string
+	Mode       string
+	Firing     bool
+	Online     bool
+	// Removed is set for devices deleted from storage as AlarmManager no
+	// longer lists them, other fields are empty
+	Removed bool
+}
+
+// StatePublisher is implemented by notifiers mirroring current device state,
+// they receive every known device after each poll regardless of notify rules
+// along with devices removed in that poll
+type StatePublisher interface {
+	PublishStates(ctx context.Context, states []DeviceState) error
+}
+
+// Registry holds the enabled notifiers and dispatches events to all of them
+type Registry struct {
+	Metrics *metrics.Metrics
+
+	mutex     sync.RWMutex
+	notifiers []Notifier
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a notifier to the registry, names must be unique
+func (registry *Registry) Register(notifier Notifier) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for _, registered := range registry.notifiers {
+		if registered.Name() == notifier.Name() {
+			return errors.New("Notifier " + notifier.Name() + " is already registered.")
+		}
+	}
+	registry.notifiers = append(registry.notifiers, notifier)
+	return nil
+}
+
+// Notifiers returns registered notifiers in registration order
+func (registry *Registry) Notifiers() []Notifier {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	notifiers := make([]Notifier, len(registry.notifiers))
+	copy(notifiers, registry.notifiers)
+	return notifiers
+}
+
+// Names returns registered notifier names in registration order
+func (registry *Registry) Names() []string {
+	notifiers := registry.Notifiers()
+	names := make([]string, 0, len(notifiers))
+	for _, notifier := range notifiers {
+		names = append(names, notifier.Name())
+	}
+	return names
+}
+
+// Close releases resources held by notifiers implementing io.Closer, in
+// registration order
+func (registry *Registry) Close() error {
+	var failures []string
+	for _, notifier := range registry.Notifiers() {
+		if closer, ok := notifier.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", notifier.Name(), closeErr.Error()))
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("Failed to close notifiers " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Dispatch sends event through every registered notifier. A failing notifier
+// does not prevent the others from being called, all failures are returned
+// together.
+func (registry *Registry) Dispatch(ctx context.Context, event Event) error {
+	return registry.DispatchTo(ctx, event, nil)
+}
+
+// DispatchTo sends event through registered notifiers named in channels,
+// every notifier is used when channels is empty
+func (registry *Registry) DispatchTo(ctx context.Context, event Event, channels []string) error {
+	selected := make(map[string]bool)
+	for _, channel := range channels {
+		selected[channel] = true
+	}
+	var failures []string
+	for _, notifier := range registry.Notifiers() {
+		if len(selected) > 0 && !selected[notifier.Name()] {
+			continue
+		}
+		sendErr := notifier.Send(ctx, event)
+		registry.Metrics.NotificationSent(notifier.Name(), sendErr)
+		if sendErr != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", notifier.Name(), sendErr.Error()))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("Failed to send notification through " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// PublishStates sends states through registered notifiers implementing
+// StatePublisher, all failures are returned together
+func (registry *Registry) PublishStates(ctx context.Context, states []DeviceState) error {
+	var failures []string
+	for _, notifier := range registry.Notifiers() {
+		publisher, ok := notifier.(StatePublisher)
+		if !ok {
+			continue
+		}
+		if publishErr := publisher.PublishStates(ctx, states); publishErr != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", notifier.Name(), publishErr.Error()))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("Failed to publish device states through " + strings.Join(failures, "; "))
+	}
+	return nil
+}
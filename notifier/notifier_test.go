@@ -0,0 +1,168 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+type FakeNotifier struct {
+	NotifierName string
+	SendErr      error
+	Sent         []Event
+}
+
+func (fake *FakeNotifier) Name() string {
+	return fake.NotifierName
+}
+
+func (fake *FakeNotifier) Send(ctx context.Context, event Event) error {
+	fake.Sent = append(fake.Sent, event)
+	return fake.SendErr
+}
+
+func TestRegisterDuplicatedNotifier(t *testing.T) {
+
+	registry := NewRegistry()
+	if err := registry.Register(&FakeNotifier{NotifierName: "fake"}); err != nil {
+		t.Errorf("First register should not fail, error was '%s'.", err.Error())
+	}
+	if err := registry.Register(&FakeNotifier{NotifierName: "fake"}); err == nil {
+		t.Errorf("Registering a notifier with a duplicated name should fail.")
+	}
+	if len(registry.Notifiers()) != 1 {
+		t.Errorf("Registry should contain one notifier, not %d.", len(registry.Notifiers()))
+	}
+}
+
+func TestDispatchToAllNotifiers(t *testing.T) {
+
+	first := FakeNotifier{NotifierName: "first"}
+	second := FakeNotifier{NotifierName: "second"}
+	registry := NewRegistry()
+	registry.Register(&first)
+	registry.Register(&second)
+
+	event := Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldFiring, "false", "true", time.Now())}}
+	err := registry.Dispatch(context.TODO(), event)
+	if err != nil {
+		t.Errorf("Dispatch should not fail, error was '%s'.", err.Error())
+	}
+	if len(first.Sent) != 1 || len(second.Sent) != 1 {
+		t.Errorf("Every notifier should receive the event once.")
+	}
+	if first.Sent[0].Text() != "Home Alarm - Started Firing" {
+		t.Errorf("Event text should be 'Home Alarm - Started Firing', not '%s'.", first.Sent[0].Text())
+	}
+}
+
+func TestDispatchKeepsSendingAfterFailure(t *testing.T) {
+
+	failing := FakeNotifier{NotifierName: "failing", SendErr: errors.New("unreachable")}
+	working := FakeNotifier{NotifierName: "working"}
+	registry := NewRegistry()
+	registry.Register(&failing)
+	registry.Register(&working)
+
+	err := registry.Dispatch(context.TODO(), Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldOnline, "true", "false", time.Now())}})
+	if err == nil {
+		t.Errorf("Dispatch should fail when a notifier fails.")
+	} else if err.Error() != "Failed to send notification through failing: unreachable" {
+		t.Errorf("Unexpected dispatch error '%s'.", err.Error())
+	}
+	if len(working.Sent) != 1 {
+		t.Errorf("Working notifier should receive the event even if another notifier failed.")
+	}
+}
+
+func TestEventPayload(t *testing.T) {
+
+	now := time.Now()
+	event := Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{
+		events.New("ab123", "Home Alarm", events.FieldMode, "armed", "disarmed", now),
+		events.New("ab123", "Home Alarm", events.FieldFiring, "false", "true", now),
+	}}
+
+	body, err := event.Payload()
+	if err != nil {
+		t.Fatalf("Payload should not fail, error was '%s'.", err.Error())
+	}
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("Payload should be valid JSON, error was '%s'.", err.Error())
+	}
+	if payload.Version != PayloadVersion {
+		t.Errorf("Payload version should be %d, not %d.", PayloadVersion, payload.Version)
+	}
+	if payload.Severity != events.SeverityCritical {
+		t.Errorf("Payload severity should be critical, not %s.", payload.Severity)
+	}
+	if payload.Message != "Changed Mode from armed to disarmed Started Firing" {
+		t.Errorf("Unexpected payload message '%s'.", payload.Message)
+	}
+	if len(payload.Changes) != 2 || payload.Changes[0].Field != events.FieldMode {
+		t.Errorf("Payload should contain both changes in order.")
+	}
+}
+
+type ClosableNotifier struct {
+	FakeNotifier
+	Closed bool
+}
+
+func (closable *ClosableNotifier) Close() error {
+	closable.Closed = true
+	return nil
+}
+
+func TestCloseRegistry(t *testing.T) {
+
+	closable := ClosableNotifier{FakeNotifier: FakeNotifier{NotifierName: "closable"}}
+	registry := NewRegistry()
+	registry.Register(&FakeNotifier{NotifierName: "fake"})
+	registry.Register(&closable)
+
+	if err := registry.Close(); err != nil {
+		t.Errorf("Close should not fail, error was '%s'.", err.Error())
+	}
+	if !closable.Closed {
+		t.Errorf("Notifiers implementing io.Closer should be closed.")
+	}
+}
+
+type FakeStatePublisher struct {
+	FakeNotifier
+	States []DeviceState
+}
+
+func (fake *FakeStatePublisher) PublishStates(ctx context.Context, states []DeviceState) error {
+	fake.States = append(fake.States, states...)
+	return fake.SendErr
+}
+
+func TestPublishStatesOnlyToStatePublishers(t *testing.T) {
+
+	plain := FakeNotifier{NotifierName: "plain"}
+	publisher := FakeStatePublisher{FakeNotifier: FakeNotifier{NotifierName: "publisher"}}
+	failing := FakeStatePublisher{FakeNotifier: FakeNotifier{NotifierName: "failing", SendErr: errors.New("broker down")}}
+	registry := NewRegistry()
+	registry.Register(&plain)
+	registry.Register(&publisher)
+	registry.Register(&failing)
+
+	states := []DeviceState{{DeviceID: "ab123", DeviceName: "Home Alarm", Mode: "armed_home", Online: true}}
+	err := registry.PublishStates(context.TODO(), states)
+	if err == nil || err.Error() != "Failed to publish device states through failing: broker down" {
+		t.Errorf("PublishStates should return failing publisher error, error was '%v'.", err)
+	}
+	if len(publisher.States) != 1 || publisher.States[0] != states[0] {
+		t.Errorf("State publishers should receive device states.")
+	}
+	if len(plain.Sent) != 0 {
+		t.Errorf("Notifiers without state support should not receive anything.")
+	}
+}
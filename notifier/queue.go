@@ -0,0 +1,548 @@
+package notifier
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	"github.com/streadway/amqp"
+)
+
+// DefaultQueueBufferSize is the number of messages kept in memory while broker is down
+const DefaultQueueBufferSize = 100
+
+// DefaultQueuePublishAttempts is how many times a message is published before
+// it is dropped
+const DefaultQueuePublishAttempts = 5
+
+// AMQPConnection is the subset of *amqp.Connection used by QueueNotifier and
+// command consumers
+type AMQPConnection interface {
+	Channel() (AMQPChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// AMQPChannel is the subset of *amqp.Channel used by QueueNotifier and
+// command consumers
+type AMQPChannel interface {
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Close() error
+}
+
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (connection amqpConnection) Channel() (AMQPChannel, error) {
+	return connection.Connection.Channel()
+}
+
+// DialAMQP connects to a real RabbitMQ server
+func DialAMQP(url string, amqpConfig amqp.Config) (AMQPConnection, error) {
+	connection, dialErr := amqp.DialConfig(url, amqpConfig)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	return amqpConnection{connection}, nil
+}
+
+// RoutingKeyData holds the values available to routing key templates
+type RoutingKeyData struct {
+	DeviceID   string
+	DeviceName string
+	EventType  events.Type
+	Field      events.Field
+	Severity   events.Severity
+}
+
+type queueMessage struct {
+	routingKey string
+	publishing amqp.Publishing
+	attempts   int
+}
+
+// QueueNotifier publishes events to RabbitMQ through a long lived
+// connection. Events are buffered in memory while the broker is unreachable
+// and published once the connection is restored.
+//
+// Without exchange, events are sent to QueueName through the default
+// exchange. When an exchange is configured every change is published on its
+// own using the routing key rendered from Config.RoutingKey.
+type QueueNotifier struct {
+	Config     config_reader.RabbitmqConfig
+	BufferSize int
+	Dial       func(url string, amqpConfig amqp.Config) (AMQPConnection, error)
+	// TLSConfig is used for amqps connections
+	TLSConfig      *tls.Config
+	ConfirmTimeout time.Duration
+	ReconnectDelay time.Duration
+	MaxReconnect   time.Duration
+	// FlushTimeout is how long Close waits for buffered messages to be published
+	FlushTimeout time.Duration
+	// MaxPublishAttempts is how many times a nacked message is retried before
+	// it is dropped so buffered messages keep draining
+	MaxPublishAttempts int
+
+	startOnce sync.Once
+	mutex     sync.Mutex
+	closed    bool
+	buffer    chan queueMessage
+	routing   *template.Template
+	routeErr  error
+	stop      chan struct{}
+	done      chan struct{}
+
+	connection AMQPConnection
+	channel    AMQPChannel
+	connClosed chan *amqp.Error
+	confirms   chan amqp.Confirmation
+	pending    *queueMessage
+}
+
+// NewQueueNotifier returns a QueueNotifier connecting to configured broker
+func NewQueueNotifier(config config_reader.RabbitmqConfig) (*QueueNotifier, error) {
+	queueNotifier := &QueueNotifier{Config: config, BufferSize: config.BufferSize}
+	if config.TLS.Enabled {
+		tlsConfig, tlsErr := NewTLSConfig(config.TLS)
+		if tlsErr != nil {
+			return nil, tlsErr
+		}
+		queueNotifier.TLSConfig = tlsConfig
+	}
+	queueNotifier.start()
+	return queueNotifier, nil
+}
+
+// Name returns notifier name
+func (queueNotifier *QueueNotifier) Name() string {
+	return "queue"
+}
+
+func (queueNotifier *QueueNotifier) start() {
+	queueNotifier.startOnce.Do(func() {
+		if queueNotifier.BufferSize < 1 {
+			queueNotifier.BufferSize = DefaultQueueBufferSize
+		}
+		if queueNotifier.Dial == nil {
+			queueNotifier.Dial = DialAMQP
+		}
+		if queueNotifier.ConfirmTimeout <= 0 {
+			queueNotifier.ConfirmTimeout = time.Second * 5
+		}
+		if queueNotifier.ReconnectDelay <= 0 {
+			queueNotifier.ReconnectDelay = time.Second
+		}
+		if queueNotifier.MaxReconnect < queueNotifier.ReconnectDelay {
+			queueNotifier.MaxReconnect = time.Minute
+		}
+		if queueNotifier.FlushTimeout <= 0 {
+			queueNotifier.FlushTimeout = time.Second * 5
+		}
+		if queueNotifier.MaxPublishAttempts < 1 {
+			queueNotifier.MaxPublishAttempts = DefaultQueuePublishAttempts
+		}
+		if queueNotifier.Config.Exchange != "" {
+			queueNotifier.routing, queueNotifier.routeErr = template.New("routingkey").Option("missingkey=error").Parse(queueNotifier.Config.RoutingKey)
+		}
+		queueNotifier.buffer = make(chan queueMessage, queueNotifier.BufferSize)
+		queueNotifier.stop = make(chan struct{})
+		queueNotifier.done = make(chan struct{})
+		go queueNotifier.run()
+	})
+}
+
+// Send buffers event JSON payload to be published, it only fails if the
+// buffer is full or the notifier is closed
+func (queueNotifier *QueueNotifier) Send(ctx context.Context, event Event) error {
+	queueNotifier.start()
+
+	messages, errMessages := queueNotifier.messages(event)
+	if errMessages != nil {
+		return errMessages
+	}
+
+	queueNotifier.mutex.Lock()
+	defer queueNotifier.mutex.Unlock()
+	if queueNotifier.closed {
+		return errors.New("Queue notifier is closed.")
+	}
+	// Event messages are buffered all or none so a retried event is not
+	// published twice. Buffer is only filled while mutex is held, free space
+	// can only grow before messages are sent.
+	if cap(queueNotifier.buffer)-len(queueNotifier.buffer) < len(messages) {
+		return fmt.Errorf("Queue buffer is full, %d messages are waiting for the broker.", len(queueNotifier.buffer))
+	}
+	for _, message := range messages {
+		queueNotifier.buffer <- message
+	}
+	return nil
+}
+
+// messages builds the messages to publish for event, one per change in
+// exchange mode and a single one in queue mode
+func (queueNotifier *QueueNotifier) messages(event Event) ([]queueMessage, error) {
+	if queueNotifier.Config.Exchange == "" {
+		message, errMessage := newQueueMessage(event, queueNotifier.Config.QueueName)
+		if errMessage != nil {
+			return nil, errMessage
+		}
+		return []queueMessage{message}, nil
+	}
+	if queueNotifier.routeErr != nil {
+		return nil, queueNotifier.routeErr
+	}
+	messages := make([]queueMessage, 0, len(event.Changes))
+	for _, change := range event.Changes {
+		var routingKey strings.Builder
+		data := RoutingKeyData{DeviceID: event.DeviceID, DeviceName: event.DeviceName, EventType: change.Type(), Field: change.Field, Severity: change.Severity}
+		if errRouting := queueNotifier.routing.Execute(&routingKey, data); errRouting != nil {
+			return nil, errRouting
+		}
+		changeEvent := event
+		changeEvent.Changes = []events.ChangeEvent{change}
+		message, errMessage := newQueueMessage(changeEvent, routingKey.String())
+		if errMessage != nil {
+			return nil, errMessage
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func newQueueMessage(event Event, routingKey string) (queueMessage, error) {
+	body, errPayload := event.Payload()
+	if errPayload != nil {
+		return queueMessage{}, errPayload
+	}
+	return queueMessage{
+		routingKey: routingKey,
+		publishing: amqp.Publishing{
+			Headers: amqp.Table{
+				"device_id":  event.DeviceID,
+				"event_type": string(event.Type()),
+				"severity":   string(event.Severity()),
+			},
+			DeliveryMode: amqp.Persistent,
+			ContentType:  "application/json",
+			Timestamp:    time.Now(),
+			Body:         body,
+		},
+	}, nil
+}
+
+// Buffered returns how many messages are waiting to be published
+func (queueNotifier *QueueNotifier) Buffered() int {
+	return len(queueNotifier.buffer)
+}
+
+// Close publishes buffered messages for up to FlushTimeout and closes the connection
+func (queueNotifier *QueueNotifier) Close() error {
+	queueNotifier.start()
+	queueNotifier.mutex.Lock()
+	if !queueNotifier.closed {
+		queueNotifier.closed = true
+		close(queueNotifier.stop)
+	}
+	queueNotifier.mutex.Unlock()
+	<-queueNotifier.done
+	if remaining := len(queueNotifier.buffer); remaining > 0 {
+		return fmt.Errorf("%d queue messages could not be published before closing.", remaining)
+	}
+	return nil
+}
+
+func (queueNotifier *QueueNotifier) dialString() string {
+	return AMQPURL(queueNotifier.Config)
+}
+
+// AMQPURL returns the URL to dial configured broker
+func AMQPURL(rabbitmqConfig config_reader.RabbitmqConfig) string {
+	if rabbitmqConfig.URL != "" {
+		return rabbitmqConfig.URL
+	}
+	dialURL := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(rabbitmqConfig.User, rabbitmqConfig.Password),
+		Host:   net.JoinHostPort(rabbitmqConfig.Host, strconv.Itoa(rabbitmqConfig.Port)),
+		Path:   "/",
+	}
+	if rabbitmqConfig.TLS.Enabled {
+		dialURL.Scheme = "amqps"
+	}
+	return dialURL.String()
+}
+
+func (queueNotifier *QueueNotifier) amqpConfig() amqp.Config {
+	return AMQPConfig(queueNotifier.Config, queueNotifier.TLSConfig)
+}
+
+// AMQPConfig returns connection settings. Configured vhost is only used
+// without URL, URL vhost is used as is like every other URL field.
+func AMQPConfig(rabbitmqConfig config_reader.RabbitmqConfig, tlsConfig *tls.Config) amqp.Config {
+	amqpConfig := amqp.Config{
+		Heartbeat: rabbitmqConfig.Heartbeat,
+		Locale:    "en_US",
+	}
+	if rabbitmqConfig.URL == "" {
+		amqpConfig.Vhost = rabbitmqConfig.VHost
+	}
+	if tlsConfig != nil {
+		amqpConfig.TLSClientConfig = tlsConfig.Clone()
+	}
+	return amqpConfig
+}
+
+func (queueNotifier *QueueNotifier) connect() error {
+	connection, errDial := queueNotifier.Dial(queueNotifier.dialString(), queueNotifier.amqpConfig())
+	if errDial != nil {
+		return errDial
+	}
+
+	channel, errChannel := connection.Channel()
+	if errChannel != nil {
+		connection.Close()
+		return errChannel
+	}
+
+	if errDeclare := queueNotifier.declare(channel); errDeclare != nil {
+		channel.Close()
+		connection.Close()
+		return errDeclare
+	}
+
+	if errConfirm := channel.Confirm(false); errConfirm != nil {
+		channel.Close()
+		connection.Close()
+		return errConfirm
+	}
+
+	queueNotifier.connection = connection
+	queueNotifier.channel = channel
+	queueNotifier.connClosed = connection.NotifyClose(make(chan *amqp.Error, 1))
+	queueNotifier.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return nil
+}
+
+// declare creates configured exchange and queue and binds them
+func (queueNotifier *QueueNotifier) declare(channel AMQPChannel) error {
+	rabbitmqConfig := queueNotifier.Config
+	if rabbitmqConfig.Exchange != "" {
+		errExchange := channel.ExchangeDeclare(
+			rabbitmqConfig.Exchange,     // name
+			rabbitmqConfig.ExchangeType, // type
+			true,                        // durable
+			false,                       // auto-deleted
+			false,                       // internal
+			false,                       // no-wait
+			nil,                         // arguments
+		)
+		if errExchange != nil {
+			return errExchange
+		}
+	}
+	if rabbitmqConfig.QueueName == "" {
+		return nil
+	}
+	_, errQueue := channel.QueueDeclare(
+		rabbitmqConfig.QueueName, // name
+		true,                     // durable
+		false,                    // delete when unused
+		false,                    // exclusive
+		false,                    // no-wait
+		nil,                      // arguments
+	)
+	if errQueue != nil {
+		return errQueue
+	}
+	if rabbitmqConfig.Exchange != "" {
+		return channel.QueueBind(rabbitmqConfig.QueueName, rabbitmqConfig.BindingKey, rabbitmqConfig.Exchange, false, nil)
+	}
+	return nil
+}
+
+func (queueNotifier *QueueNotifier) disconnect() {
+	if queueNotifier.channel != nil {
+		queueNotifier.channel.Close()
+	}
+	if queueNotifier.connection != nil {
+		queueNotifier.connection.Close()
+	}
+	queueNotifier.channel = nil
+	queueNotifier.connection = nil
+	queueNotifier.connClosed = nil
+	queueNotifier.confirms = nil
+}
+
+// publish sends message and waits for broker confirmation
+func (queueNotifier *QueueNotifier) publish(message queueMessage) error {
+	err := queueNotifier.channel.Publish(
+		queueNotifier.Config.Exchange, // exchange
+		message.routingKey,            // routing key
+		false,                         // mandatory
+		false,
+		message.publishing)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(queueNotifier.ConfirmTimeout)
+	defer timer.Stop()
+	select {
+	case confirmation, ok := <-queueNotifier.confirms:
+		if !ok {
+			return errors.New("Channel closed before message was confirmed.")
+		}
+		if !confirmation.Ack {
+			return errors.New("Message was not acknowledged by broker.")
+		}
+		return nil
+	case <-timer.C:
+		return errors.New("Timed out waiting for broker confirmation.")
+	}
+}
+
+// next returns pending message if any or waits for a new buffered one
+func (queueNotifier *QueueNotifier) next() (queueMessage, bool) {
+	if queueNotifier.pending != nil {
+		message := *queueNotifier.pending
+		queueNotifier.pending = nil
+		return message, true
+	}
+	select {
+	case message := <-queueNotifier.buffer:
+		return message, true
+	case amqpErr := <-queueNotifier.connClosed:
+		log.Printf("RabbitMQ connection closed: %v", amqpErr)
+		queueNotifier.disconnect()
+	case <-queueNotifier.stop:
+	}
+	return queueMessage{}, false
+}
+
+func (queueNotifier *QueueNotifier) run() {
+	defer close(queueNotifier.done)
+	defer queueNotifier.disconnect()
+
+	delay := queueNotifier.ReconnectDelay
+	for {
+		select {
+		case <-queueNotifier.stop:
+			queueNotifier.flush()
+			return
+		default:
+		}
+
+		if queueNotifier.connection == nil {
+			if connectErr := queueNotifier.connect(); connectErr != nil {
+				log.Printf("Failed to connect to RabbitMQ, retrying in %s: %s", delay, connectErr.Error())
+				if !queueNotifier.wait(&delay) {
+					return
+				}
+				continue
+			}
+			// A message that failed to publish keeps the backoff until it succeeds
+			if queueNotifier.pending == nil {
+				delay = queueNotifier.ReconnectDelay
+			}
+		}
+
+		message, ok := queueNotifier.next()
+		if !ok {
+			continue
+		}
+		if publishErr := queueNotifier.publish(message); publishErr != nil {
+			message.attempts++
+			if message.attempts >= queueNotifier.MaxPublishAttempts {
+				log.Printf("Failed to publish message to RabbitMQ %d times, dropping it: %s", message.attempts, publishErr.Error())
+			} else {
+				log.Printf("Failed to publish message to RabbitMQ, retrying in %s: %s", delay, publishErr.Error())
+				queueNotifier.pending = &message
+			}
+			queueNotifier.disconnect()
+			// Stopping while waiting is handled above so pending message is flushed
+			queueNotifier.wait(&delay)
+			continue
+		}
+		delay = queueNotifier.ReconnectDelay
+	}
+}
+
+// wait sleeps for delay and doubles it up to MaxReconnect, it returns false
+// if the notifier is stopped meanwhile
+func (queueNotifier *QueueNotifier) wait(delay *time.Duration) bool {
+	timer := time.NewTimer(*delay)
+	select {
+	case <-queueNotifier.stop:
+		timer.Stop()
+		return false
+	case <-timer.C:
+	}
+	*delay = *delay * 2
+	if *delay > queueNotifier.MaxReconnect {
+		*delay = queueNotifier.MaxReconnect
+	}
+	return true
+}
+
+// flush publishes pending and buffered messages until FlushTimeout is reached
+func (queueNotifier *QueueNotifier) flush() {
+	if queueNotifier.connection == nil {
+		if queueNotifier.pending != nil || len(queueNotifier.buffer) > 0 {
+			if connectErr := queueNotifier.connect(); connectErr != nil {
+				queueNotifier.keepPending()
+				return
+			}
+		} else {
+			return
+		}
+	}
+	deadline := time.Now().Add(queueNotifier.FlushTimeout)
+	for time.Now().Before(deadline) {
+		var message queueMessage
+		if queueNotifier.pending != nil {
+			message = *queueNotifier.pending
+			queueNotifier.pending = nil
+		} else {
+			select {
+			case message = <-queueNotifier.buffer:
+			default:
+				return
+			}
+		}
+		if publishErr := queueNotifier.publish(message); publishErr != nil {
+			queueNotifier.pending = &message
+			break
+		}
+	}
+	queueNotifier.keepPending()
+}
+
+// keepPending puts back pending message so Close can report it
+func (queueNotifier *QueueNotifier) keepPending() {
+	if queueNotifier.pending == nil {
+		return
+	}
+	select {
+	case queueNotifier.buffer <- *queueNotifier.pending:
+	default:
+	}
+	queueNotifier.pending = nil
+}
@@ -0,0 +1,63 @@
+package notifier
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+// SlackMessage is a Slack incoming webhook payload
+type SlackMessage struct {
+	Text        string            `json:"text"`
+	Channel     string            `json:"channel,omitempty"`
+	Username    string            `json:"username,omitempty"`
+	Attachments []SlackAttachment `json:"attachments"`
+}
+
+// SlackAttachment shows event changes with the severity colour
+type SlackAttachment struct {
+	Color    string `json:"color"`
+	Fallback string `json:"fallback"`
+	Title    string `json:"title"`
+	Text     string `json:"text"`
+	Footer   string `json:"footer"`
+}
+
+// SlackNotifier sends events to a Slack compatible incoming webhook
+type SlackNotifier struct {
+	Config config_reader.Slack
+	Client *http.Client
+}
+
+// NewSlackNotifier returns a SlackNotifier for config
+func NewSlackNotifier(config config_reader.Slack) *SlackNotifier {
+	return &SlackNotifier{Config: config, Client: &http.Client{Timeout: config.Timeout}}
+}
+
+// Name returns notifier name
+func (slackNotifier *SlackNotifier) Name() string {
+	return "slack"
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// NewSlackMessage renders event as a webhook payload with one attachment
+func NewSlackMessage(config config_reader.Slack, event Event) SlackMessage {
+	message := NewChatMessage(event)
+	title := slackEscaper.Replace(message.Title())
+	attachment := SlackAttachment{
+		Color:    message.Color,
+		Fallback: slackEscaper.Replace(message.Text()),
+		Title:    title,
+		Text:     slackEscaper.Replace(strings.Join(message.Lines, "\n")),
+		Footer:   "Device " + slackEscaper.Replace(message.DeviceID),
+	}
+	return SlackMessage{Text: title, Channel: config.Channel, Username: config.Username, Attachments: []SlackAttachment{attachment}}
+}
+
+// Send posts event to configured webhook
+func (slackNotifier *SlackNotifier) Send(ctx context.Context, event Event) error {
+	return sendJSON(ctx, slackNotifier.Client, http.MethodPost, slackNotifier.Config.WebhookURL, nil, NewSlackMessage(slackNotifier.Config, event), nil)
+}
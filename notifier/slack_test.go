@@ -0,0 +1,54 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+func TestSlackSendsColouredAttachment(t *testing.T) {
+
+	var message SlackMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&message)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	slackNotifier := NewSlackNotifier(config_reader.Slack{Enabled: true, WebhookURL: server.URL + "/services/T000/B000", Channel: "#alarms", Username: "watcher", Timeout: time.Second})
+	event := Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldMode, "disarmed", "armed_home", time.Now())}}
+	if err := slackNotifier.Send(context.TODO(), event); err != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", err.Error())
+	}
+	if message.Text != "ℹ️ [MODE] Home Alarm" || message.Channel != "#alarms" || message.Username != "watcher" {
+		t.Errorf("Unexpected Slack message %+v.", message)
+	}
+	if len(message.Attachments) != 1 {
+		t.Fatalf("Slack message should have one attachment, not %d.", len(message.Attachments))
+	}
+	attachment := message.Attachments[0]
+	if attachment.Color != "#2e7d32" || attachment.Text != "Mode disarmed → armed_home" || attachment.Footer != "Device ab123" {
+		t.Errorf("Unexpected Slack attachment %+v.", attachment)
+	}
+}
+
+func TestSlackWebhookFailure(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no_service"))
+	}))
+	defer server.Close()
+
+	slackNotifier := NewSlackNotifier(config_reader.Slack{Enabled: true, WebhookURL: server.URL, Timeout: time.Second})
+	err := slackNotifier.Send(context.TODO(), webhookEvent())
+	if err == nil || err.Error() != "Request failed with status 404: no_service" {
+		t.Errorf("Send should fail with webhook response, error was '%v'.", err)
+	}
+}
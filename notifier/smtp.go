@@ -0,0 +1,173 @@
+package notifier
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+// SMTPSender delivers messages through the configured SMTP server
+type SMTPSender struct {
+	Config    config_reader.MailServer
+	TLSConfig *tls.Config
+}
+
+// NewSMTPSender returns a SMTPSender verifying server certificate against
+// configured CA or system roots
+func NewSMTPSender(config config_reader.MailServer) (SMTPSender, error) {
+	sender := SMTPSender{Config: config}
+	if config.Mode != config_reader.MailModePlain {
+		tlsConfig, tlsErr := NewTLSConfig(config.TLS)
+		if tlsErr != nil {
+			return sender, tlsErr
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = config.SMTPHost
+		}
+		sender.TLSConfig = tlsConfig
+	}
+	return sender, nil
+}
+
+// defaultSMTPTimeout bounds deliveries when no timeout is configured
+const defaultSMTPTimeout = time.Second * 30
+
+// Send delivers message to recipients using from as envelope sender. The
+// whole delivery is bounded by configured timeout or ctx deadline if earlier.
+func (sender SMTPSender) Send(ctx context.Context, from string, recipients []string, message []byte) error {
+	config := sender.Config
+	if len(recipients) == 0 {
+		return errors.New("No mail recipients were defined.")
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultSMTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	address := net.JoinHostPort(config.SMTPHost, strconv.Itoa(config.SMTPPort))
+
+	var conn net.Conn
+	var err error
+	if config.Mode == config_reader.MailModeTLS {
+		dialer := tls.Dialer{Config: sender.tlsConfig()}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, config.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if config.Mode == config_reader.MailModeStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP server " + address + " does not support STARTTLS.")
+		}
+		if err = client.StartTLS(sender.tlsConfig()); err != nil {
+			return err
+		}
+	}
+
+	if auth := sender.auth(); auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("SMTP server " + address + " does not support authentication.")
+		}
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err = client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("Recipient %s rejected: %w", recipient, err)
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (sender SMTPSender) tlsConfig() *tls.Config {
+	if sender.TLSConfig == nil {
+		return &tls.Config{ServerName: sender.Config.SMTPHost}
+	}
+	return sender.TLSConfig.Clone()
+}
+
+func (sender SMTPSender) auth() smtp.Auth {
+	config := sender.Config
+	switch config.Auth {
+	case config_reader.MailAuthNone:
+		return nil
+	case config_reader.MailAuthLogin:
+		return loginAuth{username: config.SMTPName, password: config.SMTPPassword, host: config.SMTPHost}
+	case config_reader.MailAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(config.SMTPName, config.SMTPPassword)
+	}
+	return smtp.PlainAuth("", config.SMTPName, config.SMTPPassword, config.SMTPHost)
+}
+
+// loginAuth implements LOGIN authentication, like smtp.PlainAuth it refuses
+// to send credentials over unencrypted connections except to localhost
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (auth loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != auth.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (auth loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username":
+		return []byte(auth.username), nil
+	case "password":
+		return []byte(auth.password), nil
+	}
+	return nil, fmt.Errorf("Unexpected LOGIN challenge %q.", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,314 @@
+package notifier
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+// FakeMail is a message received by FakeSMTPServer
+type FakeMail struct {
+	From       string
+	Recipients []string
+	Data       string
+	TLS        bool
+	Auth       string
+}
+
+// FakeSMTPServer is a minimal SMTP server supporting implicit TLS,
+// STARTTLS and PLAIN, LOGIN and CRAM-MD5 authentication
+type FakeSMTPServer struct {
+	Username string
+	Password string
+	// ImplicitTLS wraps accepted connections in TLS
+	ImplicitTLS bool
+	// TLSConfig enables STARTTLS when ImplicitTLS is false
+	TLSConfig *tls.Config
+
+	listener net.Listener
+	mutex    sync.Mutex
+	mails    []FakeMail
+}
+
+func NewFakeSMTPServer(t *testing.T, server *FakeSMTPServer) *FakeSMTPServer {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	if server.ImplicitTLS {
+		listener = tls.NewListener(listener, server.TLSConfig)
+	}
+	server.listener = listener
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (server *FakeSMTPServer) Port() int {
+	return server.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (server *FakeSMTPServer) Mails() []FakeMail {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]FakeMail{}, server.mails...)
+}
+
+func (server *FakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	isTLS := server.ImplicitTLS
+	current := FakeMail{}
+	text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, readErr := text.ReadLine()
+		if readErr != nil {
+			return
+		}
+		verb, argument := line, ""
+		if index := strings.Index(line, " "); index >= 0 {
+			verb, argument = line[:index], line[index+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-localhost")
+			if !isTLS && server.TLSConfig != nil {
+				text.PrintfLine("250-STARTTLS")
+			}
+			text.PrintfLine("250 AUTH PLAIN LOGIN CRAM-MD5")
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, server.TLSConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			isTLS = true
+		case "AUTH":
+			mechanism, ok := server.authenticate(text, argument)
+			if !ok {
+				text.PrintfLine("535 Authentication failed")
+				continue
+			}
+			current.Auth = mechanism
+			text.PrintfLine("235 Authentication succeeded")
+		case "MAIL":
+			current.From = strings.Trim(strings.TrimPrefix(argument, "FROM:"), "<>")
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			current.Recipients = append(current.Recipients, strings.Trim(strings.TrimPrefix(argument, "TO:"), "<>"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, dataErr := io.ReadAll(text.DotReader())
+			if dataErr != nil {
+				return
+			}
+			current.Data = string(data)
+			current.TLS = isTLS
+			server.mutex.Lock()
+			server.mails = append(server.mails, current)
+			server.mutex.Unlock()
+			current = FakeMail{Auth: current.Auth}
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (server *FakeSMTPServer) authenticate(text *textproto.Conn, argument string) (string, bool) {
+	fields := strings.Fields(argument)
+	if len(fields) == 0 {
+		return "", false
+	}
+	readResponse := func(challenge string) string {
+		text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+		line, _ := text.ReadLine()
+		decoded, _ := base64.StdEncoding.DecodeString(line)
+		return string(decoded)
+	}
+	mechanism := strings.ToUpper(fields[0])
+	switch mechanism {
+	case "PLAIN":
+		var response string
+		if len(fields) > 1 {
+			decoded, _ := base64.StdEncoding.DecodeString(fields[1])
+			response = string(decoded)
+		} else {
+			response = readResponse("")
+		}
+		return mechanism, response == "\x00"+server.Username+"\x00"+server.Password
+	case "LOGIN":
+		username := readResponse("Username:")
+		password := readResponse("Password:")
+		return mechanism, username == server.Username && password == server.Password
+	case "CRAM-MD5":
+		challenge := "<1234@localhost>"
+		response := readResponse(challenge)
+		digest := hmac.New(md5.New, []byte(server.Password))
+		digest.Write([]byte(challenge))
+		return mechanism, response == fmt.Sprintf("%s %s", server.Username, hex.EncodeToString(digest.Sum(nil)))
+	}
+	return mechanism, false
+}
+
+// newTestSMTPTLS returns server TLS config and a client TLS config trusting it
+func newTestSMTPTLS(t *testing.T) (*tls.Config, config_reader.TLSConfig) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	certificate, loadErr := tls.LoadX509KeyPair(certFile, keyFile)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}}, config_reader.TLSConfig{Enabled: true, CAFile: certFile, Verify: true}
+}
+
+func newTestSMTPSender(t *testing.T, mailServer config_reader.MailServer) SMTPSender {
+	sender, senderErr := NewSMTPSender(mailServer)
+	if senderErr != nil {
+		t.Fatalf("NewSMTPSender should not fail, error was '%s'.", senderErr.Error())
+	}
+	return sender
+}
+
+func TestSMTPSenderImplicitTLS(t *testing.T) {
+
+	serverTLS, clientTLS := newTestSMTPTLS(t)
+	server := NewFakeSMTPServer(t, &FakeSMTPServer{Username: "alarms", Password: "secret", ImplicitTLS: true, TLSConfig: serverTLS})
+	sender := newTestSMTPSender(t, config_reader.MailServer{SMTPHost: "127.0.0.1", SMTPPort: server.Port(), SMTPName: "alarms", SMTPPassword: "secret", Mode: config_reader.MailModeTLS, Auth: config_reader.MailAuthPlain, TLS: clientTLS})
+
+	err := sender.Send(context.TODO(), "alarms@example.com", []string{"owner@example.com", "audit@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", err.Error())
+	}
+	mails := server.Mails()
+	if len(mails) != 1 {
+		t.Fatalf("Server should receive one mail, not %d.", len(mails))
+	}
+	if mails[0].From != "alarms@example.com" || len(mails[0].Recipients) != 2 || !mails[0].TLS || mails[0].Auth != "PLAIN" {
+		t.Errorf("Unexpected mail received %+v.", mails[0])
+	}
+}
+
+func TestSMTPSenderStartTLSWithLogin(t *testing.T) {
+
+	serverTLS, clientTLS := newTestSMTPTLS(t)
+	server := NewFakeSMTPServer(t, &FakeSMTPServer{Username: "alarms", Password: "secret", TLSConfig: serverTLS})
+	sender := newTestSMTPSender(t, config_reader.MailServer{SMTPHost: "127.0.0.1", SMTPPort: server.Port(), SMTPName: "alarms", SMTPPassword: "secret", Mode: config_reader.MailModeStartTLS, Auth: config_reader.MailAuthLogin, TLS: clientTLS})
+
+	if err := sender.Send(context.TODO(), "alarms@example.com", []string{"owner@example.com"}, []byte("body\r\n")); err != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", err.Error())
+	}
+	mails := server.Mails()
+	if len(mails) != 1 || !mails[0].TLS || mails[0].Auth != "LOGIN" {
+		t.Errorf("Mail should be sent after STARTTLS using LOGIN auth, received %+v.", mails)
+	}
+}
+
+func TestSMTPSenderPlainWithCRAMMD5(t *testing.T) {
+
+	server := NewFakeSMTPServer(t, &FakeSMTPServer{Username: "alarms", Password: "secret"})
+	sender := newTestSMTPSender(t, config_reader.MailServer{SMTPHost: "127.0.0.1", SMTPPort: server.Port(), SMTPName: "alarms", SMTPPassword: "secret", Mode: config_reader.MailModePlain, Auth: config_reader.MailAuthCRAMMD5})
+
+	if err := sender.Send(context.TODO(), "alarms@example.com", []string{"owner@example.com"}, []byte("body\r\n")); err != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", err.Error())
+	}
+	mails := server.Mails()
+	if len(mails) != 1 || mails[0].TLS || mails[0].Auth != "CRAM-MD5" {
+		t.Errorf("Mail should be sent without TLS using CRAM-MD5 auth, received %+v.", mails)
+	}
+}
+
+func TestSMTPSenderWrongPassword(t *testing.T) {
+
+	server := NewFakeSMTPServer(t, &FakeSMTPServer{Username: "alarms", Password: "secret"})
+	sender := newTestSMTPSender(t, config_reader.MailServer{SMTPHost: "127.0.0.1", SMTPPort: server.Port(), SMTPName: "alarms", SMTPPassword: "wrong", Mode: config_reader.MailModePlain, Auth: config_reader.MailAuthLogin})
+
+	if err := sender.Send(context.TODO(), "alarms@example.com", []string{"owner@example.com"}, []byte("body\r\n")); err == nil {
+		t.Errorf("Send should fail when authentication is rejected.")
+	}
+}
+
+func TestSMTPSenderVerifiesCertificate(t *testing.T) {
+
+	serverTLS, _ := newTestSMTPTLS(t)
+	server := NewFakeSMTPServer(t, &FakeSMTPServer{Username: "alarms", Password: "secret", ImplicitTLS: true, TLSConfig: serverTLS})
+	// Server certificate is not signed by system roots
+	sender := newTestSMTPSender(t, config_reader.MailServer{SMTPHost: "127.0.0.1", SMTPPort: server.Port(), SMTPName: "alarms", SMTPPassword: "secret", Mode: config_reader.MailModeTLS, Auth: config_reader.MailAuthPlain, TLS: config_reader.TLSConfig{Enabled: true, Verify: true}})
+
+	if err := sender.Send(context.TODO(), "alarms@example.com", []string{"owner@example.com"}, []byte("body\r\n")); err == nil {
+		t.Errorf("Send should fail when server certificate cannot be verified.")
+	}
+	if len(server.Mails()) != 0 {
+		t.Errorf("No mail should be delivered when certificate verification fails.")
+	}
+}
+
+func TestSMTPSenderStartTLSNotSupported(t *testing.T) {
+
+	server := NewFakeSMTPServer(t, &FakeSMTPServer{Username: "alarms", Password: "secret"})
+	sender := newTestSMTPSender(t, config_reader.MailServer{SMTPHost: "127.0.0.1", SMTPPort: server.Port(), SMTPName: "alarms", SMTPPassword: "secret", Mode: config_reader.MailModeStartTLS, Auth: config_reader.MailAuthPlain, TLS: config_reader.TLSConfig{Enabled: true, Verify: true}})
+
+	err := sender.Send(context.TODO(), "alarms@example.com", []string{"owner@example.com"}, []byte("body\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "does not support STARTTLS") {
+		t.Errorf("Send should fail when server does not support STARTTLS, error was '%v'.", err)
+	}
+}
+
+func TestSMTPSenderTimesOutUnresponsiveServer(t *testing.T) {
+
+	// Server accepts connections but never sends its greeting
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("Listen should not fail, error was '%s'.", listenErr.Error())
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	sender := newTestSMTPSender(t, config_reader.MailServer{SMTPHost: "127.0.0.1", SMTPPort: port, Mode: config_reader.MailModePlain, Auth: config_reader.MailAuthNone, Timeout: time.Millisecond * 100})
+
+	start := time.Now()
+	if err := sender.Send(context.TODO(), "alarms@example.com", []string{"owner@example.com"}, []byte("body\r\n")); err == nil {
+		t.Errorf("Send should fail when server does not answer.")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Send should give up after configured timeout, it took %s.", elapsed)
+	}
+}
@@ -0,0 +1,61 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"html"
+	"net/http"
+	"strings"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+// TelegramMessage is the Bot API sendMessage request
+type TelegramMessage struct {
+	ChatID                string `json:"chat_id"`
+	Text                  string `json:"text"`
+	ParseMode             string `json:"parse_mode"`
+	DisableWebPagePreview bool   `json:"disable_web_page_preview"`
+}
+
+// TelegramNotifier sends events to a chat through the Telegram Bot API
+type TelegramNotifier struct {
+	Config config_reader.Telegram
+	Client *http.Client
+}
+
+// NewTelegramNotifier returns a TelegramNotifier for config
+func NewTelegramNotifier(config config_reader.Telegram) *TelegramNotifier {
+	return &TelegramNotifier{Config: config, Client: &http.Client{Timeout: config.Timeout}}
+}
+
+// Name returns notifier name
+func (telegramNotifier *TelegramNotifier) Name() string {
+	return "telegram"
+}
+
+// NewTelegramMessage renders event as an HTML Telegram message
+func NewTelegramMessage(chatID string, event Event) TelegramMessage {
+	message := NewChatMessage(event)
+	lines := []string{"<b>" + html.EscapeString(message.Title()) + "</b>", "<code>" + html.EscapeString(message.DeviceID) + "</code>"}
+	for _, line := range message.Lines {
+		lines = append(lines, html.EscapeString(line))
+	}
+	return TelegramMessage{ChatID: chatID, Text: strings.Join(lines, "\n"), ParseMode: "HTML", DisableWebPagePreview: true}
+}
+
+// Send posts event to configured chat
+func (telegramNotifier *TelegramNotifier) Send(ctx context.Context, event Event) error {
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	requestURL := telegramNotifier.Config.APIURL + "/bot" + telegramNotifier.Config.Token + "/sendMessage"
+	if sendErr := sendJSON(ctx, telegramNotifier.Client, http.MethodPost, requestURL, nil, NewTelegramMessage(telegramNotifier.Config.ChatID, event), &result); sendErr != nil {
+		return sendErr
+	}
+	if !result.OK {
+		return errors.New("Telegram rejected message: " + result.Description)
+	}
+	return nil
+}
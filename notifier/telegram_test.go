@@ -0,0 +1,62 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+func TestTelegramSendsHTMLMessage(t *testing.T) {
+
+	var path string
+	var message TelegramMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&message)
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	defer server.Close()
+
+	telegramNotifier := NewTelegramNotifier(config_reader.Telegram{Enabled: true, APIURL: server.URL, Token: "123:ABC", ChatID: "-100123", Timeout: time.Second})
+	event := webhookEvent()
+	event.DeviceName = "Home <Alarm>"
+	if err := telegramNotifier.Send(context.TODO(), event); err != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", err.Error())
+	}
+	if path != "/bot123:ABC/sendMessage" {
+		t.Errorf("Telegram request path should be '/bot123:ABC/sendMessage', not '%s'.", path)
+	}
+	if message.ChatID != "-100123" || message.ParseMode != "HTML" {
+		t.Errorf("Unexpected Telegram message %+v.", message)
+	}
+	if message.Text != "<b>🚨 [FIRING] Home &lt;Alarm&gt;</b>\n<code>ab123</code>\nStarted Firing" {
+		t.Errorf("Unexpected Telegram text '%s'.", message.Text)
+	}
+}
+
+func TestTelegramRejectedMessage(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+	}))
+	defer server.Close()
+
+	telegramNotifier := NewTelegramNotifier(config_reader.Telegram{Enabled: true, APIURL: server.URL, Token: "123:ABC", ChatID: "-1", Timeout: time.Second})
+	err := telegramNotifier.Send(context.TODO(), webhookEvent())
+	if err == nil || !strings.Contains(err.Error(), "chat not found") {
+		t.Errorf("Send should return Telegram error description, error was '%v'.", err)
+	}
+
+	server.Close()
+	err = telegramNotifier.Send(context.TODO(), webhookEvent())
+	if err == nil || strings.Contains(err.Error(), "123:ABC") {
+		t.Errorf("Connection errors should not include the bot token, error was '%v'.", err)
+	}
+}
@@ -0,0 +1,39 @@
+package notifier
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+// NewTLSConfig builds a client tls.Config loading configured CA and client
+// certificate, system roots are used when no CA is set
+func NewTLSConfig(tlsConfig config_reader.TLSConfig) (*tls.Config, error) {
+	clientConfig := &tls.Config{
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: !tlsConfig.Verify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if tlsConfig.CAFile != "" {
+		caPEM, readErr := os.ReadFile(tlsConfig.CAFile)
+		if readErr != nil {
+			return nil, readErr
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("No certificates found in CA file " + tlsConfig.CAFile + ".")
+		}
+		clientConfig.RootCAs = rootCAs
+	}
+	if tlsConfig.CertFile != "" {
+		certificate, loadErr := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		clientConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return clientConfig, nil
+}
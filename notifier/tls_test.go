@@ -0,0 +1,75 @@
+package notifier
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+)
+
+// writeTestCertificate writes a self signed certificate and its key to dir
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certificate, certErr := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if certErr != nil {
+		t.Fatal(certErr)
+	}
+	keyBytes, marshalErr := x509.MarshalPKCS8PrivateKey(key)
+	if marshalErr != nil {
+		t.Fatal(marshalErr)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600)
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	tlsConfig, err := NewTLSConfig(config_reader.TLSConfig{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "broker", Verify: true})
+	if err != nil {
+		t.Fatalf("NewTLSConfig should not fail, error was '%s'.", err.Error())
+	}
+	if tlsConfig.RootCAs == nil || len(tlsConfig.Certificates) != 1 {
+		t.Errorf("CA and client certificate should be loaded.")
+	}
+	if tlsConfig.ServerName != "broker" || tlsConfig.InsecureSkipVerify {
+		t.Errorf("Unexpected tls config, server name '%s', insecure %t.", tlsConfig.ServerName, tlsConfig.InsecureSkipVerify)
+	}
+}
+
+func TestNewTLSConfigWithInvalidCA(t *testing.T) {
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, []byte("not a certificate"), 0600)
+	if _, err := NewTLSConfig(config_reader.TLSConfig{Enabled: true, CAFile: caFile, Verify: true}); err == nil {
+		t.Errorf("NewTLSConfig should fail when CA file contains no certificates.")
+	}
+}
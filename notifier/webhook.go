@@ -0,0 +1,196 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+// WebhookData holds the values available to webhook body templates
+type WebhookData struct {
+	Payload
+	Type events.Type
+	Text string
+}
+
+// DeadLetter is a webhook delivery that failed every attempt
+type DeadLetter struct {
+	Time     time.Time       `json:"time"`
+	URL      string          `json:"url"`
+	Method   string          `json:"method"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// WebhookNotifier sends events to an HTTP endpoint. Requests failing with a
+// 5xx status or a network error are retried with backoff up to
+// DeliveryTimeout, deliveries failing every attempt are written to the
+// dead-letter log.
+type WebhookNotifier struct {
+	Config   config_reader.Webhook
+	Client   *http.Client
+	Template *template.Template
+
+	mutex sync.Mutex
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// NewWebhookNotifier returns a WebhookNotifier for config
+func NewWebhookNotifier(config config_reader.Webhook) (*WebhookNotifier, error) {
+	webhookNotifier := &WebhookNotifier{Config: config, Client: &http.Client{Timeout: config.Timeout}}
+	if config.BodyTemplate != "" {
+		bodyTemplate, templateErr := template.New("webhook").Funcs(webhookFuncs).Option("missingkey=error").Parse(config.BodyTemplate)
+		if templateErr != nil {
+			return nil, templateErr
+		}
+		webhookNotifier.Template = bodyTemplate
+	}
+	return webhookNotifier, nil
+}
+
+// Name returns notifier name
+func (webhookNotifier *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+// Send delivers event retrying failed attempts, retries stop once
+// DeliveryTimeout is reached so an unreachable endpoint does not stall polling
+func (webhookNotifier *WebhookNotifier) Send(ctx context.Context, event Event) error {
+	body, bodyErr := webhookNotifier.body(event)
+	if bodyErr != nil {
+		return bodyErr
+	}
+	if webhookNotifier.Config.DeliveryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, webhookNotifier.Config.DeliveryTimeout)
+		defer cancel()
+	}
+
+	delay := webhookNotifier.Config.RetryDelay
+	attempts := 0
+	var deliveryErr error
+	for {
+		attempts++
+		var retry bool
+		if retry, deliveryErr = webhookNotifier.deliver(ctx, body); deliveryErr == nil {
+			return nil
+		}
+		if !retry || attempts > webhookNotifier.Config.Retries {
+			break
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			// Next attempt would start after the deadline
+			break
+		}
+		log.Printf("Webhook delivery failed, retrying in %s: %s", delay, deliveryErr.Error())
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			deliveryErr = ctx.Err()
+		case <-timer.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		delay = delay * 2
+	}
+	webhookNotifier.deadLetter(DeadLetter{Time: time.Now(), URL: webhookNotifier.Config.URL, Method: webhookNotifier.Config.Method, Attempts: attempts, Error: deliveryErr.Error(), Body: body})
+	return fmt.Errorf("Webhook delivery failed after %d attempts: %s", attempts, deliveryErr.Error())
+}
+
+// body renders event with configured template or returns its JSON payload
+func (webhookNotifier *WebhookNotifier) body(event Event) ([]byte, error) {
+	payload, payloadErr := event.Payload()
+	if payloadErr != nil || webhookNotifier.Template == nil {
+		return payload, payloadErr
+	}
+	data := WebhookData{Type: event.Type(), Text: event.Text()}
+	if unmarshalErr := json.Unmarshal(payload, &data.Payload); unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	var body bytes.Buffer
+	if templateErr := webhookNotifier.Template.Execute(&body, data); templateErr != nil {
+		return nil, templateErr
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, errors.New("Webhook body template did not render valid JSON.")
+	}
+	return body.Bytes(), nil
+}
+
+// deliver sends body once, it returns if a failed delivery can be retried
+func (webhookNotifier *WebhookNotifier) deliver(ctx context.Context, body []byte) (bool, error) {
+	request, requestErr := http.NewRequestWithContext(ctx, webhookNotifier.Config.Method, webhookNotifier.Config.URL, bytes.NewReader(body))
+	if requestErr != nil {
+		return false, requestErr
+	}
+	for name, value := range webhookNotifier.Config.Headers {
+		request.Header.Set(name, value)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if webhookNotifier.Config.Secret != "" {
+		request.Header.Set(webhookNotifier.Config.SignatureHeader, Sign(webhookNotifier.Config.Secret, body))
+	}
+
+	response, responseErr := webhookNotifier.Client.Do(request)
+	if responseErr != nil {
+		return ctx.Err() == nil, responseErr
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	return response.StatusCode >= 500, fmt.Errorf("Webhook returned status %d.", response.StatusCode)
+}
+
+// deadLetter appends letter to the dead-letter file, it is logged when there
+// is no file or it cannot be written
+func (webhookNotifier *WebhookNotifier) deadLetter(letter DeadLetter) {
+	line, _ := json.Marshal(letter)
+	if webhookNotifier.Config.DeadLetterFile != "" {
+		webhookNotifier.mutex.Lock()
+		defer webhookNotifier.mutex.Unlock()
+		file, openErr := os.OpenFile(webhookNotifier.Config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if openErr == nil {
+			_, writeErr := file.Write(append(line, '\n'))
+			closeErr := file.Close()
+			if writeErr == nil && closeErr == nil {
+				return
+			}
+		}
+		log.Printf("Failed to write webhook dead letter file %s.", webhookNotifier.Config.DeadLetterFile)
+	}
+	log.Printf("Webhook dead letter: %s", line)
+}
+
+// Sign returns the HMAC-SHA256 signature of body as "sha256=<hex>"
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
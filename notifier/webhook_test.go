@@ -0,0 +1,237 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	config_reader "github.com/a-castellano/AlarmStatusWatcher/config_reader"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+)
+
+func webhookEvent() Event {
+	return Event{DeviceID: "ab123", DeviceName: "Home Alarm", Changes: []events.ChangeEvent{events.New("ab123", "Home Alarm", events.FieldFiring, "false", "true", time.Now())}}
+}
+
+func webhookConfig(url string) config_reader.Webhook {
+	return config_reader.Webhook{Enabled: true, URL: url, Method: "POST", SignatureHeader: "X-AlarmStatusWatcher-Signature", Timeout: time.Second, Retries: 3, RetryDelay: time.Millisecond, DeliveryTimeout: time.Second * 10}
+}
+
+func TestWebhookSendsSignedTemplateBody(t *testing.T) {
+
+	var method, authorization, signature, contentType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		authorization = r.Header.Get("Authorization")
+		signature = r.Header.Get("X-AlarmStatusWatcher-Signature")
+		contentType = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	config := webhookConfig(server.URL)
+	config.Method = "PUT"
+	config.Headers = map[string]string{"authorization": "Bearer token"}
+	config.BodyTemplate = `{"text": {{json .Text}}, "device": {{json .DeviceID}}, "type": {{json .Type}}}`
+	config.Secret = "s3cr3t"
+	webhookNotifier, err := NewWebhookNotifier(config)
+	if err != nil {
+		t.Fatalf("NewWebhookNotifier should not fail, error was '%s'.", err.Error())
+	}
+	if sendErr := webhookNotifier.Send(context.TODO(), webhookEvent()); sendErr != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", sendErr.Error())
+	}
+	if method != "PUT" {
+		t.Errorf("Webhook method should be PUT, not '%s'.", method)
+	}
+	if authorization != "Bearer token" {
+		t.Errorf("Configured headers should be sent, Authorization was '%s'.", authorization)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Content-Type should be application/json, not '%s'.", contentType)
+	}
+	if signature != Sign("s3cr3t", body) {
+		t.Errorf("Signature header '%s' should match body signature.", signature)
+	}
+	var decoded map[string]string
+	if unmarshalErr := json.Unmarshal(body, &decoded); unmarshalErr != nil {
+		t.Fatalf("Webhook body should be valid JSON, error was '%s'.", unmarshalErr.Error())
+	}
+	if decoded["text"] != "Home Alarm - Started Firing" || decoded["device"] != "ab123" || decoded["type"] != string(events.TypeFiringStarted) {
+		t.Errorf("Webhook body was not rendered from the template, body was '%s'.", body)
+	}
+}
+
+func TestWebhookSendsPayloadWithoutTemplate(t *testing.T) {
+
+	var payload Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		if r.Header.Get("X-AlarmStatusWatcher-Signature") != "" {
+			t.Errorf("Signature header should not be sent without a secret.")
+		}
+	}))
+	defer server.Close()
+
+	webhookNotifier, _ := NewWebhookNotifier(webhookConfig(server.URL))
+	if sendErr := webhookNotifier.Send(context.TODO(), webhookEvent()); sendErr != nil {
+		t.Fatalf("Send should not fail, error was '%s'.", sendErr.Error())
+	}
+	if payload.Version != PayloadVersion || payload.DeviceID != "ab123" {
+		t.Errorf("Webhook body should be the event payload, got %+v.", payload)
+	}
+}
+
+func TestWebhookInvalidTemplate(t *testing.T) {
+
+	config := webhookConfig("http://localhost")
+	config.BodyTemplate = `{"text": {{json .Text}`
+	if _, err := NewWebhookNotifier(config); err == nil {
+		t.Errorf("NewWebhookNotifier should fail with an invalid template.")
+	}
+
+	config.BodyTemplate = `text: {{.Text}}`
+	webhookNotifier, _ := NewWebhookNotifier(config)
+	if err := webhookNotifier.Send(context.TODO(), webhookEvent()); err == nil || err.Error() != "Webhook body template did not render valid JSON." {
+		t.Errorf("Send should fail when the template does not render JSON.")
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	webhookNotifier, _ := NewWebhookNotifier(webhookConfig(server.URL))
+	if sendErr := webhookNotifier.Send(context.TODO(), webhookEvent()); sendErr != nil {
+		t.Fatalf("Send should succeed after retrying, error was '%s'.", sendErr.Error())
+	}
+	if requests != 3 {
+		t.Errorf("Webhook should be requested 3 times, not %d.", requests)
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	config := webhookConfig(server.URL)
+	config.DeadLetterFile = filepath.Join(t.TempDir(), "deadletter.log")
+	webhookNotifier, _ := NewWebhookNotifier(config)
+	sendErr := webhookNotifier.Send(context.TODO(), webhookEvent())
+	if sendErr == nil || sendErr.Error() != "Webhook delivery failed after 1 attempts: Webhook returned status 400." {
+		t.Errorf("Send should fail without retrying client errors, error was '%v'.", sendErr)
+	}
+	if requests != 1 {
+		t.Errorf("Webhook should be requested once, not %d.", requests)
+	}
+
+	content, readErr := ioutil.ReadFile(config.DeadLetterFile)
+	if readErr != nil {
+		t.Fatalf("Dead letter file should be written, error was '%s'.", readErr.Error())
+	}
+	var letter DeadLetter
+	if unmarshalErr := json.Unmarshal(content, &letter); unmarshalErr != nil {
+		t.Fatalf("Dead letter should be a JSON line, error was '%s'.", unmarshalErr.Error())
+	}
+	if letter.URL != server.URL || letter.Attempts != 1 || letter.Error != "Webhook returned status 400." || !strings.Contains(string(letter.Body), `"device_id":"ab123"`) {
+		t.Errorf("Dead letter does not describe the failed delivery, it was '%s'.", content)
+	}
+}
+
+func TestWebhookRetriesTimeouts(t *testing.T) {
+
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config := webhookConfig(server.URL)
+	config.Timeout = 50 * time.Millisecond
+	config.Retries = 1
+	webhookNotifier, _ := NewWebhookNotifier(config)
+	if sendErr := webhookNotifier.Send(context.TODO(), webhookEvent()); sendErr != nil {
+		t.Fatalf("Send should succeed after a timed out attempt, error was '%s'.", sendErr.Error())
+	}
+	if requests != 2 {
+		t.Errorf("Webhook should be requested twice, not %d.", requests)
+	}
+}
+
+func TestWebhookGivesUpAfterRetries(t *testing.T) {
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := webhookConfig(server.URL)
+	config.Retries = 2
+	config.DeadLetterFile = filepath.Join(t.TempDir(), "deadletter.log")
+	webhookNotifier, _ := NewWebhookNotifier(config)
+	if sendErr := webhookNotifier.Send(context.TODO(), webhookEvent()); sendErr == nil {
+		t.Errorf("Send should fail once retries are exhausted.")
+	}
+	if requests != 3 {
+		t.Errorf("Webhook should be requested 3 times, not %d.", requests)
+	}
+}
+
+func TestWebhookStopsRetryingAtDeliveryTimeout(t *testing.T) {
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := webhookConfig(server.URL)
+	config.Retries = 10
+	config.RetryDelay = time.Millisecond * 50
+	config.DeliveryTimeout = time.Millisecond * 200
+	config.DeadLetterFile = filepath.Join(t.TempDir(), "deadletter.log")
+	webhookNotifier, _ := NewWebhookNotifier(config)
+	start := time.Now()
+	sendErr := webhookNotifier.Send(context.TODO(), webhookEvent())
+	if sendErr == nil {
+		t.Errorf("Send should fail once delivery timeout is reached.")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Send should give up at delivery timeout, it took %s.", elapsed)
+	}
+	if requests >= 11 {
+		t.Errorf("Webhook should not be retried after delivery timeout, it was requested %d times.", requests)
+	}
+	if _, readErr := ioutil.ReadFile(config.DeadLetterFile); readErr != nil {
+		t.Errorf("Timed out delivery should be written to dead letter file, error was '%s'.", readErr.Error())
+	}
+}
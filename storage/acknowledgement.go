@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	goredis "github.com/go-redis/redis/v8"
+)
+
+// AcknowledgementsKey is the set holding IDs of devices with an acknowledged firing
+const AcknowledgementsKey = "acknowledgements"
+
+// AcknowledgementKeyPrefix prefixes the hash holding each device acknowledgement
+const AcknowledgementKeyPrefix = "acknowledgement:"
+
+// ErrUnknownDevice is returned when acknowledging a device without stored status
+var ErrUnknownDevice = errors.New("Device is not known.")
+
+// ErrNotFiring is returned when acknowledging a device which is not firing
+var ErrNotFiring = errors.New("Device is not firing.")
+
+// ErrAcknowledged is returned when saving the escalation of an acknowledged device
+var ErrAcknowledged = errors.New("Device firing is acknowledged.")
+
+type acknowledgementHash struct {
+	By      string `redis:"by"`
+	At      int64  `redis:"at"`
+	Comment string `redis:"comment"`
+}
+
+func acknowledgementKey(deviceID string) string {
+	return AcknowledgementKeyPrefix + deviceID
+}
+
+// Acknowledge stores acknowledgement of a firing device and stops its
+// escalation, devices not stored or not firing cannot be acknowledged
+func (storage Storage) Acknowledge(ctx context.Context, acknowledgement events.Acknowledgement) error {
+	alarmStatus, statusErr := storage.storedStatus(ctx, acknowledgement.DeviceID)
+	if statusErr != nil {
+		return statusErr
+	}
+	if !alarmStatus.Firing {
+		return ErrNotFiring
+	}
+
+	start := time.Now()
+	if addErr := storage.RedisClient.SAdd(ctx, AcknowledgementsKey, acknowledgement.DeviceID).Err(); addErr != nil {
+		return addErr
+	}
+	storage.Metrics.ObserveRedis("sadd", start)
+	start = time.Now()
+	setErr := storage.RedisClient.HSet(ctx, acknowledgementKey(acknowledgement.DeviceID),
+		"by", acknowledgement.By,
+		"at", unixMilli(acknowledgement.At),
+		"comment", acknowledgement.Comment).Err()
+	storage.Metrics.ObserveRedis("hset", start)
+	if setErr != nil {
+		return setErr
+	}
+	return storage.StopEscalation(ctx, acknowledgement.DeviceID)
+}
+
+// storedStatus returns deviceID stored status or ErrUnknownDevice
+func (storage Storage) storedStatus(ctx context.Context, deviceID string) (AlarmStatus, error) {
+	var alarmStatus AlarmStatus
+	start := time.Now()
+	statusCmd := storage.RedisClient.HGetAll(ctx, deviceID)
+	storage.Metrics.ObserveRedis("hgetall", start)
+	if statusCmd.Err() != nil && statusCmd.Err() != goredis.Nil {
+		return alarmStatus, statusCmd.Err()
+	}
+	if len(statusCmd.Val()) == 0 {
+		return alarmStatus, ErrUnknownDevice
+	}
+	scanErr := statusCmd.Scan(&alarmStatus)
+	return alarmStatus, scanErr
+}
+
+// Acknowledgements returns stored acknowledgements indexed by device ID
+func (storage Storage) Acknowledgements(ctx context.Context) (map[string]events.Acknowledgement, error) {
+	start := time.Now()
+	deviceIDs, membersErr := storage.RedisClient.SMembers(ctx, AcknowledgementsKey).Result()
+	storage.Metrics.ObserveRedis("smembers", start)
+	if membersErr != nil && membersErr != goredis.Nil {
+		return nil, membersErr
+	}
+	sort.Strings(deviceIDs)
+
+	acknowledgements := make(map[string]events.Acknowledgement, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		start = time.Now()
+		acknowledgementCmd := storage.RedisClient.HGetAll(ctx, acknowledgementKey(deviceID))
+		storage.Metrics.ObserveRedis("hgetall", start)
+		if acknowledgementCmd.Err() != nil {
+			return nil, acknowledgementCmd.Err()
+		}
+		if len(acknowledgementCmd.Val()) == 0 {
+			continue
+		}
+		var stored acknowledgementHash
+		if scanErr := acknowledgementCmd.Scan(&stored); scanErr != nil {
+			return nil, scanErr
+		}
+		acknowledgements[deviceID] = events.Acknowledgement{DeviceID: deviceID, By: stored.By, At: fromUnixMilli(stored.At), Comment: stored.Comment}
+	}
+	return acknowledgements, nil
+}
+
+// ClearAcknowledgement removes deviceID acknowledgement
+func (storage Storage) ClearAcknowledgement(ctx context.Context, deviceID string) error {
+	start := time.Now()
+	if delErr := storage.RedisClient.Del(ctx, acknowledgementKey(deviceID)).Err(); delErr != nil {
+		return delErr
+	}
+	storage.Metrics.ObserveRedis("del", start)
+	start = time.Now()
+	remErr := storage.RedisClient.SRem(ctx, AcknowledgementsKey, deviceID).Err()
+	storage.Metrics.ObserveRedis("srem", start)
+	return remErr
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	redismock "github.com/go-redis/redismock/v8"
+)
+
+func TestAcknowledge(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectHGetAll("ab123").SetVal(map[string]string{"online": "1", "firing": "1", "mode": "armed", "name": "Home"})
+	mock.ExpectSAdd("acknowledgements", "ab123").SetVal(1)
+	mock.ExpectHSet("acknowledgement:ab123", "by", "alice", "at", int64(1655150000000), "comment", "On my way").SetVal(3)
+	mock.ExpectDel("escalation:ab123").SetVal(1)
+	mock.ExpectSRem("escalations", "ab123").SetVal(1)
+
+	storageInstance := Storage{RedisClient: db}
+	acknowledgement := events.Acknowledgement{DeviceID: "ab123", By: "alice", At: time.Unix(1655150000, 0), Comment: "On my way"}
+	if err := storageInstance.Acknowledge(context.TODO(), acknowledgement); err != nil {
+		t.Error("TestAcknowledge should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestAcknowledge, expected redis calls were not made: ", err.Error())
+	}
+}
+
+func TestAcknowledgeRequiresFiringDevice(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectHGetAll("ab123").SetVal(map[string]string{})
+	mock.ExpectHGetAll("cd456").SetVal(map[string]string{"online": "1", "firing": "0", "mode": "armed", "name": "Home"})
+
+	storageInstance := Storage{RedisClient: db}
+	if err := storageInstance.Acknowledge(context.TODO(), events.Acknowledgement{DeviceID: "ab123", By: "alice"}); err != ErrUnknownDevice {
+		t.Errorf("TestAcknowledgeRequiresFiringDevice should fail for unknown devices, error was %v", err)
+	}
+	if err := storageInstance.Acknowledge(context.TODO(), events.Acknowledgement{DeviceID: "cd456", By: "alice"}); err != ErrNotFiring {
+		t.Errorf("TestAcknowledgeRequiresFiringDevice should fail for devices not firing, error was %v", err)
+	}
+}
+
+func TestAcknowledgements(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectSMembers("acknowledgements").SetVal([]string{"ab123"})
+	mock.ExpectHGetAll("acknowledgement:ab123").SetVal(map[string]string{"by": "alice", "at": "1655150000000", "comment": "On my way"})
+
+	storageInstance := Storage{RedisClient: db}
+	acknowledgements, err := storageInstance.Acknowledgements(context.TODO())
+	if err != nil {
+		t.Fatal("TestAcknowledgements should not fail. Error was ", err.Error())
+	}
+	acknowledgement, found := acknowledgements["ab123"]
+	if !found || acknowledgement.By != "alice" || !acknowledgement.At.Equal(time.Unix(1655150000, 0)) || acknowledgement.Comment != "On my way" {
+		t.Errorf("TestAcknowledgements, unexpected acknowledgements %+v", acknowledgements)
+	}
+}
+
+func TestClearAcknowledgement(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectDel("acknowledgement:ab123").SetVal(1)
+	mock.ExpectSRem("acknowledgements", "ab123").SetVal(1)
+
+	storageInstance := Storage{RedisClient: db}
+	if err := storageInstance.ClearAcknowledgement(context.TODO(), "ab123"); err != nil {
+		t.Error("TestClearAcknowledgement should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestClearAcknowledgement, expected redis calls were not made: ", err.Error())
+	}
+}
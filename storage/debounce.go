@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+)
+
+// DebouncesKey is the set holding IDs of devices with debounce state
+const DebouncesKey = "debounces"
+
+// DebounceKeyPrefix prefixes the hash holding each device debounce state
+const DebounceKeyPrefix = "debounce:"
+
+// DebounceState is the online debounce and flapping state of a device
+type DebounceState struct {
+	DeviceID string
+	// Last is the last observed value, Confirmed the value that held long
+	// enough and Notified the value users were told about
+	Last      string
+	Confirmed string
+	Notified  string
+
+	Candidate      string
+	CandidateSince time.Time
+	CandidatePolls int
+
+	Transitions []time.Time
+	Flapping    bool
+}
+
+type debounceHash struct {
+	Last           string `redis:"last"`
+	Confirmed      string `redis:"confirmed"`
+	Notified       string `redis:"notified"`
+	Candidate      string `redis:"candidate"`
+	CandidateSince int64  `redis:"candidatesince"`
+	CandidatePolls int    `redis:"candidatepolls"`
+	// Transitions are comma separated unix milliseconds
+	Transitions string `redis:"transitions"`
+	Flapping    bool   `redis:"flapping"`
+}
+
+func debounceKey(deviceID string) string {
+	return DebounceKeyPrefix + deviceID
+}
+
+// SaveDebounceState stores deviceID debounce state
+func (storage Storage) SaveDebounceState(ctx context.Context, state DebounceState) error {
+	transitions := make([]string, 0, len(state.Transitions))
+	for _, transition := range state.Transitions {
+		transitions = append(transitions, strconv.FormatInt(unixMilli(transition), 10))
+	}
+	var candidateSince int64
+	if !state.CandidateSince.IsZero() {
+		candidateSince = unixMilli(state.CandidateSince)
+	}
+	start := time.Now()
+	_, execErr := storage.RedisClient.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.SAdd(ctx, DebouncesKey, state.DeviceID)
+		pipe.HSet(ctx, debounceKey(state.DeviceID),
+			"last", state.Last,
+			"confirmed", state.Confirmed,
+			"notified", state.Notified,
+			"candidate", state.Candidate,
+			"candidatesince", candidateSince,
+			"candidatepolls", state.CandidatePolls,
+			"transitions", strings.Join(transitions, ","),
+			"flapping", state.Flapping)
+		return nil
+	})
+	storage.Metrics.ObserveRedis("exec", start)
+	return execErr
+}
+
+// DebounceStates returns stored debounce states by device ID
+func (storage Storage) DebounceStates(ctx context.Context) (map[string]DebounceState, error) {
+	start := time.Now()
+	deviceIDs, membersErr := storage.RedisClient.SMembers(ctx, DebouncesKey).Result()
+	storage.Metrics.ObserveRedis("smembers", start)
+	if membersErr != nil && membersErr != goredis.Nil {
+		return nil, membersErr
+	}
+	sort.Strings(deviceIDs)
+
+	states := make(map[string]DebounceState, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		start = time.Now()
+		stateCmd := storage.RedisClient.HGetAll(ctx, debounceKey(deviceID))
+		storage.Metrics.ObserveRedis("hgetall", start)
+		if stateCmd.Err() != nil {
+			return nil, stateCmd.Err()
+		}
+		if len(stateCmd.Val()) == 0 {
+			continue
+		}
+		var stored debounceHash
+		if scanErr := stateCmd.Scan(&stored); scanErr != nil {
+			return nil, scanErr
+		}
+		state := DebounceState{DeviceID: deviceID, Last: stored.Last, Confirmed: stored.Confirmed, Notified: stored.Notified, Candidate: stored.Candidate, CandidatePolls: stored.CandidatePolls, Flapping: stored.Flapping}
+		if stored.CandidateSince != 0 {
+			state.CandidateSince = fromUnixMilli(stored.CandidateSince)
+		}
+		for _, transition := range strings.Split(stored.Transitions, ",") {
+			if transition == "" {
+				continue
+			}
+			milliseconds, parseErr := strconv.ParseInt(transition, 10, 64)
+			if parseErr != nil {
+				return nil, parseErr
+			}
+			state.Transitions = append(state.Transitions, fromUnixMilli(milliseconds))
+		}
+		states[deviceID] = state
+	}
+	return states, nil
+}
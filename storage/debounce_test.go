@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	redismock "github.com/go-redis/redismock/v8"
+)
+
+func TestSaveDebounceState(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	since := time.Unix(1655150000, 0)
+	mock.ExpectTxPipeline()
+	mock.ExpectSAdd("debounces", "ab123").SetVal(1)
+	mock.ExpectHSet("debounce:ab123", "last", "false", "confirmed", "true", "notified", "true", "candidate", "false", "candidatesince", int64(1655150000000), "candidatepolls", 2, "transitions", "1655150000000,1655150010000", "flapping", true).SetVal(8)
+	mock.ExpectTxPipelineExec()
+
+	storageInstance := Storage{RedisClient: db}
+	state := DebounceState{DeviceID: "ab123", Last: "false", Confirmed: "true", Notified: "true", Candidate: "false", CandidateSince: since, CandidatePolls: 2, Transitions: []time.Time{since, since.Add(time.Second * 10)}, Flapping: true}
+	if err := storageInstance.SaveDebounceState(context.TODO(), state); err != nil {
+		t.Error("TestSaveDebounceState should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestSaveDebounceState, expected redis calls were not made: ", err.Error())
+	}
+}
+
+func TestDebounceStates(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectSMembers("debounces").SetVal([]string{"cd456", "ab123"})
+	mock.ExpectHGetAll("debounce:ab123").SetVal(map[string]string{"last": "false", "confirmed": "true", "notified": "true", "candidate": "false", "candidatesince": "1655150000000", "candidatepolls": "2", "transitions": "1655150000000,1655150010000", "flapping": "1"})
+	mock.ExpectHGetAll("debounce:cd456").SetVal(map[string]string{"last": "true", "confirmed": "true", "notified": "true", "candidate": "", "candidatesince": "0", "candidatepolls": "0", "transitions": "", "flapping": "0"})
+
+	storageInstance := Storage{RedisClient: db}
+	states, err := storageInstance.DebounceStates(context.TODO())
+	if err != nil {
+		t.Fatal("TestDebounceStates should not fail. Error was ", err.Error())
+	}
+	state := states["ab123"]
+	if state.Last != "false" || state.Confirmed != "true" || state.Candidate != "false" || !state.CandidateSince.Equal(time.Unix(1655150000, 0)) || state.CandidatePolls != 2 || !state.Flapping {
+		t.Errorf("TestDebounceStates, unexpected state %+v", state)
+	}
+	if len(state.Transitions) != 2 || !state.Transitions[1].Equal(time.Unix(1655150010, 0)) {
+		t.Errorf("TestDebounceStates, unexpected transitions %v", state.Transitions)
+	}
+	if state := states["cd456"]; !state.CandidateSince.IsZero() || len(state.Transitions) != 0 || state.Flapping {
+		t.Errorf("TestDebounceStates, unexpected state %+v", state)
+	}
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+)
+
+// EscalationsKey is the set holding IDs of devices with an active escalation
+const EscalationsKey = "escalations"
+
+// EscalationKeyPrefix prefixes the hash holding each device escalation state
+const EscalationKeyPrefix = "escalation:"
+
+// Escalation tracks repeated notifications of a firing device
+type Escalation struct {
+	DeviceID string
+	// Started is when device started firing
+	Started time.Time
+	// Notified is when device firing was last notified
+	Notified time.Time
+	Level    int
+	Count    int
+}
+
+type escalationHash struct {
+	Started  int64 `redis:"started"`
+	Notified int64 `redis:"notified"`
+	Level    int   `redis:"level"`
+	Count    int   `redis:"count"`
+}
+
+func escalationKey(deviceID string) string {
+	return EscalationKeyPrefix + deviceID
+}
+
+func unixMilli(timestamp time.Time) int64 {
+	return timestamp.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(milliseconds int64) time.Time {
+	return time.Unix(0, milliseconds*int64(time.Millisecond))
+}
+
+// StartEscalation starts tracking deviceID escalation, it started firing and
+// was notified at started
+func (storage Storage) StartEscalation(ctx context.Context, deviceID string, started time.Time) error {
+	return storage.SaveEscalation(ctx, Escalation{DeviceID: deviceID, Started: started, Notified: started})
+}
+
+// SaveEscalation stores escalation state. Acknowledgement is checked in the
+// same transaction, so an escalation stopped by Acknowledge is not stored
+// again, ErrAcknowledged is returned instead.
+func (storage Storage) SaveEscalation(ctx context.Context, escalation Escalation) error {
+	acknowledgement := acknowledgementKey(escalation.DeviceID)
+	start := time.Now()
+	watchErr := storage.RedisClient.Watch(ctx, func(tx *goredis.Tx) error {
+		acknowledged, existsErr := tx.Exists(ctx, acknowledgement).Result()
+		if existsErr != nil {
+			return existsErr
+		}
+		if acknowledged > 0 {
+			return ErrAcknowledged
+		}
+		_, execErr := tx.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			pipe.SAdd(ctx, EscalationsKey, escalation.DeviceID)
+			pipe.HSet(ctx, escalationKey(escalation.DeviceID),
+				"started", unixMilli(escalation.Started),
+				"notified", unixMilli(escalation.Notified),
+				"level", escalation.Level,
+				"count", escalation.Count)
+			return nil
+		})
+		return execErr
+	}, acknowledgement)
+	storage.Metrics.ObserveRedis("exec", start)
+	if watchErr == goredis.TxFailedErr {
+		// Acknowledgement was stored while escalation was being saved
+		return ErrAcknowledged
+	}
+	return watchErr
+}
+
+// Escalations returns active escalations sorted by device ID
+func (storage Storage) Escalations(ctx context.Context) ([]Escalation, error) {
+	start := time.Now()
+	deviceIDs, membersErr := storage.RedisClient.SMembers(ctx, EscalationsKey).Result()
+	storage.Metrics.ObserveRedis("smembers", start)
+	if membersErr != nil && membersErr != goredis.Nil {
+		return nil, membersErr
+	}
+	sort.Strings(deviceIDs)
+
+	escalations := make([]Escalation, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		start = time.Now()
+		escalationCmd := storage.RedisClient.HGetAll(ctx, escalationKey(deviceID))
+		storage.Metrics.ObserveRedis("hgetall", start)
+		if escalationCmd.Err() != nil {
+			return nil, escalationCmd.Err()
+		}
+		if len(escalationCmd.Val()) == 0 {
+			continue
+		}
+		var stored escalationHash
+		if scanErr := escalationCmd.Scan(&stored); scanErr != nil {
+			return nil, scanErr
+		}
+		escalations = append(escalations, Escalation{DeviceID: deviceID, Started: fromUnixMilli(stored.Started), Notified: fromUnixMilli(stored.Notified), Level: stored.Level, Count: stored.Count})
+	}
+	return escalations, nil
+}
+
+// StopEscalation removes deviceID escalation
+func (storage Storage) StopEscalation(ctx context.Context, deviceID string) error {
+	start := time.Now()
+	if delErr := storage.RedisClient.Del(ctx, escalationKey(deviceID)).Err(); delErr != nil {
+		return delErr
+	}
+	storage.Metrics.ObserveRedis("del", start)
+	start = time.Now()
+	remErr := storage.RedisClient.SRem(ctx, EscalationsKey, deviceID).Err()
+	storage.Metrics.ObserveRedis("srem", start)
+	return remErr
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	redismock "github.com/go-redis/redismock/v8"
+)
+
+func TestSaveEscalation(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	started := time.Unix(1655150000, 0)
+	mock.ExpectWatch("acknowledgement:ab123")
+	mock.ExpectExists("acknowledgement:ab123").SetVal(0)
+	mock.ExpectTxPipeline()
+	mock.ExpectSAdd("escalations", "ab123").SetVal(1)
+	mock.ExpectHSet("escalation:ab123", "started", int64(1655150000000), "notified", int64(1655150300000), "level", 1, "count", 2).SetVal(4)
+	mock.ExpectTxPipelineExec()
+
+	storageInstance := Storage{RedisClient: db}
+	escalation := Escalation{DeviceID: "ab123", Started: started, Notified: started.Add(time.Minute * 5), Level: 1, Count: 2}
+	if err := storageInstance.SaveEscalation(context.TODO(), escalation); err != nil {
+		t.Error("TestSaveEscalation should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestSaveEscalation, expected redis calls were not made: ", err.Error())
+	}
+}
+
+func TestSaveEscalationOfAcknowledgedDevice(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectWatch("acknowledgement:ab123")
+	mock.ExpectExists("acknowledgement:ab123").SetVal(1)
+
+	storageInstance := Storage{RedisClient: db}
+	escalation := Escalation{DeviceID: "ab123", Started: time.Unix(1655150000, 0), Notified: time.Unix(1655150300, 0), Level: 1, Count: 2}
+	if err := storageInstance.SaveEscalation(context.TODO(), escalation); err != ErrAcknowledged {
+		t.Errorf("TestSaveEscalationOfAcknowledgedDevice should return ErrAcknowledged, not %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestSaveEscalationOfAcknowledgedDevice, escalation should not be stored: ", err.Error())
+	}
+}
+
+func TestSaveEscalationAcknowledgedWhileSaving(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectWatch("acknowledgement:ab123")
+	mock.ExpectExists("acknowledgement:ab123").SetVal(0)
+	mock.ExpectTxPipeline()
+	mock.ExpectSAdd("escalations", "ab123").SetVal(1)
+	mock.ExpectHSet("escalation:ab123", "started", int64(1655150000000), "notified", int64(1655150300000), "level", 1, "count", 2).SetVal(4)
+	mock.ExpectTxPipelineExec().SetErr(goredis.TxFailedErr)
+
+	storageInstance := Storage{RedisClient: db}
+	escalation := Escalation{DeviceID: "ab123", Started: time.Unix(1655150000, 0), Notified: time.Unix(1655150300, 0), Level: 1, Count: 2}
+	if err := storageInstance.SaveEscalation(context.TODO(), escalation); err != ErrAcknowledged {
+		t.Errorf("TestSaveEscalationAcknowledgedWhileSaving should return ErrAcknowledged, not %v", err)
+	}
+}
+
+func TestEscalations(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectSMembers("escalations").SetVal([]string{"cd456", "ab123"})
+	mock.ExpectHGetAll("escalation:ab123").SetVal(map[string]string{"started": "1655150000000", "notified": "1655150300000", "level": "1", "count": "2"})
+	mock.ExpectHGetAll("escalation:cd456").SetVal(map[string]string{})
+
+	storageInstance := Storage{RedisClient: db}
+	escalations, err := storageInstance.Escalations(context.TODO())
+	if err != nil {
+		t.Fatal("TestEscalations should not fail. Error was ", err.Error())
+	}
+	if len(escalations) != 1 {
+		t.Fatalf("TestEscalations should skip escalations without state, %d were returned", len(escalations))
+	}
+	escalation := escalations[0]
+	if escalation.DeviceID != "ab123" || !escalation.Started.Equal(time.Unix(1655150000, 0)) || !escalation.Notified.Equal(time.Unix(1655150300, 0)) || escalation.Level != 1 || escalation.Count != 2 {
+		t.Errorf("TestEscalations, unexpected escalation %+v", escalation)
+	}
+}
+
+func TestStopEscalation(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectDel("escalation:ab123").SetVal(1)
+	mock.ExpectSRem("escalations", "ab123").SetVal(1)
+
+	storageInstance := Storage{RedisClient: db}
+	if err := storageInstance.StopEscalation(context.TODO(), "ab123"); err != nil {
+		t.Error("TestStopEscalation should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestStopEscalation, expected redis calls were not made: ", err.Error())
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	goredis "github.com/go-redis/redis/v8"
+)
+
+// HistoryKeyPrefix prefixes the sorted set holding each device changes
+const HistoryKeyPrefix = "history:"
+
+func historyKey(deviceID string) string {
+	return HistoryKeyPrefix + deviceID
+}
+
+func historyScore(timestamp time.Time) float64 {
+	return float64(timestamp.UnixNano() / int64(time.Millisecond))
+}
+
+// HistoryEnabled returns true when changes have to be stored
+func (storage Storage) HistoryEnabled() bool {
+	return storage.HistoryRetention > 0
+}
+
+// AppendHistory stores changes in each device history and removes changes
+// older than HistoryRetention
+func (storage Storage) AppendHistory(ctx context.Context, changes []events.ChangeEvent) error {
+	if !storage.HistoryEnabled() {
+		return nil
+	}
+	for deviceID, deviceChanges := range events.GroupByDevice(changes) {
+		members := make([]*goredis.Z, 0, len(deviceChanges))
+		for _, change := range deviceChanges {
+			member, marshalErr := json.Marshal(change)
+			if marshalErr != nil {
+				return marshalErr
+			}
+			members = append(members, &goredis.Z{Score: historyScore(change.Timestamp), Member: string(member)})
+		}
+		start := time.Now()
+		if addErr := storage.RedisClient.ZAdd(ctx, historyKey(deviceID), members...).Err(); addErr != nil {
+			return addErr
+		}
+		storage.Metrics.ObserveRedis("zadd", start)
+
+		oldest := historyScore(time.Now().Add(-storage.HistoryRetention))
+		start = time.Now()
+		if removeErr := storage.RedisClient.ZRemRangeByScore(ctx, historyKey(deviceID), "-inf", "("+strconv.FormatFloat(oldest, 'f', 0, 64)).Err(); removeErr != nil {
+			return removeErr
+		}
+		storage.Metrics.ObserveRedis("zremrangebyscore", start)
+	}
+	return nil
+}
+
+// History returns device changes between from and to, oldest first
+func (storage Storage) History(ctx context.Context, deviceID string, from time.Time, to time.Time) ([]events.ChangeEvent, error) {
+	changes := []events.ChangeEvent{}
+	rangeBy := goredis.ZRangeBy{
+		Min: strconv.FormatFloat(historyScore(from), 'f', 0, 64),
+		Max: strconv.FormatFloat(historyScore(to), 'f', 0, 64),
+	}
+	start := time.Now()
+	members, rangeErr := storage.RedisClient.ZRangeByScore(ctx, historyKey(deviceID), &rangeBy).Result()
+	storage.Metrics.ObserveRedis("zrangebyscore", start)
+	if rangeErr != nil && rangeErr != goredis.Nil {
+		return changes, rangeErr
+	}
+	for _, member := range members {
+		var change events.ChangeEvent
+		if unmarshalErr := json.Unmarshal([]byte(member), &change); unmarshalErr != nil {
+			return changes, unmarshalErr
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	goredis "github.com/go-redis/redis/v8"
+	redismock "github.com/go-redis/redismock/v8"
+)
+
+func TestAppendHistoryDisabled(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	storageInstance := Storage{RedisClient: db}
+	change := events.New("ab123", "Test", events.FieldFiring, "false", "true", time.Now())
+	if err := storageInstance.AppendHistory(context.TODO(), []events.ChangeEvent{change}); err != nil {
+		t.Error("TestAppendHistoryDisabled should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestAppendHistoryDisabled, no redis calls were expected: ", err.Error())
+	}
+}
+
+func TestAppendHistory(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	timestamp := time.Unix(1655150000, 0)
+	change := events.New("ab123", "Test", events.FieldFiring, "false", "true", timestamp)
+	member, _ := json.Marshal(change)
+
+	mock.ExpectZAdd("history:ab123", &goredis.Z{Score: 1655150000000, Member: string(member)}).SetVal(1)
+	mock.Regexp().ExpectZRemRangeByScore("history:ab123", "-inf", `^\(\d+$`).SetVal(0)
+
+	storageInstance := Storage{RedisClient: db, HistoryRetention: time.Hour}
+	if err := storageInstance.AppendHistory(context.TODO(), []events.ChangeEvent{change}); err != nil {
+		t.Error("TestAppendHistory should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestAppendHistory, expected redis calls were not made: ", err.Error())
+	}
+}
+
+func TestHistory(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	from := time.Unix(1655150000, 0)
+	to := time.Unix(1655160000, 0)
+	started := events.New("ab123", "Test", events.FieldFiring, "false", "true", from.Add(time.Minute))
+	stopped := events.New("ab123", "Test", events.FieldFiring, "true", "false", from.Add(time.Minute*2))
+	startedMember, _ := json.Marshal(started)
+	stoppedMember, _ := json.Marshal(stopped)
+
+	mock.ExpectZRangeByScore("history:ab123", &goredis.ZRangeBy{Min: "1655150000000", Max: "1655160000000"}).SetVal([]string{string(startedMember), string(stoppedMember)})
+
+	storageInstance := Storage{RedisClient: db, HistoryRetention: time.Hour}
+	changes, err := storageInstance.History(context.TODO(), "ab123", from, to)
+	if err != nil {
+		t.Fatal("TestHistory should not fail. Error was ", err.Error())
+	}
+	if len(changes) != 2 {
+		t.Fatalf("TestHistory should return 2 changes, not %d", len(changes))
+	}
+	if changes[0].Message() != "Started Firing" || changes[1].Message() != "Stopped Firing" {
+		t.Errorf("TestHistory, unexpected changes '%s'", events.RenderMessage(changes))
+	}
+	if !changes[0].Timestamp.Equal(started.Timestamp) {
+		t.Errorf("TestHistory, timestamp should be kept")
+	}
+}
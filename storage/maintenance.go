@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	goredis "github.com/go-redis/redis/v8"
+)
+
+// MaintenancesKey is the set holding IDs of devices under maintenance
+const MaintenancesKey = "maintenances"
+
+// MaintenanceKeyPrefix prefixes the hash holding each device maintenance window
+const MaintenanceKeyPrefix = "maintenance:"
+
+type maintenanceHash struct {
+	By      string `redis:"by"`
+	Reason  string `redis:"reason"`
+	Started int64  `redis:"started"`
+	Until   int64  `redis:"until"`
+}
+
+func maintenanceKey(deviceID string) string {
+	return MaintenanceKeyPrefix + deviceID
+}
+
+// StartMaintenance stores a maintenance window of a known device, an
+// existing window is replaced
+func (storage Storage) StartMaintenance(ctx context.Context, maintenance events.Maintenance) error {
+	if _, statusErr := storage.storedStatus(ctx, maintenance.DeviceID); statusErr != nil {
+		return statusErr
+	}
+	start := time.Now()
+	if addErr := storage.RedisClient.SAdd(ctx, MaintenancesKey, maintenance.DeviceID).Err(); addErr != nil {
+		return addErr
+	}
+	storage.Metrics.ObserveRedis("sadd", start)
+	start = time.Now()
+	setErr := storage.RedisClient.HSet(ctx, maintenanceKey(maintenance.DeviceID),
+		"by", maintenance.By,
+		"reason", maintenance.Reason,
+		"started", unixMilli(maintenance.Started),
+		"until", unixMilli(maintenance.Until)).Err()
+	storage.Metrics.ObserveRedis("hset", start)
+	return setErr
+}
+
+// Maintenances returns stored maintenance windows indexed by device ID,
+// expired ones are returned until EndMaintenance is called
+func (storage Storage) Maintenances(ctx context.Context) (map[string]events.Maintenance, error) {
+	start := time.Now()
+	deviceIDs, membersErr := storage.RedisClient.SMembers(ctx, MaintenancesKey).Result()
+	storage.Metrics.ObserveRedis("smembers", start)
+	if membersErr != nil && membersErr != goredis.Nil {
+		return nil, membersErr
+	}
+	sort.Strings(deviceIDs)
+
+	maintenances := make(map[string]events.Maintenance, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		start = time.Now()
+		maintenanceCmd := storage.RedisClient.HGetAll(ctx, maintenanceKey(deviceID))
+		storage.Metrics.ObserveRedis("hgetall", start)
+		if maintenanceCmd.Err() != nil {
+			return nil, maintenanceCmd.Err()
+		}
+		if len(maintenanceCmd.Val()) == 0 {
+			continue
+		}
+		var stored maintenanceHash
+		if scanErr := maintenanceCmd.Scan(&stored); scanErr != nil {
+			return nil, scanErr
+		}
+		maintenances[deviceID] = events.Maintenance{DeviceID: deviceID, By: stored.By, Reason: stored.Reason, Started: fromUnixMilli(stored.Started), Until: fromUnixMilli(stored.Until)}
+	}
+	return maintenances, nil
+}
+
+// EndMaintenance removes deviceID maintenance window
+func (storage Storage) EndMaintenance(ctx context.Context, deviceID string) error {
+	start := time.Now()
+	if delErr := storage.RedisClient.Del(ctx, maintenanceKey(deviceID)).Err(); delErr != nil {
+		return delErr
+	}
+	storage.Metrics.ObserveRedis("del", start)
+	start = time.Now()
+	remErr := storage.RedisClient.SRem(ctx, MaintenancesKey, deviceID).Err()
+	storage.Metrics.ObserveRedis("srem", start)
+	return remErr
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	redismock "github.com/go-redis/redismock/v8"
+)
+
+func TestStartMaintenance(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectHGetAll("ab123").SetVal(map[string]string{"online": "1", "firing": "0", "mode": "armed", "name": "Home"})
+	mock.ExpectSAdd("maintenances", "ab123").SetVal(1)
+	mock.ExpectHSet("maintenance:ab123", "by", "alice", "reason", "Panel replacement", "started", int64(1655150000000), "until", int64(1655157200000)).SetVal(4)
+	mock.ExpectHGetAll("cd456").SetVal(map[string]string{})
+
+	storageInstance := Storage{RedisClient: db}
+	started := time.Unix(1655150000, 0)
+	maintenance := events.Maintenance{DeviceID: "ab123", By: "alice", Reason: "Panel replacement", Started: started, Until: started.Add(time.Hour * 2)}
+	if err := storageInstance.StartMaintenance(context.TODO(), maintenance); err != nil {
+		t.Error("TestStartMaintenance should not fail. Error was ", err.Error())
+	}
+	if err := storageInstance.StartMaintenance(context.TODO(), events.Maintenance{DeviceID: "cd456"}); err != ErrUnknownDevice {
+		t.Errorf("TestStartMaintenance should fail for unknown devices, error was %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestStartMaintenance, expected redis calls were not made: ", err.Error())
+	}
+}
+
+func TestMaintenances(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectSMembers("maintenances").SetVal([]string{"ab123"})
+	mock.ExpectHGetAll("maintenance:ab123").SetVal(map[string]string{"by": "alice", "reason": "Panel replacement", "started": "1655150000000", "until": "1655157200000"})
+
+	storageInstance := Storage{RedisClient: db}
+	maintenances, err := storageInstance.Maintenances(context.TODO())
+	if err != nil {
+		t.Fatal("TestMaintenances should not fail. Error was ", err.Error())
+	}
+	maintenance, found := maintenances["ab123"]
+	if !found || maintenance.By != "alice" || maintenance.Reason != "Panel replacement" || !maintenance.Until.Equal(time.Unix(1655157200, 0)) {
+		t.Errorf("TestMaintenances, unexpected maintenances %+v", maintenances)
+	}
+}
+
+func TestEndMaintenance(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectDel("maintenance:ab123").SetVal(1)
+	mock.ExpectSRem("maintenances", "ab123").SetVal(1)
+
+	storageInstance := Storage{RedisClient: db}
+	if err := storageInstance.EndMaintenance(context.TODO(), "ab123"); err != nil {
+		t.Error("TestEndMaintenance should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestEndMaintenance, expected redis calls were not made: ", err.Error())
+	}
+}
@@ -2,40 +2,78 @@ package storage
 
 import (
 	"context"
-	"fmt"
-	"strings"
+	"sort"
+	"strconv"
+	"time"
 
 	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
+	metrics "github.com/a-castellano/AlarmStatusWatcher/metrics"
 	goredis "github.com/go-redis/redis/v8"
 )
 
+// DevicesKey is the set holding IDs of devices with stored status
+const DevicesKey = "devices"
+
 type AlarmStatus struct {
-	Online bool   `redis:"online"`
-	Firing bool   `redis:"firing"`
-	Mode   string `redis:"mode"`
-	Name   string `redis:"name"`
+	Online   bool   `redis:"online"`
+	Firing   bool   `redis:"firing"`
+	Mode     string `redis:"mode"`
+	Name     string `redis:"name"`
+	Failures int    `redis:"failures"`
 }
 
 type Storage struct {
 	RedisClient *goredis.Client
+	// UnavailableThreshold is the number of consecutive failed status
+	// requests after which a device is reported as unavailable, 0 disables it
+	UnavailableThreshold int
+	// HistoryRetention is how long changes are kept in history, 0 disables history
+	HistoryRetention time.Duration
+	Metrics          *metrics.Metrics
+}
+
+// Ping checks Redis connectivity
+func (storage Storage) Ping(ctx context.Context) error {
+	return storage.RedisClient.Ping(ctx).Err()
 }
 
-func (storage Storage) CheckAndUpdate(ctx context.Context, devicesInfo map[string]apiwatcher.DeviceInfo) (map[string]apiwatcher.DeviceInfo, map[string]string, map[string]bool, map[string]bool, error) {
-	newStatusMap := make(map[string]apiwatcher.DeviceInfo)
-	onlineChangedMap := make(map[string]bool)
-	modeChangedMap := make(map[string]bool)
-	changedStatusMap := make(map[string]string)
-	for deviceId, newDeviceInfo := range devicesInfo {
+// CheckAndUpdate compares devices status in apiInfo against stored status,
+// stores the new status and returns the changes found. Devices whose status
+// could not be retrieved keep their stored status and are returned as stale.
+func (storage Storage) CheckAndUpdate(ctx context.Context, apiInfo apiwatcher.APIInfo) (apiwatcher.APIInfo, []events.ChangeEvent, error) {
+	newInfo := apiwatcher.APIInfo{Time: apiInfo.Time}
+	newInfo.DevicesInfo = make(map[string]apiwatcher.DeviceInfo)
+	newInfo.DevicesStatus = make(map[string]apiwatcher.FetchStatus)
+	var changes []events.ChangeEvent
+
+	// Iterate in a stable order so events are always returned sorted by device
+	deviceIds := make([]string, 0, len(apiInfo.DevicesInfo)+len(apiInfo.DevicesStatus))
+	for deviceId := range apiInfo.DevicesInfo {
+		deviceIds = append(deviceIds, deviceId)
+	}
+	for deviceId := range apiInfo.DevicesStatus {
+		if _, ok := apiInfo.DevicesInfo[deviceId]; !ok {
+			deviceIds = append(deviceIds, deviceId)
+		}
+	}
+	sort.Strings(deviceIds)
 
-		onlineChangedMap[deviceId] = false
-		modeChangedMap[deviceId] = false
+	now := time.Now()
+	for _, deviceId := range deviceIds {
 
 		var storedAlarmStatus AlarmStatus
-		storedAlarmStatusError := storage.RedisClient.HGetAll(ctx, deviceId).Scan(&storedAlarmStatus)
-		if storedAlarmStatusError != goredis.Nil {
-			if storedAlarmStatusError != nil {
-				fmt.Println("ERRROR", storedAlarmStatusError)
-				return newStatusMap, changedStatusMap, modeChangedMap, onlineChangedMap, storedAlarmStatusError
+		start := time.Now()
+		storedAlarmStatusCmd := storage.RedisClient.HGetAll(ctx, deviceId)
+		storage.Metrics.ObserveRedis("hgetall", start)
+		storedAlarmStatusError := storedAlarmStatusCmd.Err()
+		known := storedAlarmStatusError == nil && len(storedAlarmStatusCmd.Val()) > 0
+		if storedAlarmStatusError != nil && storedAlarmStatusError != goredis.Nil {
+			return newInfo, changes, storedAlarmStatusError
+		}
+		if known {
+			if scanErr := storedAlarmStatusCmd.Scan(&storedAlarmStatus); scanErr != nil {
+				return newInfo, changes, scanErr
 			}
 		} else { // Value has not been set yet
 			storedAlarmStatus.Name = ""
@@ -44,43 +82,99 @@ func (storage Storage) CheckAndUpdate(ctx context.Context, devicesInfo map[strin
 			storedAlarmStatus.Online = false
 		}
 
+		fetchStatus := apiInfo.Status(deviceId)
+		if fetchStatus.State == apiwatcher.FetchCached && known {
+			// Device was not polled this time
+			newInfo.DevicesInfo[deviceId] = apiwatcher.DeviceInfo{Name: storedAlarmStatus.Name, Mode: storedAlarmStatus.Mode, Firing: storedAlarmStatus.Firing, Online: storedAlarmStatus.Online}
+			newInfo.DevicesStatus[deviceId] = fetchStatus
+			continue
+		}
+		if fetchStatus.State != apiwatcher.FetchOK {
+			// Status is unknown, keep stored values untouched
+			if !known {
+				newInfo.DevicesStatus[deviceId] = fetchStatus
+				continue
+			}
+			start = time.Now()
+			failures, failuresErr := storage.RedisClient.HIncrBy(ctx, deviceId, "failures", 1).Result()
+			storage.Metrics.ObserveRedis("hincrby", start)
+			if failuresErr != nil {
+				return newInfo, changes, failuresErr
+			}
+			if storage.UnavailableThreshold > 0 && int(failures) == storage.UnavailableThreshold {
+				changes = append(changes, events.New(deviceId, storedAlarmStatus.Name, events.FieldAvailable, "true", "false", now))
+			}
+			newInfo.DevicesInfo[deviceId] = apiwatcher.DeviceInfo{Name: storedAlarmStatus.Name, Mode: storedAlarmStatus.Mode, Firing: storedAlarmStatus.Firing, Online: storedAlarmStatus.Online}
+			newInfo.DevicesStatus[deviceId] = apiwatcher.FetchStatus{State: apiwatcher.FetchStale, Message: fetchStatus.Message}
+			continue
+		}
+		newDeviceInfo := apiInfo.DevicesInfo[deviceId]
+
+		if storedAlarmStatus.Failures > 0 {
+			if storage.UnavailableThreshold > 0 && storedAlarmStatus.Failures >= storage.UnavailableThreshold {
+				changes = append(changes, events.New(deviceId, newDeviceInfo.Name, events.FieldAvailable, "false", "true", now))
+			}
+			storage.RedisClient.HSet(ctx, deviceId, "failures", 0)
+		}
+
 		// Compare Values
-		changedStatusMap[deviceId] = ""
 		if storedAlarmStatus.Name != newDeviceInfo.Name {
-			changedStatusMap[deviceId] = fmt.Sprintf("%sChanged Name to %s ", changedStatusMap[deviceId], newDeviceInfo.Name)
+			changes = append(changes, events.New(deviceId, newDeviceInfo.Name, events.FieldName, storedAlarmStatus.Name, newDeviceInfo.Name, now))
 		}
-		storedAlarmStatus.Name = newDeviceInfo.Name
 		if storedAlarmStatus.Mode != newDeviceInfo.Mode && newDeviceInfo.Mode != "" && storedAlarmStatus.Mode != "" {
-			changedStatusMap[deviceId] = fmt.Sprintf("%sChanged Mode from %s to %s ", changedStatusMap[deviceId], storedAlarmStatus.Mode, newDeviceInfo.Mode)
-			modeChangedMap[deviceId] = true
+			changes = append(changes, events.New(deviceId, newDeviceInfo.Name, events.FieldMode, storedAlarmStatus.Mode, newDeviceInfo.Mode, now))
 		}
-		storedAlarmStatus.Mode = newDeviceInfo.Mode
 		if storedAlarmStatus.Firing != newDeviceInfo.Firing {
-			modeChangedMap[deviceId] = true
-			if newDeviceInfo.Firing == true {
-				changedStatusMap[deviceId] = fmt.Sprintf("%sStarted Firing ", changedStatusMap[deviceId])
-			} else {
-				changedStatusMap[deviceId] = fmt.Sprintf("%sStopped Firing ", changedStatusMap[deviceId])
-			}
+			changes = append(changes, events.New(deviceId, newDeviceInfo.Name, events.FieldFiring, strconv.FormatBool(storedAlarmStatus.Firing), strconv.FormatBool(newDeviceInfo.Firing), now))
 		}
-		storedAlarmStatus.Firing = newDeviceInfo.Firing
 		if storedAlarmStatus.Online != newDeviceInfo.Online {
-			onlineChangedMap[deviceId] = true
-			if newDeviceInfo.Online == true {
-				changedStatusMap[deviceId] = fmt.Sprintf("%sBecame Online ", changedStatusMap[deviceId])
-			} else {
-				changedStatusMap[deviceId] = fmt.Sprintf("%sBecame Offline ", changedStatusMap[deviceId])
-			}
+			changes = append(changes, events.New(deviceId, newDeviceInfo.Name, events.FieldOnline, strconv.FormatBool(storedAlarmStatus.Online), strconv.FormatBool(newDeviceInfo.Online), now))
 		}
-		storedAlarmStatus.Online = newDeviceInfo.Online
 
+		start = time.Now()
 		storage.RedisClient.HSet(ctx, deviceId, "name", newDeviceInfo.Name)
 		storage.RedisClient.HSet(ctx, deviceId, "mode", newDeviceInfo.Mode)
 		storage.RedisClient.HSet(ctx, deviceId, "online", newDeviceInfo.Online)
 		storage.RedisClient.HSet(ctx, deviceId, "firing", newDeviceInfo.Firing)
+		storage.Metrics.ObserveRedis("hset", start)
+		start = time.Now()
+		storage.RedisClient.SAdd(ctx, DevicesKey, deviceId)
+		storage.Metrics.ObserveRedis("sadd", start)
 
-		newStatusMap[deviceId] = newDeviceInfo
-		changedStatusMap[deviceId] = strings.TrimSpace(changedStatusMap[deviceId])
+		newInfo.DevicesInfo[deviceId] = newDeviceInfo
+		newInfo.DevicesStatus[deviceId] = apiwatcher.FetchStatus{State: apiwatcher.FetchOK}
+	}
+	return newInfo, changes, nil
+}
+
+// RemoveDevices deletes stored status and debounce state of devices no
+// longer listed by AlarmManager and returns their IDs sorted
+func (storage Storage) RemoveDevices(ctx context.Context, listed map[string]bool) ([]string, error) {
+	start := time.Now()
+	deviceIDs, membersErr := storage.RedisClient.SMembers(ctx, DevicesKey).Result()
+	storage.Metrics.ObserveRedis("smembers", start)
+	if membersErr != nil && membersErr != goredis.Nil {
+		return nil, membersErr
+	}
+	sort.Strings(deviceIDs)
+
+	var removed []string
+	for _, deviceID := range deviceIDs {
+		if listed[deviceID] {
+			continue
+		}
+		start = time.Now()
+		_, execErr := storage.RedisClient.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			pipe.Del(ctx, deviceID, debounceKey(deviceID))
+			pipe.SRem(ctx, DevicesKey, deviceID)
+			pipe.SRem(ctx, DebouncesKey, deviceID)
+			return nil
+		})
+		storage.Metrics.ObserveRedis("exec", start)
+		if execErr != nil {
+			return removed, execErr
+		}
+		removed = append(removed, deviceID)
 	}
-	return newStatusMap, changedStatusMap, modeChangedMap, onlineChangedMap, nil
+	return removed, nil
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	apiwatcher "github.com/a-castellano/AlarmStatusWatcher/apiwatcher"
+	events "github.com/a-castellano/AlarmStatusWatcher/events"
 	redismock "github.com/go-redis/redismock/v8"
 )
 
@@ -14,7 +15,7 @@ func TestNewsReadEmptySet(t *testing.T) {
 	var key string = "ab123"
 	mock.ExpectHGetAll(key).RedisNil()
 
-	storageInstance := Storage{db}
+	storageInstance := Storage{RedisClient: db}
 	var ctx = context.TODO()
 
 	deviceInfo := apiwatcher.DeviceInfo{Name: "Test", Mode: "test", Firing: false, Online: true}
@@ -22,15 +23,15 @@ func TestNewsReadEmptySet(t *testing.T) {
 
 	devicesInfo[key] = deviceInfo
 
-	newStatus, changedStatusMap, _, _, err := storageInstance.CheckAndUpdate(ctx, devicesInfo)
+	newStatus, changes, err := storageInstance.CheckAndUpdate(ctx, apiwatcher.APIInfo{DevicesInfo: devicesInfo})
 	if err != nil {
 		t.Error("TestNewsReadEmptySet should not fail. Error was ", err.Error())
 	}
-	if changedStatusMap[key] == "" {
-		t.Error("TestNewsReadEmptySet, should not contain empty changedStatusMap variable.")
+	if len(changes) == 0 {
+		t.Error("TestNewsReadEmptySet, should return change events.")
 	}
-	if newStatus[key].Name != "Test" {
-		t.Error("TestNewsReadEmptySet, name should be Test, not ", newStatus[key].Name)
+	if newStatus.DevicesInfo[key].Name != "Test" {
+		t.Error("TestNewsReadEmptySet, name should be Test, not ", newStatus.DevicesInfo[key].Name)
 	}
 
 }
@@ -47,7 +48,7 @@ func TestNewsReadNotChanged(t *testing.T) {
 	expectedValues["online"] = "true"
 
 	mock.ExpectHGetAll(key).SetVal(expectedValues)
-	storageInstance := Storage{db}
+	storageInstance := Storage{RedisClient: db}
 	var ctx = context.TODO()
 
 	deviceInfo := apiwatcher.DeviceInfo{Name: "Test", Mode: "armed", Firing: false, Online: true}
@@ -55,12 +56,12 @@ func TestNewsReadNotChanged(t *testing.T) {
 
 	devicesInfo[key] = deviceInfo
 
-	_, changedStatusMap, _, _, err := storageInstance.CheckAndUpdate(ctx, devicesInfo)
+	_, changes, err := storageInstance.CheckAndUpdate(ctx, apiwatcher.APIInfo{DevicesInfo: devicesInfo})
 	if err != nil {
 		t.Error("TestNewsReadNotChanged should not fail. Error was ", err.Error())
 	}
-	if changedStatusMap[key] != "" {
-		t.Error("TestNewsReadNotChanged, should be empty. It contains ", changedStatusMap[key])
+	if len(changes) != 0 {
+		t.Error("TestNewsReadNotChanged, should be empty. It contains ", events.RenderMessage(changes))
 	}
 
 }
@@ -77,7 +78,7 @@ func TestNewsReadStartedFirirng(t *testing.T) {
 	expectedValues["online"] = "true"
 
 	mock.ExpectHGetAll(key).SetVal(expectedValues)
-	storageInstance := Storage{db}
+	storageInstance := Storage{RedisClient: db}
 	var ctx = context.TODO()
 
 	deviceInfo := apiwatcher.DeviceInfo{Name: "Test", Mode: "armed", Firing: true, Online: true}
@@ -85,18 +86,21 @@ func TestNewsReadStartedFirirng(t *testing.T) {
 
 	devicesInfo[key] = deviceInfo
 
-	_, changedStatusMap, modeChangedMap, onlineChangedMap, err := storageInstance.CheckAndUpdate(ctx, devicesInfo)
+	_, changes, err := storageInstance.CheckAndUpdate(ctx, apiwatcher.APIInfo{DevicesInfo: devicesInfo})
 	if err != nil {
 		t.Error("TestNewsReadStartedFirirng should not fail. Error was ", err.Error())
 	}
-	if changedStatusMap[key] != "Started Firing" {
-		t.Errorf("TestNewsReadStartedFirirng, should be 'Started Firing'. It contains '%s'", changedStatusMap[key])
+	if events.RenderMessage(changes) != "Started Firing" {
+		t.Errorf("TestNewsReadStartedFirirng, should be 'Started Firing'. It contains '%s'", events.RenderMessage(changes))
 	}
-	if modeChangedMap[key] != true {
-		t.Error("TestNewsReadStartedFirirng, modeChangedMap should be true")
+	if len(changes) != 1 || changes[0].IsStatusChange() != true {
+		t.Error("TestNewsReadStartedFirirng, status change should be true")
 	}
-	if onlineChangedMap[key] != false {
-		t.Error("TestNewsReadStartedFirirng, onlineChangedMap should be false")
+	if len(changes) == 1 && changes[0].Severity != events.SeverityCritical {
+		t.Errorf("TestNewsReadStartedFirirng, severity should be critical, not %s", changes[0].Severity)
+	}
+	if len(changes) != 1 || changes[0].IsOnlineChange() != false {
+		t.Error("TestNewsReadStartedFirirng, online change should be false")
 	}
 
 }
@@ -113,7 +117,7 @@ func TestNewsReadStoppedFirirng(t *testing.T) {
 	expectedValues["online"] = "true"
 
 	mock.ExpectHGetAll(key).SetVal(expectedValues)
-	storageInstance := Storage{db}
+	storageInstance := Storage{RedisClient: db}
 	var ctx = context.TODO()
 
 	deviceInfo := apiwatcher.DeviceInfo{Name: "Test", Mode: "armed", Firing: false, Online: true}
@@ -121,18 +125,18 @@ func TestNewsReadStoppedFirirng(t *testing.T) {
 
 	devicesInfo[key] = deviceInfo
 
-	_, changedStatusMap, modeChangedMap, onlineChangedMap, err := storageInstance.CheckAndUpdate(ctx, devicesInfo)
+	_, changes, err := storageInstance.CheckAndUpdate(ctx, apiwatcher.APIInfo{DevicesInfo: devicesInfo})
 	if err != nil {
 		t.Error("TestNewsReadStoppedFirirng should not fail. Error was ", err.Error())
 	}
-	if changedStatusMap[key] != "Stopped Firing" {
-		t.Errorf("TestNewsReadStoppedFirirng, should be 'Stopped Firing'. It contains '%s'", changedStatusMap[key])
+	if events.RenderMessage(changes) != "Stopped Firing" {
+		t.Errorf("TestNewsReadStoppedFirirng, should be 'Stopped Firing'. It contains '%s'", events.RenderMessage(changes))
 	}
-	if modeChangedMap[key] != true {
-		t.Error("TestNewsReadStoppedFirirng, modeChangedMap should be true")
+	if len(changes) != 1 || changes[0].IsStatusChange() != true {
+		t.Error("TestNewsReadStoppedFirirng, status change should be true")
 	}
-	if onlineChangedMap[key] != false {
-		t.Error("TestNewsReadStoppedFirirng, onlineChangedMap should be false")
+	if len(changes) != 1 || changes[0].IsOnlineChange() != false {
+		t.Error("TestNewsReadStoppedFirirng, online change should be false")
 	}
 
 }
@@ -149,7 +153,7 @@ func TestNewsReadBecameOffline(t *testing.T) {
 	expectedValues["online"] = "true"
 
 	mock.ExpectHGetAll(key).SetVal(expectedValues)
-	storageInstance := Storage{db}
+	storageInstance := Storage{RedisClient: db}
 	var ctx = context.TODO()
 
 	deviceInfo := apiwatcher.DeviceInfo{Name: "Test", Mode: "armed", Firing: false, Online: false}
@@ -157,18 +161,18 @@ func TestNewsReadBecameOffline(t *testing.T) {
 
 	devicesInfo[key] = deviceInfo
 
-	_, changedStatusMap, modeChangedMap, onlineChangedMap, err := storageInstance.CheckAndUpdate(ctx, devicesInfo)
+	_, changes, err := storageInstance.CheckAndUpdate(ctx, apiwatcher.APIInfo{DevicesInfo: devicesInfo})
 	if err != nil {
 		t.Error("TestNewsReadBecameOffline should not fail. Error was ", err.Error())
 	}
-	if changedStatusMap[key] != "Became Offline" {
-		t.Errorf("TestNewsReadBecameOffline, should be 'Became Offline'. It contains '%s'", changedStatusMap[key])
+	if events.RenderMessage(changes) != "Became Offline" {
+		t.Errorf("TestNewsReadBecameOffline, should be 'Became Offline'. It contains '%s'", events.RenderMessage(changes))
 	}
-	if modeChangedMap[key] != false {
-		t.Error("TestNewsReadBecameOffline, modeChangedMap should be false")
+	if len(changes) != 1 || changes[0].IsStatusChange() != false {
+		t.Error("TestNewsReadBecameOffline, status change should be false")
 	}
-	if onlineChangedMap[key] != true {
-		t.Error("TestNewsReadBecameOffline, onlineChangedMap should be true")
+	if len(changes) != 1 || changes[0].IsOnlineChange() != true {
+		t.Error("TestNewsReadBecameOffline, online change should be true")
 	}
 
 }
@@ -185,7 +189,7 @@ func TestNewsReadBecameOnline(t *testing.T) {
 	expectedValues["online"] = "false"
 
 	mock.ExpectHGetAll(key).SetVal(expectedValues)
-	storageInstance := Storage{db}
+	storageInstance := Storage{RedisClient: db}
 	var ctx = context.TODO()
 
 	deviceInfo := apiwatcher.DeviceInfo{Name: "Test", Mode: "armed", Firing: false, Online: true}
@@ -193,18 +197,216 @@ func TestNewsReadBecameOnline(t *testing.T) {
 
 	devicesInfo[key] = deviceInfo
 
-	_, changedStatusMap, modeChangedMap, onlineChangedMap, err := storageInstance.CheckAndUpdate(ctx, devicesInfo)
+	_, changes, err := storageInstance.CheckAndUpdate(ctx, apiwatcher.APIInfo{DevicesInfo: devicesInfo})
 	if err != nil {
 		t.Error("TestNewsReadBecameOnline should not fail. Error was ", err.Error())
 	}
-	if changedStatusMap[key] != "Became Online" {
-		t.Errorf("TestNewsReadBecameOnline, should be 'Became Online'. It contains '%s'", changedStatusMap[key])
+	if events.RenderMessage(changes) != "Became Online" {
+		t.Errorf("TestNewsReadBecameOnline, should be 'Became Online'. It contains '%s'", events.RenderMessage(changes))
+	}
+	if len(changes) != 1 || changes[0].IsStatusChange() != false {
+		t.Error("TestNewsReadBecameOnline, status change should be false")
+	}
+	if len(changes) != 1 || changes[0].IsOnlineChange() != true {
+		t.Error("TestNewsReadBecameOnline, online change should be true")
+	}
+
+}
+
+func TestNewsReadChangedMode(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	var key string = "ab123"
+
+	expectedValues := make(map[string]string)
+	expectedValues["name"] = "Test"
+	expectedValues["mode"] = "armed"
+	expectedValues["firing"] = "false"
+	expectedValues["online"] = "true"
+
+	mock.ExpectHGetAll(key).SetVal(expectedValues)
+	storageInstance := Storage{RedisClient: db}
+	var ctx = context.TODO()
+
+	deviceInfo := apiwatcher.DeviceInfo{Name: "Test", Mode: "disarmed", Firing: false, Online: true}
+	devicesInfo := make(map[string]apiwatcher.DeviceInfo)
+
+	devicesInfo[key] = deviceInfo
+
+	_, changes, err := storageInstance.CheckAndUpdate(ctx, apiwatcher.APIInfo{DevicesInfo: devicesInfo})
+	if err != nil {
+		t.Error("TestNewsReadChangedMode should not fail. Error was ", err.Error())
+	}
+	if len(changes) != 1 {
+		t.Fatalf("TestNewsReadChangedMode, should return one change, not %d", len(changes))
+	}
+	change := changes[0]
+	if change.DeviceID != key || change.DeviceName != "Test" || change.Field != events.FieldMode {
+		t.Errorf("TestNewsReadChangedMode, unexpected change %+v", change)
+	}
+	if change.OldValue != "armed" || change.NewValue != "disarmed" {
+		t.Errorf("TestNewsReadChangedMode, mode should change from armed to disarmed, not from %s to %s", change.OldValue, change.NewValue)
+	}
+	if change.Severity != events.SeverityInfo {
+		t.Errorf("TestNewsReadChangedMode, severity should be info, not %s", change.Severity)
+	}
+	if change.Timestamp.IsZero() {
+		t.Error("TestNewsReadChangedMode, timestamp should be set")
+	}
+}
+
+func TestFailedDeviceKeepsStoredStatus(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	var key string = "ab123"
+
+	expectedValues := make(map[string]string)
+	expectedValues["name"] = "Test"
+	expectedValues["mode"] = "armed"
+	expectedValues["firing"] = "false"
+	expectedValues["online"] = "true"
+	expectedValues["failures"] = "1"
+
+	mock.ExpectHGetAll(key).SetVal(expectedValues)
+	mock.ExpectHIncrBy(key, "failures", 1).SetVal(2)
+	storageInstance := Storage{RedisClient: db, UnavailableThreshold: 2}
+	var ctx = context.TODO()
+
+	apiInfo := apiwatcher.APIInfo{DevicesInfo: map[string]apiwatcher.DeviceInfo{}, DevicesStatus: map[string]apiwatcher.FetchStatus{key: {State: apiwatcher.FetchError, Message: "timeout"}}}
+
+	newInfo, changes, err := storageInstance.CheckAndUpdate(ctx, apiInfo)
+	if err != nil {
+		t.Error("TestFailedDeviceKeepsStoredStatus should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestFailedDeviceKeepsStoredStatus, stored status should not be overwritten: ", err.Error())
+	}
+	if newInfo.Status(key).State != apiwatcher.FetchStale || newInfo.Status(key).Message != "timeout" {
+		t.Errorf("TestFailedDeviceKeepsStoredStatus, device should be stale, not %+v", newInfo.Status(key))
+	}
+	if newInfo.DevicesInfo[key].Mode != "armed" || newInfo.DevicesInfo[key].Name != "Test" {
+		t.Errorf("TestFailedDeviceKeepsStoredStatus, stale device should keep stored info, not %+v", newInfo.DevicesInfo[key])
+	}
+	if events.RenderMessage(changes) != "Status Unavailable" {
+		t.Errorf("TestFailedDeviceKeepsStoredStatus, should be 'Status Unavailable'. It contains '%s'", events.RenderMessage(changes))
+	}
+}
+
+func TestFailedUnknownDeviceIsSkipped(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	var key string = "ab123"
+
+	mock.ExpectHGetAll(key).RedisNil()
+	storageInstance := Storage{RedisClient: db, UnavailableThreshold: 1}
+	var ctx = context.TODO()
+
+	apiInfo := apiwatcher.APIInfo{DevicesInfo: map[string]apiwatcher.DeviceInfo{}, DevicesStatus: map[string]apiwatcher.FetchStatus{key: {State: apiwatcher.FetchError, Message: "Failed"}}}
+
+	newInfo, changes, err := storageInstance.CheckAndUpdate(ctx, apiInfo)
+	if err != nil {
+		t.Error("TestFailedUnknownDeviceIsSkipped should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestFailedUnknownDeviceIsSkipped, unexpected redis calls: ", err.Error())
 	}
-	if modeChangedMap[key] != false {
-		t.Error("TestNewsReadBecameOnline, modeChangedMap should be false")
+	if len(changes) != 0 {
+		t.Errorf("TestFailedUnknownDeviceIsSkipped, should not return changes. It contains '%s'", events.RenderMessage(changes))
 	}
-	if onlineChangedMap[key] != true {
-		t.Error("TestNewsReadBecameOnline, onlineChangedMap should be true")
+	if _, ok := newInfo.DevicesInfo[key]; ok {
+		t.Error("TestFailedUnknownDeviceIsSkipped, unknown device should not have info")
 	}
+	if newInfo.Status(key).State != apiwatcher.FetchError {
+		t.Errorf("TestFailedUnknownDeviceIsSkipped, device status should be error, not %s", newInfo.Status(key).State)
+	}
+}
+
+func TestDeviceStatusAvailableAgain(t *testing.T) {
+	db, mock := redismock.NewClientMock()
 
+	var key string = "ab123"
+
+	expectedValues := make(map[string]string)
+	expectedValues["name"] = "Test"
+	expectedValues["mode"] = "armed"
+	expectedValues["firing"] = "false"
+	expectedValues["online"] = "true"
+	expectedValues["failures"] = "3"
+
+	mock.ExpectHGetAll(key).SetVal(expectedValues)
+	storageInstance := Storage{RedisClient: db, UnavailableThreshold: 2}
+	var ctx = context.TODO()
+
+	deviceInfo := apiwatcher.DeviceInfo{Name: "Test", Mode: "armed", Firing: false, Online: true}
+	apiInfo := apiwatcher.APIInfo{DevicesInfo: map[string]apiwatcher.DeviceInfo{key: deviceInfo}}
+
+	newInfo, changes, err := storageInstance.CheckAndUpdate(ctx, apiInfo)
+	if err != nil {
+		t.Error("TestDeviceStatusAvailableAgain should not fail. Error was ", err.Error())
+	}
+	if events.RenderMessage(changes) != "Status Available" {
+		t.Errorf("TestDeviceStatusAvailableAgain, should be 'Status Available'. It contains '%s'", events.RenderMessage(changes))
+	}
+	if newInfo.Status(key).State != apiwatcher.FetchOK {
+		t.Errorf("TestDeviceStatusAvailableAgain, device status should be ok, not %s", newInfo.Status(key).State)
+	}
+}
+
+func TestCachedDeviceKeepsStoredStatus(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	var key string = "ab123"
+
+	expectedValues := make(map[string]string)
+	expectedValues["name"] = "Test"
+	expectedValues["mode"] = "armed"
+	expectedValues["firing"] = "false"
+	expectedValues["online"] = "true"
+
+	mock.ExpectHGetAll(key).SetVal(expectedValues)
+	storageInstance := Storage{RedisClient: db, UnavailableThreshold: 1}
+
+	apiInfo := apiwatcher.APIInfo{DevicesInfo: map[string]apiwatcher.DeviceInfo{}, DevicesStatus: map[string]apiwatcher.FetchStatus{key: {State: apiwatcher.FetchCached}}}
+
+	newInfo, changes, err := storageInstance.CheckAndUpdate(context.TODO(), apiInfo)
+	if err != nil {
+		t.Error("TestCachedDeviceKeepsStoredStatus should not fail. Error was ", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestCachedDeviceKeepsStoredStatus, unexpected redis calls: ", err.Error())
+	}
+	if len(changes) != 0 {
+		t.Errorf("TestCachedDeviceKeepsStoredStatus, should not return changes. It contains '%s'", events.RenderMessage(changes))
+	}
+	if newInfo.Status(key).State != apiwatcher.FetchCached || newInfo.DevicesInfo[key].Mode != "armed" {
+		t.Errorf("TestCachedDeviceKeepsStoredStatus, device should keep stored info as cached, got %+v %+v", newInfo.Status(key), newInfo.DevicesInfo[key])
+	}
+}
+
+func TestRemoveDevices(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock.ExpectSMembers("devices").SetVal([]string{"garage", "ab123", "old"})
+	mock.ExpectTxPipeline()
+	mock.ExpectDel("garage", "debounce:garage").SetVal(1)
+	mock.ExpectSRem("devices", "garage").SetVal(1)
+	mock.ExpectSRem("debounces", "garage").SetVal(0)
+	mock.ExpectTxPipelineExec()
+	mock.ExpectTxPipeline()
+	mock.ExpectDel("old", "debounce:old").SetVal(2)
+	mock.ExpectSRem("devices", "old").SetVal(1)
+	mock.ExpectSRem("debounces", "old").SetVal(1)
+	mock.ExpectTxPipelineExec()
+
+	storageInstance := Storage{RedisClient: db}
+	removed, err := storageInstance.RemoveDevices(context.TODO(), map[string]bool{"ab123": true})
+	if err != nil {
+		t.Fatal("TestRemoveDevices should not fail. Error was ", err.Error())
+	}
+	if len(removed) != 2 || removed[0] != "garage" || removed[1] != "old" {
+		t.Errorf("TestRemoveDevices, only devices no longer listed should be removed, removed %v", removed)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("TestRemoveDevices, expected redis calls were not made: ", err.Error())
+	}
 }